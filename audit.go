@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const redactedText = "[redacted]"
+
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	CommandSource
+	Device   string          `json:"device"`
+	Commands CommandSlice    `json:"commands"`
+	Ok       bool            `json:"ok"`
+	Results  []CommandResult `json:"results"`
+}
+
+type AuditLog struct {
+	mutex  sync.Mutex
+	config AuditLogConfig
+	file   *os.File
+	size   int64
+}
+
+var auditLog *AuditLog
+
+func openAuditLog(c AuditLogConfig) (*AuditLog, error) {
+	l := &AuditLog{config: c}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *AuditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	if l.config.MaxFiles == 0 {
+		err := os.Remove(l.config.File)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return l.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", l.config.File, l.config.MaxFiles))
+
+	for i := l.config.MaxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.config.File, i), fmt.Sprintf("%s.%d", l.config.File, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := os.Rename(l.config.File, l.config.File+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *AuditLog) redact(commands CommandSlice) CommandSlice {
+	redacted := make(CommandSlice, len(commands))
+
+	for i, command := range commands {
+		redacted[i] = slices.Clone(command)
+
+		args := redacted[i]
+		if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '@' {
+			args = args[1:]
+		}
+
+		if len(args) > 1 && slices.Contains(l.config.Redact, args[0]) {
+			args[1] = redactedText
+		}
+	}
+
+	return redacted
+}
+
+func (l *AuditLog) record(device string, source CommandSource, commands CommandSlice, results CommandResults) {
+	if l == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:          time.Now(),
+		CommandSource: source,
+		Device:        device,
+		Commands:      l.redact(commands),
+		Ok:            results.Ok,
+		Results:       make([]CommandResult, len(results.Results)),
+	}
+
+	for i, result := range results.Results {
+		result.Payload = ""
+		record.Results[i] = result
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("audit log record failed", "error", err)
+		return
+	}
+
+	data = append(data, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		err = l.open()
+		if err != nil {
+			slog.Error("audit log open failed", "file", l.config.File, "error", err)
+			return
+		}
+	}
+
+	if l.config.MaxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.config.MaxSize {
+		err = l.rotate()
+		if err != nil {
+			slog.Error("audit log rotation failed", "file", l.config.File, "error", err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("audit log write failed", "file", l.config.File, "error", err)
+	}
+}
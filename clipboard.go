@@ -2,14 +2,16 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
-func getClipboard(cut bool) bool {
+func (s *Session) getClipboard(cut bool) error {
 	data := make([]byte, 2)
 	data[0] = ScrcpyControlMessageTypes.GetClipboard
 	if cut {
@@ -18,18 +20,18 @@ func getClipboard(cut bool) bool {
 		data[1] = 0x01
 	}
 
-	n, err := controlSocket.Write(data)
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != 2 {
-		return false
+		return io.ErrShortWrite
 	}
 
-	return true
+	return nil
 }
 
-func setClipboard(text string, sequence int, paste bool, timeout time.Duration) bool {
+func (s *Session) setClipboard(text string, sequence int, paste bool, timeout time.Duration) error {
 	data := make([]byte, 14+len(text))
 	data[0] = ScrcpyControlMessageTypes.SetClipboard
 	binary.BigEndian.PutUint64(data[1:], uint64(sequence))
@@ -39,32 +41,41 @@ func setClipboard(text string, sequence int, paste bool, timeout time.Duration)
 	binary.BigEndian.PutUint32(data[10:], uint32(len(text)))
 	copy(data[14:], []byte(text))
 
-	n, err := controlSocket.Write(data)
+	var events chan Event
+	if timeout > 0 {
+		events = s.events.subscribe(eventSubscriberBuffer, "ackclipboard")
+		defer s.events.unsubscribe(events)
+	}
+
+	start := time.Now()
+
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != len(data) {
-		return false
+		return io.ErrShortWrite
 	}
 
 	if timeout > 0 {
-		select {
-		case s := <-clipboardChannel:
-			if s != strconv.Itoa(sequence) {
-				return false
-			}
-		case <-time.After(timeout):
-			return false
+		_, ok := waitEvent(events, timeout, func(e Event) bool {
+			return e.Type == "ackclipboard" && e.Data == strconv.Itoa(sequence)
+		})
+		if !ok {
+			return errors.New("timed out waiting for clipboard acknowledgement")
 		}
+
+		s.clipboardRoundTrip.observe(time.Since(start))
 	}
 
-	return true
+	return nil
 }
 
 func clipboardHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -92,26 +103,41 @@ func clipboardHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		if controlSocket == nil {
+		if s.controlSocket == nil {
 			http.NotFound(w, req)
 			return
 		}
 
-		if !getClipboard(req.URL.Path == "/clipboardcut") {
+		events := s.events.subscribe(eventSubscriberBuffer, "clipboard")
+		defer s.events.unsubscribe(events)
+
+		var e Event
+
+		err := s.runAction(httpCommandSource("http", req), []string{req.URL.Path[1:]}, func() error {
+			err := s.getClipboard(req.URL.Path == "/clipboardcut")
+			if err != nil {
+				return err
+			}
+
+			var ok bool
+			e, ok = waitEvent(events, 2*time.Second, func(e Event) bool { return e.Type == "clipboard" })
+			if !ok {
+				return errors.New("timed out waiting for clipboard")
+			}
+
+			return nil
+		})
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		select {
-		case s := <-clipboardChannel:
-			if strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
-				w.Write([]byte(s))
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		case <-time.After(2 * time.Second):
-			w.WriteHeader(http.StatusInternalServerError)
+		lineBytes, err := json.Marshal(e.Data)
+		if err != nil {
+			panic(err)
 		}
+
+		w.Write(lineBytes)
 	default:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
@@ -124,9 +150,10 @@ func clipboardHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func setClipboardHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -170,7 +197,15 @@ func setClipboardHandler(w http.ResponseWriter, req *http.Request) {
 			timeout = 2 * time.Second
 		}
 
-		if !setClipboard(query.Get("text"), sequence, req.URL.Path == "/setclipboardpaste", timeout) {
+		command := []string{req.URL.Path[1:], query.Get("text")}
+		if sequenceString != "" {
+			command = append(command, sequenceString)
+		}
+
+		err = s.runAction(httpCommandSource("http", req), command, func() error {
+			return s.setClipboard(query.Get("text"), sequence, req.URL.Path == "/setclipboardpaste", timeout)
+		})
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -188,9 +223,10 @@ func setClipboardHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func clipboardStreamHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -218,16 +254,36 @@ func clipboardStreamHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
+		events := s.events.subscribe(eventSubscriberBuffer, "clipboard", "ackclipboard")
+		defer s.events.unsubscribe(events)
+
 		var err error
 
 		for {
 			select {
-			case line := <-clipboardChannel:
-				_, err = fmt.Fprintln(w, line)
-				if err != nil {
+			case e, ok := <-events:
+				if !ok {
 					return
 				}
 
+				switch e.Type {
+				case "clipboard":
+					lineBytes, err := json.Marshal(e.Data)
+					if err != nil {
+						panic(err)
+					}
+
+					_, err = fmt.Fprintln(w, string(lineBytes))
+					if err != nil {
+						return
+					}
+				case "ackclipboard":
+					_, err = fmt.Fprintln(w, e.Data)
+					if err != nil {
+						return
+					}
+				}
+
 				w.(http.Flusher).Flush()
 			case <-req.Context().Done():
 				return
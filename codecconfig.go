@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	var v uint64
+
+	for i := 0; i < n; i++ {
+		v <<= 1
+
+		if r.pos/8 < len(r.data) {
+			v |= uint64(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+		}
+
+		r.pos++
+	}
+
+	return v
+}
+
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+
+	for r.bits(1) == 0 {
+		zeros++
+		if zeros > 32 {
+			return 0
+		}
+	}
+
+	return (1 << zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) uvlc() uint64 {
+	zeros := 0
+
+	for r.bits(1) == 0 {
+		zeros++
+		if zeros >= 32 {
+			return (1 << 32) - 1
+		}
+	}
+
+	return (1 << zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) overrun() bool {
+	return r.pos > len(r.data)*8
+}
+
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+
+	for i := 0; i+2 < len(data); {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+
+			if end > start {
+				nals = append(nals, data[start:end])
+			}
+		}
+
+		i += 3
+		start = i
+	}
+
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+
+	return nals
+}
+
+func annexBToLengthPrefixed(data []byte) []byte {
+	var out []byte
+
+	for _, nal := range splitAnnexB(data) {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nal)))
+		out = append(out, nal...)
+	}
+
+	return out
+}
+
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+func avcDecoderConfiguration(config []byte) ([]byte, error) {
+	var sps, pps [][]byte
+
+	for _, nal := range splitAnnexB(config) {
+		switch nal[0] & 0x1F {
+		case 7:
+			sps = append(sps, nal)
+		case 8:
+			pps = append(pps, nal)
+		}
+	}
+
+	if len(sps) == 0 || len(pps) == 0 || len(sps[0]) < 4 {
+		return nil, errors.New("missing h264 parameter sets")
+	}
+
+	record := []byte{1, sps[0][1], sps[0][2], sps[0][3], 0xFF, 0xE0 | byte(len(sps))}
+
+	for _, nal := range sps {
+		record = binary.BigEndian.AppendUint16(record, uint16(len(nal)))
+		record = append(record, nal...)
+	}
+
+	record = append(record, byte(len(pps)))
+
+	for _, nal := range pps {
+		record = binary.BigEndian.AppendUint16(record, uint16(len(nal)))
+		record = append(record, nal...)
+	}
+
+	return record, nil
+}
+
+func hevcDecoderConfiguration(config []byte) ([]byte, error) {
+	parameterSets := map[byte][][]byte{}
+
+	for _, nal := range splitAnnexB(config) {
+		if len(nal) < 2 {
+			continue
+		}
+
+		nalType := (nal[0] >> 1) & 0x3F
+		if nalType >= 32 && nalType <= 34 {
+			parameterSets[nalType] = append(parameterSets[nalType], nal)
+		}
+	}
+
+	if len(parameterSets[32]) == 0 || len(parameterSets[33]) == 0 || len(parameterSets[34]) == 0 {
+		return nil, errors.New("missing h265 parameter sets")
+	}
+
+	sps := removeEmulationPrevention(parameterSets[33][0][2:])
+	if len(sps) < 13 {
+		return nil, errors.New("invalid h265 sequence parameter set")
+	}
+
+	r := &bitReader{data: sps}
+	r.bits(4)
+	maxSubLayersMinus1 := int(r.bits(3))
+	temporalIdNested := r.bits(1)
+	r.bits(96)
+
+	subLayerProfilePresent := make([]bool, maxSubLayersMinus1)
+	subLayerLevelPresent := make([]bool, maxSubLayersMinus1)
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		subLayerProfilePresent[i] = r.bits(1) == 1
+		subLayerLevelPresent[i] = r.bits(1) == 1
+	}
+
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.bits(2)
+		}
+	}
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if subLayerProfilePresent[i] {
+			r.bits(88)
+		}
+
+		if subLayerLevelPresent[i] {
+			r.bits(8)
+		}
+	}
+
+	r.ue()
+	chromaFormat := r.ue()
+	if chromaFormat == 3 {
+		r.bits(1)
+	}
+
+	r.ue()
+	r.ue()
+
+	if r.bits(1) == 1 {
+		r.ue()
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+
+	bitDepthLumaMinus8 := r.ue()
+	bitDepthChromaMinus8 := r.ue()
+
+	if r.overrun() {
+		return nil, errors.New("invalid h265 sequence parameter set")
+	}
+
+	record := []byte{1}
+	record = append(record, sps[1:13]...)
+	record = append(
+		record,
+		0xF0,
+		0x00,
+		0xFC,
+		0xFC|byte(chromaFormat&3),
+		0xF8|byte(bitDepthLumaMinus8&7),
+		0xF8|byte(bitDepthChromaMinus8&7),
+		0x00,
+		0x00,
+		byte(maxSubLayersMinus1+1)<<3|byte(temporalIdNested)<<2|3,
+		3,
+	)
+
+	for _, nalType := range []byte{32, 33, 34} {
+		record = append(record, 0x80|nalType)
+		record = binary.BigEndian.AppendUint16(record, uint16(len(parameterSets[nalType])))
+
+		for _, nal := range parameterSets[nalType] {
+			record = binary.BigEndian.AppendUint16(record, uint16(len(nal)))
+			record = append(record, nal...)
+		}
+	}
+
+	return record, nil
+}
+
+type av1Obu struct {
+	obuType byte
+	data    []byte
+	payload []byte
+}
+
+func splitAv1Obus(data []byte) ([]av1Obu, error) {
+	var obus []av1Obu
+
+	for len(data) > 0 {
+		headerSize := 1 + int(data[0]>>2&1)
+		if len(data) < headerSize {
+			return nil, errors.New("truncated av1 obu")
+		}
+
+		size := uint64(len(data) - headerSize)
+		sizeLength := 0
+
+		if data[0]>>1&1 == 1 {
+			size = 0
+
+			for ; sizeLength < 8 && headerSize+sizeLength < len(data); sizeLength++ {
+				b := data[headerSize+sizeLength]
+				size |= uint64(b&0x7F) << (7 * sizeLength)
+
+				if b&0x80 == 0 {
+					break
+				}
+			}
+
+			sizeLength++
+		}
+
+		if size > uint64(len(data)-headerSize-sizeLength) {
+			return nil, errors.New("truncated av1 obu")
+		}
+
+		end := headerSize + sizeLength + int(size)
+
+		obus = append(obus, av1Obu{
+			obuType: data[0] >> 3 & 0x0F,
+			data:    data[:end],
+			payload: data[headerSize+sizeLength : end],
+		})
+
+		data = data[end:]
+	}
+
+	return obus, nil
+}
+
+func av1StripTemporalDelimiters(data []byte) []byte {
+	obus, err := splitAv1Obus(data)
+	if err != nil {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+
+	for _, obu := range obus {
+		if obu.obuType != 2 {
+			out = append(out, obu.data...)
+		}
+	}
+
+	return out
+}
+
+func av1CodecConfiguration(config []byte) ([]byte, error) {
+	if len(config) >= 4 && config[0] == 0x81 {
+		return config, nil
+	}
+
+	obus, err := splitAv1Obus(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var sequenceHeader *av1Obu
+
+	for i := range obus {
+		if obus[i].obuType == 1 {
+			sequenceHeader = &obus[i]
+			break
+		}
+	}
+
+	if sequenceHeader == nil {
+		return nil, errors.New("missing av1 sequence header")
+	}
+
+	r := &bitReader{data: sequenceHeader.payload}
+	profile := r.bits(3)
+	r.bits(1)
+	reducedStillPictureHeader := r.bits(1) == 1
+
+	var level, tier uint64
+
+	if reducedStillPictureHeader {
+		level = r.bits(5)
+	} else {
+		var decoderModelInfoPresent bool
+		var bufferDelayLength int
+
+		if r.bits(1) == 1 {
+			r.bits(64)
+			if r.bits(1) == 1 {
+				r.uvlc()
+			}
+
+			if r.bits(1) == 1 {
+				decoderModelInfoPresent = true
+				bufferDelayLength = int(r.bits(5)) + 1
+				r.bits(42)
+			}
+		}
+
+		initialDisplayDelayPresent := r.bits(1) == 1
+		operatingPoints := int(r.bits(5)) + 1
+
+		for i := 0; i < operatingPoints; i++ {
+			r.bits(12)
+			operatingPointLevel := r.bits(5)
+
+			var operatingPointTier uint64
+			if operatingPointLevel > 7 {
+				operatingPointTier = r.bits(1)
+			}
+
+			if decoderModelInfoPresent && r.bits(1) == 1 {
+				r.bits(2*bufferDelayLength + 1)
+			}
+
+			if initialDisplayDelayPresent && r.bits(1) == 1 {
+				r.bits(4)
+			}
+
+			if i == 0 {
+				level = operatingPointLevel
+				tier = operatingPointTier
+			}
+		}
+	}
+
+	widthBits := int(r.bits(4)) + 1
+	heightBits := int(r.bits(4)) + 1
+	r.bits(widthBits + heightBits)
+
+	if !reducedStillPictureHeader && r.bits(1) == 1 {
+		r.bits(7)
+	}
+
+	r.bits(3)
+
+	if !reducedStillPictureHeader {
+		r.bits(4)
+
+		orderHint := r.bits(1) == 1
+		if orderHint {
+			r.bits(2)
+		}
+
+		forceScreenContentTools := uint64(2)
+		if r.bits(1) == 0 {
+			forceScreenContentTools = r.bits(1)
+		}
+
+		if forceScreenContentTools > 0 && r.bits(1) == 0 {
+			r.bits(1)
+		}
+
+		if orderHint {
+			r.bits(3)
+		}
+	}
+
+	r.bits(3)
+
+	highBitdepth := r.bits(1)
+
+	var twelveBit uint64
+	if profile == 2 && highBitdepth == 1 {
+		twelveBit = r.bits(1)
+	}
+
+	var monochrome uint64
+	if profile != 1 {
+		monochrome = r.bits(1)
+	}
+
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint64(2), uint64(2), uint64(2)
+	if r.bits(1) == 1 {
+		colorPrimaries = r.bits(8)
+		transferCharacteristics = r.bits(8)
+		matrixCoefficients = r.bits(8)
+	}
+
+	var subsamplingX, subsamplingY, chromaSamplePosition uint64
+
+	if monochrome == 1 {
+		subsamplingX, subsamplingY = 1, 1
+	} else if colorPrimaries == 1 && transferCharacteristics == 13 && matrixCoefficients == 0 {
+		subsamplingX, subsamplingY = 0, 0
+	} else {
+		r.bits(1)
+
+		switch profile {
+		case 0:
+			subsamplingX, subsamplingY = 1, 1
+		case 1:
+			subsamplingX, subsamplingY = 0, 0
+		default:
+			if twelveBit == 1 {
+				subsamplingX = r.bits(1)
+				if subsamplingX == 1 {
+					subsamplingY = r.bits(1)
+				}
+			} else {
+				subsamplingX, subsamplingY = 1, 0
+			}
+		}
+
+		if subsamplingX == 1 && subsamplingY == 1 {
+			chromaSamplePosition = r.bits(2)
+		}
+	}
+
+	if r.overrun() {
+		return nil, errors.New("invalid av1 sequence header")
+	}
+
+	record := []byte{
+		0x81,
+		byte(profile<<5 | level),
+		byte(tier<<7 | highBitdepth<<6 | twelveBit<<5 | monochrome<<4 | subsamplingX<<3 | subsamplingY<<2 | chromaSamplePosition),
+		0x00,
+	}
+
+	return append(record, sequenceHeader.data...), nil
+}
+
+func opusHead(config []byte) ([]byte, error) {
+	if len(config) < 19 || string(config[:8]) != "OpusHead" {
+		return nil, errors.New("invalid opus header")
+	}
+
+	return config, nil
+}
+
+func flacStreamInfo(config []byte) ([]byte, error) {
+	if len(config) >= 42 && string(config[:4]) == "fLaC" {
+		config = config[8:]
+	}
+
+	if len(config) < 34 {
+		return nil, errors.New("invalid flac stream info")
+	}
+
+	return config[:34], nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/bits"
+	"testing"
+)
+
+var testH264Sps = mustDecodeHex("6764002aacd940780227e5c044000003000400000300c83c60c658")
+var testH264Pps = mustDecodeHex("68ebe3cb22c0")
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func annexB(nals ...[]byte) []byte {
+	var data []byte
+	for _, nal := range nals {
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, nal...)
+	}
+
+	return data
+}
+
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bits(n int, v uint64) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint64) {
+	length := bits.Len64(v + 1)
+	w.bits(length-1, 0)
+	w.bits(length, v+1)
+}
+
+func (w *bitWriter) trailing() []byte {
+	w.bits(1, 1)
+	for w.n%8 != 0 {
+		w.bits(1, 0)
+	}
+
+	return w.data
+}
+
+func addEmulationPrevention(data []byte) []byte {
+	var out []byte
+	zeros := 0
+
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{"four byte start codes", []byte{0, 0, 0, 1, 0x67, 1, 0, 0, 0, 1, 0x68, 2}, [][]byte{{0x67, 1}, {0x68, 2}}},
+		{"three byte start codes", []byte{0, 0, 1, 0x65, 1, 2, 0, 0, 1, 0x41}, [][]byte{{0x65, 1, 2}, {0x41}}},
+		{"trailing zeros", []byte{0, 0, 1, 0x65, 1, 0, 0, 0, 0, 1, 0x41, 0}, [][]byte{{0x65, 1}, {0x41, 0}}},
+		{"empty units", []byte{0, 0, 1, 0, 0, 1, 0x41}, [][]byte{{0x41}}},
+		{"no start code", []byte{0x41, 1, 2}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := splitAnnexB(test.data)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %x, want %x", got, test.want)
+			}
+
+			for i := range got {
+				if !bytes.Equal(got[i], test.want[i]) {
+					t.Fatalf("got %x, want %x", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAnnexBToLengthPrefixed(t *testing.T) {
+	got := annexBToLengthPrefixed([]byte{0, 0, 0, 1, 0x65, 1, 2, 0, 0, 1, 0x41})
+	want := []byte{0, 0, 0, 3, 0x65, 1, 2, 0, 0, 0, 1, 0x41}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestRemoveEmulationPrevention(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{[]byte{0, 0, 3, 1}, []byte{0, 0, 1}},
+		{[]byte{0, 0, 3, 0, 0, 3, 0}, []byte{0, 0, 0, 0, 0}},
+		{[]byte{0, 3, 0, 3}, []byte{0, 3, 0, 3}},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		got := removeEmulationPrevention(test.data)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("removeEmulationPrevention(%x) = %x, want %x", test.data, got, test.want)
+		}
+	}
+}
+
+func TestAvcDecoderConfiguration(t *testing.T) {
+	record, err := avcDecoderConfiguration(annexB(testH264Sps, testH264Pps))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{1, 0x64, 0x00, 0x2A, 0xFF, 0xE1, 0, byte(len(testH264Sps))}
+	want = append(want, testH264Sps...)
+	want = append(want, 1, 0, byte(len(testH264Pps)))
+	want = append(want, testH264Pps...)
+
+	if !bytes.Equal(record, want) {
+		t.Fatalf("got %x, want %x", record, want)
+	}
+
+	_, err = avcDecoderConfiguration(annexB(testH264Sps))
+	if err == nil {
+		t.Fatal("expected an error without a picture parameter set")
+	}
+}
+
+func TestHevcDecoderConfiguration(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0C, 0x01}
+	pps := []byte{0x44, 0x01, 0xC1, 0x73}
+
+	w := &bitWriter{}
+	w.bits(4, 0)
+	w.bits(3, 0)
+	w.bits(1, 1)
+	w.bits(2, 0)
+	w.bits(1, 0)
+	w.bits(5, 1)
+	w.bits(32, 0x60000000)
+	w.bits(4, 0b1001)
+	w.bits(44, 0)
+	w.bits(8, 120)
+	w.ue(0)
+	w.ue(1)
+	w.ue(1080)
+	w.ue(1920)
+	w.bits(1, 0)
+	w.ue(2)
+	w.ue(2)
+	rbsp := w.trailing()
+
+	sps := append([]byte{0x42, 0x01}, addEmulationPrevention(rbsp)...)
+	if bytes.Equal(sps[2:], rbsp) {
+		t.Fatal("expected the test sequence parameter set to need emulation prevention")
+	}
+
+	record, err := hevcDecoderConfiguration(annexB(vps, sps, pps))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{1}
+	want = append(want, rbsp[1:13]...)
+	want = append(want, 0xF0, 0x00, 0xFC, 0xFD, 0xFA, 0xFA, 0x00, 0x00, 0x0F, 3)
+
+	for _, nal := range [][]byte{vps, sps, pps} {
+		want = append(want, 0x80|nal[0]>>1, 0, 1, 0, byte(len(nal)))
+		want = append(want, nal...)
+	}
+
+	if !bytes.Equal(record, want) {
+		t.Fatalf("got %x, want %x", record, want)
+	}
+
+	_, err = hevcDecoderConfiguration(annexB(vps, sps))
+	if err == nil {
+		t.Fatal("expected an error without a picture parameter set")
+	}
+
+	_, err = hevcDecoderConfiguration(annexB(vps, sps[:8], pps))
+	if err == nil {
+		t.Fatal("expected an error for a truncated sequence parameter set")
+	}
+}
+
+func TestAv1CodecConfiguration(t *testing.T) {
+	w := &bitWriter{}
+	w.bits(3, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(5, 0)
+	w.bits(12, 0)
+	w.bits(5, 8)
+	w.bits(1, 1)
+	w.bits(4, 10)
+	w.bits(4, 10)
+	w.bits(11, 1079)
+	w.bits(11, 1919)
+	w.bits(1, 0)
+	w.bits(3, 0)
+	w.bits(4, 0)
+	w.bits(1, 1)
+	w.bits(2, 0)
+	w.bits(1, 1)
+	w.bits(1, 1)
+	w.bits(3, 6)
+	w.bits(3, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	w.bits(2, 0)
+	w.bits(1, 0)
+	w.bits(1, 0)
+	payload := w.trailing()
+
+	sequenceHeader := append([]byte{0x0A, byte(len(payload))}, payload...)
+	temporalDelimiter := []byte{0x12, 0x00}
+
+	record, err := av1CodecConfiguration(append(temporalDelimiter, sequenceHeader...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]byte{0x81, 0x08, 0x8C, 0x00}, sequenceHeader...)
+	if !bytes.Equal(record, want) {
+		t.Fatalf("got %x, want %x", record, want)
+	}
+
+	record, err = av1CodecConfiguration(want)
+	if err != nil || !bytes.Equal(record, want) {
+		t.Fatalf("got %x, %v, want the existing record back", record, err)
+	}
+
+	_, err = av1CodecConfiguration(temporalDelimiter)
+	if err == nil {
+		t.Fatal("expected an error without a sequence header")
+	}
+
+	_, err = av1CodecConfiguration([]byte{0x0A, 0x10, 0x00})
+	if err == nil {
+		t.Fatal("expected an error for a truncated obu")
+	}
+
+	frame := []byte{0x32, 0x02, 0xAB, 0xCD}
+	stripped := av1StripTemporalDelimiters(append(append(temporalDelimiter, sequenceHeader...), frame...))
+	if !bytes.Equal(stripped, append(append([]byte{}, sequenceHeader...), frame...)) {
+		t.Fatalf("got %x, want the sequence header and frame without the temporal delimiter", stripped)
+	}
+}
+
+func TestOpusHead(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0)
+
+	got, err := opusHead(head)
+	if err != nil || !bytes.Equal(got, head) {
+		t.Fatalf("got %x, %v, want %x", got, err, head)
+	}
+
+	_, err = opusHead(head[:18])
+	if err == nil {
+		t.Fatal("expected an error for a truncated header")
+	}
+
+	_, err = opusHead(append([]byte("OpusTags"), head[8:]...))
+	if err == nil {
+		t.Fatal("expected an error for a different magic signature")
+	}
+}
+
+func TestFlacStreamInfo(t *testing.T) {
+	info := bytes.Repeat([]byte{0x12}, 34)
+
+	got, err := flacStreamInfo(info)
+	if err != nil || !bytes.Equal(got, info) {
+		t.Fatalf("got %x, %v, want %x", got, err, info)
+	}
+
+	got, err = flacStreamInfo(append(append([]byte("fLaC\x80\x00\x00\x22"), info...), 0xFF))
+	if err != nil || !bytes.Equal(got, info) {
+		t.Fatalf("got %x, %v, want %x", got, err, info)
+	}
+
+	_, err = flacStreamInfo(info[:33])
+	if err == nil {
+		t.Fatal("expected an error for a truncated stream info block")
+	}
+}
@@ -3,794 +3,1000 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
+	"log/slog"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func runCommands(commands CommandSlice) bool {
-	for _, command := range commands {
+type CommandResult struct {
+	Index    int     `json:"index"`
+	Command  string  `json:"command"`
+	Ok       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+	Payload  string  `json:"payload,omitempty"`
+}
+
+type CommandResults struct {
+	Ok      bool            `json:"ok"`
+	Results []CommandResult `json:"results"`
+}
+
+type CommandSource struct {
+	Transport     string `json:"transport"`
+	RemoteAddress string `json:"remoteAddress,omitempty"`
+	TlsClient     string `json:"tlsClient,omitempty"`
+	HttpEndpoint  string `json:"httpEndpoint,omitempty"`
+	nested        bool
+}
+
+var errInvalidArguments = errors.New("invalid arguments")
+var errConnectionBusy = errors.New("connection is busy")
+
+func (source CommandSource) logAttrs() []any {
+	attrs := []any{"transport", source.Transport}
+
+	if source.RemoteAddress != "" {
+		attrs = append(attrs, "remoteAddress", source.RemoteAddress)
+	}
+
+	if source.TlsClient != "" {
+		attrs = append(attrs, "tlsClient", source.TlsClient)
+	}
+
+	if source.HttpEndpoint != "" {
+		attrs = append(attrs, "httpEndpoint", source.HttpEndpoint)
+	}
+
+	return attrs
+}
+
+func (s *Session) runCommands(source CommandSource, commands CommandSlice) CommandResults {
+	results := CommandResults{Ok: true, Results: make([]CommandResult, 0, len(commands))}
+	device := s.Name
+
+	for i, command := range commands {
+		result := CommandResult{Index: i}
+		start := time.Now()
+		target := s
+		var name string
+		var err error
+
 		if len(command) == 0 {
-			return false
+			err = errors.New("empty command")
+		} else if strings.HasPrefix(command[0], "@") {
+			result.Command = command[0]
+			name = command[0]
+
+			t, ok := sessions[command[0][1:]]
+			if !ok {
+				err = errors.New("unknown device")
+			} else if len(command) == 1 {
+				s = t
+				target = t
+			} else {
+				target = t
+				name = command[1]
+				result.Payload, err = t.runCommand(source, command[1:])
+			}
+		} else {
+			result.Command = command[0]
+			name = command[0]
+			result.Payload, err = s.runCommand(source, command)
 		}
 
-		cs, ok := config.CustomCommands[command[0]]
-		if ok {
-			if runCommands(cs) {
-				continue
-			} else {
-				return false
-			}
+		result.Duration = time.Since(start).Seconds()
+
+		countCommand(target.Name, name, source.Transport, err)
+
+		attrs := append([]any{"device", s.Name, "command", result.Command, "duration", result.Duration}, source.logAttrs()...)
+
+		if err != nil {
+			slog.Warn("command failed", append(attrs, "error", err)...)
+
+			result.Error = err.Error()
+			results.Ok = false
+			results.Results = append(results.Results, result)
+			break
 		}
 
-		if !config.Scrcpy.Enabled && command[0] != "sleep" && command[0] != "adb" && command[0] != "adb2" {
-			return false
-		} else if controlSocket == nil && command[0] != "connect" && command[0] != "startscrcpyserver" && command[0] != "sleep" && command[0] != "adb" && command[0] != "adb2" && command[0] != "setconnectedcommands" {
-			return false
+		slog.Info("command executed", attrs...)
+
+		result.Ok = true
+		results.Results = append(results.Results, result)
+	}
+
+	if !source.nested {
+		auditLog.record(device, source, commands, results)
+	}
+
+	return results
+}
+
+func (s *Session) runAction(source CommandSource, command []string, action func() error) error {
+	start := time.Now()
+	err := action()
+	result := CommandResult{Command: command[0], Ok: err == nil, Duration: time.Since(start).Seconds()}
+
+	countCommand(s.Name, command[0], source.Transport, err)
+
+	attrs := append([]any{"device", s.Name, "command", result.Command, "duration", result.Duration}, source.logAttrs()...)
+
+	if err != nil {
+		slog.Warn("command failed", append(attrs, "error", err)...)
+		result.Error = err.Error()
+	} else {
+		slog.Info("command executed", attrs...)
+	}
+
+	auditLog.record(s.Name, source, CommandSlice{command}, CommandResults{Ok: result.Ok, Results: []CommandResult{result}})
+
+	return err
+}
+
+func (s *Session) runCommand(source CommandSource, command []string) (string, error) {
+	device := s.device()
+
+	var err error
+
+	cs, ok := customCommand(command[0])
+	if ok {
+		nested := source
+		nested.nested = true
+
+		results := s.runCommands(nested, cs)
+		if len(results.Results) == 0 {
+			return "", nil
 		}
 
-		switch command[0] {
-		case "connect":
-			if len(command) == 1 {
-				select {
-				case connectionControlChannel <- config.Scrcpy.Address:
-				default:
-					return false
-				}
-			} else if len(command) == 2 && config.Scrcpy.Forward {
-				select {
-				case connectionControlChannel <- command[1]:
-				default:
-					return false
-				}
-			} else {
-				return false
-			}
-		case "disconnect":
-			if len(command) == 1 {
-				if scrcpyServer != nil {
-					return false
-				}
+		last := results.Results[len(results.Results)-1]
+		if !results.Ok {
+			return "", fmt.Errorf("%s: %s", last.Command, last.Error)
+		}
 
-				select {
-				case connectionControlChannel <- "":
-				default:
-					return false
-				}
-			} else {
-				return false
-			}
-		case "startscrcpyserver":
-			if !config.Adb.Enabled || !config.Scrcpy.Enabled {
-				return false
+		return last.Payload, nil
+	}
+
+	if !device.Scrcpy.Enabled && command[0] != "sleep" && command[0] != "adb" && command[0] != "adb2" && command[0] != "reloadconfig" && command[0] != "useprofile" {
+		return "", errors.New("scrcpy is disabled")
+	} else if s.controlSocket == nil && command[0] != "connect" && command[0] != "disconnect" && command[0] != "startscrcpyserver" && command[0] != "sleep" && command[0] != "adb" && command[0] != "adb2" && command[0] != "setconnectedcommands" && command[0] != "list" && command[0] != "startrecording" && command[0] != "stoprecording" && command[0] != "savereplay" && command[0] != "status" && command[0] != "reloadconfig" && command[0] != "useprofile" {
+		return "", errors.New("not connected")
+	}
+
+	switch command[0] {
+	case "connect":
+		if len(command) == 1 {
+			select {
+			case s.connectionControlChannel <- connectionRequest{connect: true}:
+			default:
+				return "", errConnectionBusy
+			}
+		} else if len(command) == 2 && device.Scrcpy.Forward {
+			select {
+			case s.connectionControlChannel <- connectionRequest{connect: true, address: command[1]}:
+			default:
+				return "", errConnectionBusy
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "disconnect":
+		if len(command) == 1 {
+			if s.status().ServerRunning {
+				return "", errors.New("scrcpy server is running")
 			}
 
-			var args []string
-			if config.Adb.Device == "usb" {
-				args = append(config.Adb.Options, "-d")
-			} else if config.Adb.Device == "tcpip" {
-				args = append(config.Adb.Options, "-e")
-			} else if config.Adb.Device != "" {
-				args = append(config.Adb.Options, "-s", config.Adb.Device)
-			} else {
-				args = config.Adb.Options
+			select {
+			case s.connectionControlChannel <- connectionRequest{}:
+			default:
+				return "", errConnectionBusy
 			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "startscrcpyserver":
+		if !device.Adb.Enabled || !device.Scrcpy.Enabled {
+			return "", errors.New("adb or scrcpy is disabled")
+		}
 
-			args = append(
-				args,
-				"shell",
-				fmt.Sprintf("CLASSPATH=%s", config.Scrcpy.Server),
-				"app_process",
-				"/",
-				"com.genymobile.scrcpy.Server",
-				config.Scrcpy.ServerVersion,
-			)
+		args, err := s.scrcpyServerArguments(command[1:])
+		if err != nil {
+			return "", err
+		}
 
-			if !config.Scrcpy.Video {
-				args = append(args, "video=false")
+		err = s.startScrcpyServer(args)
+		if err != nil {
+			return "", err
+		}
+	case "stopscrcpyserver":
+		if len(command) == 1 {
+			err = s.stopScrcpyServer()
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "status":
+		if len(command) == 1 {
+			statusBytes, err := json.Marshal(s.status())
+			if err != nil {
+				return "", err
 			}
 
-			if !config.Scrcpy.Audio {
-				args = append(args, "audio=false")
+			return string(statusBytes), nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "useprofile":
+		if len(command) <= 2 {
+			profile := ""
+			if len(command) == 2 {
+				profile = command[1]
 			}
 
-			if config.Scrcpy.Control {
-				if !config.Scrcpy.ClipboardAutosync {
-					args = append(args, "clipboard_autosync=false")
-				}
-			} else {
-				args = append(args, "control=false")
+			result, err := reloadConfig("", &profile)
+			if err != nil {
+				return "", err
 			}
 
-			if !config.Scrcpy.Cleanup {
-				args = append(args, "cleanup=false")
+			resultBytes, err := json.Marshal(result)
+			if err != nil {
+				return "", err
 			}
 
-			if !config.Scrcpy.PowerOn {
-				args = append(args, "power_on=false")
+			return string(resultBytes), nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "reloadconfig":
+		if len(command) <= 2 {
+			source := ""
+			if len(command) == 2 {
+				source = command[1]
 			}
 
-			if config.Scrcpy.Forward {
-				args = append(args, "tunnel_forward=true")
+			result, err := reloadConfig(source, nil)
+			if err != nil {
+				return "", err
 			}
 
-			if len(config.Scrcpy.ServerOptions) > 0 {
-				args = append(args, config.Scrcpy.ServerOptions...)
+			resultBytes, err := json.Marshal(result)
+			if err != nil {
+				return "", err
 			}
 
-			if len(command) > 1 {
-				if len(command) == 2 && strings.HasPrefix(command[1], "[") {
-					var options []string
-					if json.Unmarshal([]byte(command[1]), &options) != nil {
-						return false
-					}
-
-					args = append(args, options...)
-				} else {
-					args = append(args, command[1:]...)
-				}
+			return string(resultBytes), nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "uhidinput":
+		if len(command) == 3 {
+			id, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
 			}
 
-			if scrcpyServer != nil {
-				select {
-				case connectionControlChannel <- "":
-					time.Sleep(1 * time.Second)
-				default:
-				}
+			data, err := hex.DecodeString(command[2])
+			if err != nil {
+				return "", err
+			}
+			if len(data) == 0 {
+				return "", errInvalidArguments
+			}
 
-				scrcpyServer.Process.Kill()
-				scrcpyServer.Wait()
+			err = s.uhidInput(id, data)
+			if err != nil {
+				return "", err
 			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "key", "key2":
+		if len(command) == 2 {
+			var keycode int
+			var err error
 
-			scrcpyServer = exec.Command(config.Adb.Executable, args...)
+			if command[0] == "key" {
+				keycode = keycodeMap[command[1]]
+				if keycode == 0 {
+					return "", fmt.Errorf("unknown key %q", command[1])
+				}
+			} else {
+				keycode, err = strconv.Atoi(command[1])
+				if err != nil {
+					return "", err
+				}
+			}
 
-			if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrUhidOutput {
-				scrcpyServer.Stdout = os.Stderr
-				scrcpyServer.Stderr = os.Stderr
+			err = s.injectKeycode(false, keycode, 0, 0)
+			if err != nil {
+				return "", err
 			}
 
-			if scrcpyServer.Start() != nil {
-				scrcpyServer = nil
-				return false
+			err = s.injectKeycode(true, keycode, 0, 0)
+			if err != nil {
+				return "", err
 			}
-		case "stopscrcpyserver":
-			if len(command) == 1 {
-				if scrcpyServer == nil {
-					return false
-				}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "key3", "key4":
+		if len(command) == 5 {
+			var keycode int
+			var err error
 
-				select {
-				case connectionControlChannel <- "":
-					time.Sleep(1 * time.Second)
-				default:
+			if command[0] == "key3" {
+				keycode = keycodeMap[command[1]]
+				if keycode == 0 {
+					return "", fmt.Errorf("unknown key %q", command[1])
 				}
-
-				scrcpyServer.Process.Kill()
-				scrcpyServer.Wait()
-				scrcpyServer = nil
 			} else {
-				return false
-			}
-		case "uhidinput":
-			if len(command) == 3 {
-				id, err := strconv.Atoi(command[1])
+				keycode, err = strconv.Atoi(command[1])
 				if err != nil {
-					return false
+					return "", err
 				}
+			}
 
-				data, err := hex.DecodeString(command[2])
-				if err != nil {
-					return false
-				}
-				if len(data) == 0 {
-					return false
-				}
+			up, err := strconv.ParseBool(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				if !uhidInput(id, data) {
-					return false
-				}
-			} else {
-				return false
+			repeat, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
 			}
-		case "key", "key2":
-			if len(command) == 2 {
-				var keycode int
-				var err error
 
-				if command[0] == "key" {
-					keycode = keycodeMap[command[1]]
-					if keycode == 0 {
-						return false
-					}
-				} else {
-					keycode, err = strconv.Atoi(command[1])
-					if err != nil {
-						return false
-					}
-				}
+			metaState, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectKeycode(false, keycode, 0, 0) {
-					return false
-				}
+			err = s.injectKeycode(up, keycode, repeat, metaState)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "type":
+		if len(command) == 2 {
+			if command[1] == "" {
+				return "", errInvalidArguments
+			}
 
-				if !injectKeycode(true, keycode, 0, 0) {
-					return false
-				}
-			} else {
-				return false
+			err = s.injectText(command[1])
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "touch":
+		if len(command) == 5 {
+			x, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
 			}
-		case "key3", "key4":
-			if len(command) == 5 {
-				var keycode int
-				var err error
 
-				if command[0] == "key3" {
-					keycode = keycodeMap[command[1]]
-					if keycode == 0 {
-						return false
-					}
-				} else {
-					keycode, err = strconv.Atoi(command[1])
-					if err != nil {
-						return false
-					}
-				}
+			y, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				up, err := strconv.ParseBool(command[2])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				repeat, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				metaState, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(0, -2, x, y, width, height, 1)
+			if err != nil {
+				return "", err
+			}
 
-				if !injectKeycode(up, keycode, repeat, metaState) {
-					return false
-				}
-			} else {
-				return false
+			err = s.injectTouchEvent(1, -2, x, y, width, height, 1)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "touchdown":
+		if len(command) == 5 {
+			x, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
 			}
-		case "type":
-			if len(command) == 2 {
-				if command[1] == "" {
-					return false
-				}
 
-				if !injectText(command[1]) {
-					return false
-				}
-			} else {
-				return false
+			y, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
 			}
-		case "touch":
-			if len(command) == 5 {
-				x, err := strconv.Atoi(command[1])
-				if err != nil {
-					return false
-				}
 
-				y, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(0, -2, x, y, width, height, 1)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "touchup":
+		if len(command) == 5 {
+			x, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(0, -2, x, y, width, height, 1) {
-					return false
-				}
+			y, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(1, -2, x, y, width, height, 1) {
-					return false
-				}
-			} else {
-				return false
+			width, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
 			}
-		case "touchdown":
-			if len(command) == 5 {
-				x, err := strconv.Atoi(command[1])
-				if err != nil {
-					return false
-				}
 
-				y, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(1, -2, x, y, width, height, 1)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "touchmove":
+		if len(command) == 5 {
+			x, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			y, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(0, -2, x, y, width, height, 1) {
-					return false
-				}
-			} else {
-				return false
+			width, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
 			}
-		case "touchup":
-			if len(command) == 5 {
-				x, err := strconv.Atoi(command[1])
-				if err != nil {
-					return false
-				}
 
-				y, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(2, -2, x, y, width, height, 1)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "mouseclick":
+		if len(command) == 6 {
+			button := getMouseButton(command[1])
+			if button == -1 {
+				return "", fmt.Errorf("unknown mouse button %q", command[1])
+			}
 
-				height, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			x, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(1, -2, x, y, width, height, 1) {
-					return false
-				}
-			} else {
-				return false
+			y, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
 			}
-		case "touchmove":
-			if len(command) == 5 {
-				x, err := strconv.Atoi(command[1])
-				if err != nil {
-					return false
-				}
 
-				y, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[5])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(0, -1, x, y, width, height, button)
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(2, -2, x, y, width, height, 1) {
-					return false
-				}
-			} else {
-				return false
+			err = s.injectTouchEvent(1, -1, x, y, width, height, button)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "mousedown":
+		if len(command) == 6 {
+			button := getMouseButton(command[1])
+			if button == -1 {
+				return "", fmt.Errorf("unknown mouse button %q", command[1])
 			}
-		case "mouseclick":
-			if len(command) == 6 {
-				button := getMouseButton(command[1])
-				if button == -1 {
-					return false
-				}
 
-				x, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			x, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
+			}
 
-				y, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			y, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[5])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[5])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(0, -1, x, y, width, height, button) {
-					return false
-				}
+			err = s.injectTouchEvent(0, -1, x, y, width, height, button)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "mouseup":
+		if len(command) == 6 {
+			button := getMouseButton(command[1])
+			if button == -1 {
+				return "", fmt.Errorf("unknown mouse button %q", command[1])
+			}
 
-				if !injectTouchEvent(1, -1, x, y, width, height, button) {
-					return false
-				}
-			} else {
-				return false
+			x, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
 			}
-		case "mousedown":
-			if len(command) == 6 {
-				button := getMouseButton(command[1])
-				if button == -1 {
-					return false
-				}
 
-				x, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			y, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				y, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[5])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[5])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(1, -1, x, y, width, height, button)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "mousemove":
+		if len(command) == 6 {
+			button := getMouseButton(command[1])
+			if button == -1 {
+				return "", fmt.Errorf("unknown mouse button %q", command[1])
+			}
 
-				if !injectTouchEvent(0, -1, x, y, width, height, button) {
-					return false
-				}
-			} else {
-				return false
+			x, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
 			}
-		case "mouseup":
-			if len(command) == 6 {
-				button := getMouseButton(command[1])
-				if button == -1 {
-					return false
-				}
 
-				x, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			y, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				y, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[5])
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[5])
-				if err != nil {
-					return false
-				}
+			err = s.injectTouchEvent(2, -1, x, y, width, height, button)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "scrollleft", "scrollright", "scrollup", "scrolldown":
+		if len(command) == 5 {
+			x, err := strconv.Atoi(command[1])
+			if err != nil {
+				return "", err
+			}
 
-				if !injectTouchEvent(1, -1, x, y, width, height, button) {
-					return false
-				}
-			} else {
-				return false
+			y, err := strconv.Atoi(command[2])
+			if err != nil {
+				return "", err
 			}
-		case "mousemove":
-			if len(command) == 6 {
-				button := getMouseButton(command[1])
-				if button == -1 {
-					return false
-				}
 
-				x, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			width, err := strconv.Atoi(command[3])
+			if err != nil {
+				return "", err
+			}
 
-				y, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			height, err := strconv.Atoi(command[4])
+			if err != nil {
+				return "", err
+			}
 
-				width, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			err = s.injectScrollEvent(x, y, width, height, command[0][6:])
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "openhardkeyboardsettings":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.OpenHardKeyboardSettings})
+			if err != nil {
+				return "", err
+			}
+			if n != 1 {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "backorscreenon":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.BackOrScreenOn, 0x00, ScrcpyControlMessageTypes.BackOrScreenOn, 0x01})
+			if err != nil {
+				return "", err
+			}
+			if n != 4 {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "expandnotificationspanel":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.ExpandNotificationPanel})
+			if err != nil {
+				return "", err
+			}
+			if n != 1 {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "expandsettingspanel":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.ExpandSettingsPanel})
+			if err != nil {
+				return "", err
+			}
+			if n != 1 {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "collapsepanels":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.CollapsePanels})
+			if err != nil {
+				return "", err
+			}
+			if n != 1 {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "getclipboard", "getclipboardcut":
+		if len(command) == 1 {
+			err = s.getClipboard(command[0] == "getclipboardcut")
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "setclipboard", "setclipboardpaste":
+		if len(command) == 2 || len(command) == 3 || len(command) == 4 {
+			var sequence int
+			var timeout time.Duration
+			var err error
 
-				height, err := strconv.Atoi(command[5])
+			if len(command) > 2 {
+				sequence, err = strconv.Atoi(command[2])
 				if err != nil {
-					return false
+					return "", err
 				}
 
-				if !injectTouchEvent(2, -1, x, y, width, height, button) {
-					return false
+				if len(command) == 4 {
+					timeout, err = time.ParseDuration(command[3])
+					if err != nil {
+						return "", err
+					}
 				}
-			} else {
-				return false
 			}
-		case "scrollleft", "scrollright", "scrollup", "scrolldown":
-			if len(command) == 5 {
-				x, err := strconv.Atoi(command[1])
-				if err != nil {
-					return false
-				}
 
-				y, err := strconv.Atoi(command[2])
-				if err != nil {
-					return false
-				}
+			err = s.setClipboard(command[1], sequence, command[0] == "setclipboardpaste", timeout)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "clipboard", "clipboardcut":
+		if len(command) == 1 {
+			events := s.events.subscribe(eventSubscriberBuffer, "clipboard")
+			defer s.events.unsubscribe(events)
 
-				width, err := strconv.Atoi(command[3])
-				if err != nil {
-					return false
-				}
+			err = s.getClipboard(command[0] == "clipboardcut")
+			if err != nil {
+				return "", err
+			}
 
-				height, err := strconv.Atoi(command[4])
-				if err != nil {
-					return false
-				}
+			e, ok := waitEvent(events, 2*time.Second, func(e Event) bool { return e.Type == "clipboard" })
+			if !ok {
+				return "", errors.New("timed out waiting for clipboard")
+			}
 
-				if !injectScrollEvent(x, y, width, height, command[0][6:]) {
-					return false
-				}
+			return e.Data, nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "list":
+		if len(command) == 2 && device.Adb.Enabled {
+			var serverArg string
+			if command[1] == "camerasizes" {
+				serverArg = "list_camera_sizes=true"
 			} else {
-				return false
+				serverArg = fmt.Sprintf("list_%s=true", command[1])
 			}
-		case "openhardkeyboardsettings":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.OpenHardKeyboardSettings})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+
+			output := s.list([]string{serverArg})
+			if output == "" {
+				return "", errors.New("listing failed")
 			}
-		case "backorscreenon":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.BackOrScreenOn, 0x00, ScrcpyControlMessageTypes.BackOrScreenOn, 0x01})
-				if err != nil {
-					return false
-				}
-				if n != 4 {
-					return false
-				}
-			} else {
-				return false
+
+			return output, nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "turnscreenon":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.SetDisplayPower, 0x02})
+			if err != nil {
+				return "", err
 			}
-		case "expandnotificationspanel":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.ExpandNotificationPanel})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+			if n != 2 {
+				return "", io.ErrShortWrite
 			}
-		case "expandsettingspanel":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.ExpandSettingsPanel})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+		} else {
+			return "", errInvalidArguments
+		}
+	case "turnscreenoff":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.SetDisplayPower, 0x00})
+			if err != nil {
+				return "", err
 			}
-		case "collapsepanels":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.CollapsePanels})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+			if n != 2 {
+				return "", io.ErrShortWrite
 			}
-		case "getclipboard", "getclipboardcut":
-			if len(command) == 1 {
-				if !getClipboard(command[0] == "getclipboardcut") {
-					return false
-				}
-			} else {
-				return false
+		} else {
+			return "", errInvalidArguments
+		}
+	case "rotate":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.RotateDevice})
+			if err != nil {
+				return "", err
 			}
-		case "setclipboard", "setclipboardpaste":
-			if len(command) == 2 || len(command) == 3 || len(command) == 4 {
-				var sequence int
-				var timeout time.Duration
-				var err error
-
-				if len(command) > 2 {
-					sequence, err = strconv.Atoi(command[2])
-					if err != nil {
-						return false
-					}
-
-					if len(command) == 4 {
-						timeout, err = time.ParseDuration(command[3])
-						if err != nil {
-							return false
-						}
-					}
-				}
-
-				if !setClipboard(command[1], sequence, command[0] == "setclipboardpaste", timeout) {
-					return false
-				}
-			} else {
-				return false
+			if n != 1 {
+				return "", io.ErrShortWrite
 			}
-		case "turnscreenon":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.SetDisplayPower, 0x02})
-				if err != nil {
-					return false
-				}
-				if n != 2 {
-					return false
-				}
-			} else {
-				return false
+		} else {
+			return "", errInvalidArguments
+		}
+	case "startapp":
+		if len(command) == 2 {
+			data := make([]byte, 2+len(command[1]))
+			data[0] = ScrcpyControlMessageTypes.StartApp
+			data[1] = byte(len(command[1]))
+			copy(data[2:], []byte(command[1]))
+
+			n, err := s.controlSocket.Write(data)
+			if err != nil {
+				return "", err
+			}
+			if n != len(data) {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "resetvideo":
+		if len(command) == 1 {
+			n, err := s.controlSocket.Write([]byte{ScrcpyControlMessageTypes.ResetVideo})
+			if err != nil {
+				return "", err
 			}
-		case "turnscreenoff":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.SetDisplayPower, 0x00})
-				if err != nil {
-					return false
-				}
-				if n != 2 {
-					return false
-				}
-			} else {
-				return false
+			if n != 1 {
+				return "", io.ErrShortWrite
 			}
-		case "rotate":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.RotateDevice})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+		} else {
+			return "", errInvalidArguments
+		}
+	case "senddata":
+		if len(command) == 2 {
+			data, err := hex.DecodeString(command[1])
+			if err != nil {
+				return "", err
+			}
+			if len(data) == 0 {
+				return "", errInvalidArguments
 			}
-		case "startapp":
-			if len(command) == 2 {
-				data := make([]byte, 2+len(command[1]))
-				data[0] = ScrcpyControlMessageTypes.StartApp
-				data[1] = byte(len(command[1]))
-				copy(data[2:], []byte(command[1]))
 
-				n, err := controlSocket.Write(data)
-				if err != nil {
-					return false
-				}
-				if n != len(data) {
-					return false
-				}
-			} else {
-				return false
+			n, err := s.controlSocket.Write(data)
+			if err != nil {
+				return "", err
 			}
-		case "resetvideo":
-			if len(command) == 1 {
-				n, err := controlSocket.Write([]byte{ScrcpyControlMessageTypes.ResetVideo})
-				if err != nil {
-					return false
-				}
-				if n != 1 {
-					return false
-				}
-			} else {
-				return false
+			if n != len(data) {
+				return "", io.ErrShortWrite
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "startrecording":
+		if len(command) == 2 || len(command) == 3 {
+			var format string
+			if len(command) == 3 {
+				format = command[2]
 			}
-		case "senddata":
-			if len(command) == 2 {
-				data, err := hex.DecodeString(command[1])
-				if err != nil {
-					return false
-				}
-				if len(data) == 0 {
-					return false
-				}
 
-				n, err := controlSocket.Write(data)
-				if err != nil {
-					return false
-				}
-				if n != len(data) {
-					return false
-				}
-			} else {
-				return false
+			err = s.startRecording(command[1], format)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			return "", errInvalidArguments
+		}
+	case "stoprecording":
+		if len(command) == 1 {
+			return s.stopRecording()
+		} else {
+			return "", errInvalidArguments
+		}
+	case "savereplay":
+		if len(command) == 2 || len(command) == 3 {
+			var format string
+			if len(command) == 3 {
+				format = command[2]
 			}
-		case "sleep":
-			if len(command) == 2 {
-				duration, err := time.ParseDuration(command[1])
-				if err != nil {
-					return false
-				}
 
-				time.Sleep(duration)
-			} else {
-				return false
+			return s.saveReplay(command[1], format)
+		} else {
+			return "", errInvalidArguments
+		}
+	case "screenshot":
+		if len(command) == 2 || len(command) == 3 {
+			if !device.VideoDecoder.Enabled {
+				return "", errors.New("video decoder is disabled")
 			}
-		case "adb", "adb2":
-			if len(command) == 2 && config.Adb.Enabled && (command[1] == "connect" || command[1] == "disconnect") {
-				args := append(config.Adb.Options, command[1], config.Adb.Device)
 
-				cmd := exec.Command(config.Adb.Executable, args...)
+			var query string
+			if len(command) == 3 {
+				query = command[2]
+			}
 
-				if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrUhidOutput {
-					cmd.Stdout = os.Stderr
-					cmd.Stderr = os.Stderr
-				}
+			err = s.saveScreenshot(command[1], query)
+			if err != nil {
+				return "", err
+			}
 
-				if cmd.Run() != nil && command[0] == "adb" {
-					return false
-				}
-			} else if len(command) > 1 && config.Adb.Enabled {
-				var args []string
-				if config.Adb.Device == "usb" {
-					args = append(config.Adb.Options, "-d")
-				} else if config.Adb.Device == "tcpip" {
-					args = append(config.Adb.Options, "-e")
-				} else if config.Adb.Device != "" {
-					args = append(config.Adb.Options, "-s", config.Adb.Device)
-				}
+			return command[1], nil
+		} else {
+			return "", errInvalidArguments
+		}
+	case "sleep":
+		if len(command) == 2 {
+			duration, err := time.ParseDuration(command[1])
+			if err != nil {
+				return "", err
+			}
 
-				args = append(args, command[1:]...)
+			time.Sleep(duration)
+		} else {
+			return "", errInvalidArguments
+		}
+	case "adb", "adb2":
+		if len(command) == 2 && device.Adb.Enabled && (command[1] == "connect" || command[1] == "disconnect") {
+			args := append(device.Adb.Options, command[1], device.Adb.Device)
 
-				cmd := exec.Command(config.Adb.Executable, args...)
+			cmd := s.adbCommand(args)
+			logProcessOutput(cmd, "device", s.Name)
 
-				if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrUhidOutput {
-					cmd.Stdout = os.Stderr
-					cmd.Stderr = os.Stderr
-				}
+			err = cmd.Run()
+			if err != nil && command[0] == "adb" {
+				return "", err
+			}
+		} else if len(command) > 1 && device.Adb.Enabled {
+			var args []string
+			if device.Adb.Device == "usb" {
+				args = append(device.Adb.Options, "-d")
+			} else if device.Adb.Device == "tcpip" {
+				args = append(device.Adb.Options, "-e")
+			} else if device.Adb.Device != "" {
+				args = append(device.Adb.Options, "-s", device.Adb.Device)
+			}
 
-				if cmd.Run() != nil && command[0] == "adb" {
-					return false
-				}
-			} else {
-				return false
+			args = append(args, command[1:]...)
+
+			cmd := s.adbCommand(args)
+			logProcessOutput(cmd, "device", s.Name)
+
+			err = cmd.Run()
+			if err != nil && command[0] == "adb" {
+				return "", err
 			}
-		case "setconnectedcommands":
-			if len(command) == 2 {
-				defer func(commands string) {
-					json.Unmarshal([]byte(commands), &scrcpyConnectedCommands)
-				}(command[1])
-			} else {
-				return false
+		} else {
+			return "", errInvalidArguments
+		}
+	case "setconnectedcommands":
+		if len(command) == 2 {
+			var cs CommandSlice
+
+			err = json.Unmarshal([]byte(command[1]), &cs)
+			if err != nil {
+				return "", err
 			}
+
+			s.setConnectedCommands(cs)
+		} else {
+			return "", errInvalidArguments
 		}
+	default:
+		return "", errors.New("unknown command")
 	}
 
-	return true
+	return "", nil
 }
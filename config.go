@@ -0,0 +1,1154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type jsonCommandHandler struct {
+	source        JsonCommandHandlerTemplate
+	c             chan *JsonCommandHandlerData
+	done          chan struct{}
+	closing       chan struct{}
+	mutex         sync.Mutex
+	inflight      []*JsonCommandHandlerData
+	inflightMutex sync.Mutex
+}
+
+const jsonCommandHandlerReplyTimeout = 5 * time.Second
+const jsonCommandHandlerResultTimeout = 60 * time.Second
+const jsonCommandHandlerNotRun = "handler template did not run the commands"
+const jsonCommandHandlerTimedOut = "timed out waiting for the command results"
+
+type ReloadResult struct {
+	Applied           []string `json:"applied"`
+	ReconnectRequired []string `json:"reconnectRequired"`
+	RestartRequired   []string `json:"restartRequired"`
+}
+
+var configSource string
+var configMutex sync.RWMutex
+var reloadMutex sync.Mutex
+var jsonCommandHandlers map[string]*jsonCommandHandler = map[string]*jsonCommandHandler{}
+
+var restartRequiredDeviceSettings = []string{
+	"adb.enabled",
+	"scrcpy.enabled",
+	"scrcpy.video",
+	"scrcpy.audio",
+	"scrcpy.control",
+	"scrcpy.forward",
+	"scrcpy.stdout",
+	"scrcpy.stderr",
+	"scrcpy.replayDuration",
+	"scrcpy.replayMaxSize",
+	"scrcpy.watchdog.enabled",
+	"videoDecoder.enabled",
+	"videoDecoder.executable",
+	"videoDecoder.alpha",
+}
+
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) Error() string {
+	if p.Path == "" {
+		return p.Message
+	}
+
+	return p.Path + ": " + p.Message
+}
+
+type ConfigProblems []ConfigProblem
+
+func (p ConfigProblems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.Error()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (p *ConfigProblems) add(path string, format string, a ...any) {
+	*p = append(*p, ConfigProblem{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+func configPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+func readConfigData(source string) ([]byte, error) {
+	var data []byte
+	var contentType string
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		contentType = resp.Header.Get("Content-Type")
+	} else {
+		data, err = os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return configToJson(configFormat(source, contentType), data)
+}
+
+func readStdinConfigData(r *bufio.Reader) ([]byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.IndexByte(" \t\r\n", c) < 0 {
+			r.UnreadByte()
+
+			if c == '{' || c == '/' {
+				return readStdinJsonConfig(r)
+			}
+
+			break
+		}
+	}
+
+	var data []byte
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if strings.TrimRight(string(line), " \t\r\n") == "..." {
+			break
+		}
+
+		data = append(data, line...)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return configToJson(configContentFormat(data), data)
+}
+
+func readStdinJsonConfig(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+	depth := 0
+	inString := false
+
+	next := func() (byte, error) {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err == nil {
+			data = append(data, c)
+		}
+
+		return c, err
+	}
+
+	for {
+		c, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case inString && c == '\\':
+			_, err = next()
+		case inString:
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '/':
+			c, err = next()
+			if err == nil && c == '/' {
+				for err == nil && c != '\n' {
+					c, err = next()
+				}
+			} else if err == nil && c == '*' {
+				var prev byte
+				for c, err = next(); err == nil && !(prev == '*' && c == '/'); c, err = next() {
+					prev = c
+				}
+			}
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return configToJson("json", data)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func decodeConfigValue(data []byte) (any, error) {
+	var v any
+
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+
+		if errors.As(err, &syntaxError) {
+			line := bytes.Count(data[:syntaxError.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func readConfig(source string, profile string) (Config, error) {
+	data, err := readConfigData(source)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return parseConfig(source, data, profile)
+}
+
+func parseConfig(source string, data []byte, profile string) (Config, error) {
+	var c Config
+
+	v, err := decodeConfigValue(data)
+	if err != nil {
+		return c, err
+	}
+
+	v, err = resolveConfigIncludes(source, v, []string{source})
+	if err != nil {
+		return c, err
+	}
+
+	v, problems := selectConfigProfile(v, profile)
+	if len(problems) > 0 {
+		return c, problems
+	}
+
+	data, err = json.Marshal(v)
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		var typeError *json.UnmarshalTypeError
+
+		if errors.As(err, &typeError) && typeError.Field != "" {
+			return c, ConfigProblems{{Path: typeError.Field, Message: fmt.Sprintf("expected %s, got %s", typeError.Type, typeError.Value)}}
+		}
+
+		return c, err
+	}
+
+	problems = unknownConfigFields("", reflect.TypeOf(c), v)
+
+	m, _ := v.(map[string]any)
+	if profiles, ok := m["profiles"].(map[string]any); ok {
+		for _, name := range sortedKeys(profiles) {
+			problems = append(problems, unknownConfigFields(configPath("profiles", name), reflect.TypeOf(c), profiles[name])...)
+		}
+	}
+
+	problems = append(problems, c.applyOverrides(configOverrides)...)
+	problems = append(problems, c.validate()...)
+
+	if len(problems) > 0 {
+		return c, problems
+	}
+
+	return c, nil
+}
+
+func unknownConfigFields(path string, t reflect.Type, v any) ConfigProblems {
+	var problems ConfigProblems
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		fields := map[string]reflect.Type{}
+		var names []string
+
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+
+			fields[strings.ToLower(name)] = t.Field(i).Type
+			names = append(names, name)
+		}
+
+		for _, k := range sortedKeys(m) {
+			fieldType, ok := fields[strings.ToLower(k)]
+			if !ok {
+				if suggestion := closestConfigField(k, names); suggestion != "" {
+					problems.add(configPath(path, k), "unknown field, did you mean %q?", suggestion)
+				} else {
+					problems.add(configPath(path, k), "unknown field")
+				}
+
+				continue
+			}
+
+			problems = append(problems, unknownConfigFields(configPath(path, k), fieldType, m[k])...)
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		for _, k := range sortedKeys(m) {
+			problems = append(problems, unknownConfigFields(configPath(path, k), t.Elem(), m[k])...)
+		}
+	case reflect.Slice:
+		a, ok := v.([]any)
+		if !ok {
+			return nil
+		}
+
+		for i, e := range a {
+			problems = append(problems, unknownConfigFields(fmt.Sprintf("%s[%d]", path, i), t.Elem(), e)...)
+		}
+	}
+
+	return problems
+}
+
+func closestConfigField(name string, names []string) string {
+	closest := ""
+	closestDistance := 3
+
+	for _, candidate := range names {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if distance < closestDistance {
+			closest = candidate
+			closestDistance = distance
+		}
+	}
+
+	return closest
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func (c LogConfig) level() slog.Level {
+	switch c.Level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func (device *DeviceConfig) validate(prefix string) ConfigProblems {
+	var problems ConfigProblems
+
+	if device.VideoDecoder.Enabled && !device.Scrcpy.Enabled {
+		problems.add(configPath(prefix, "videoDecoder"), "the video decoder requires scrcpy to be enabled")
+	}
+
+	if !device.Scrcpy.Enabled {
+		return problems
+	}
+
+	scrcpy := device.Scrcpy
+	scrcpyPath := configPath(prefix, "scrcpy")
+
+	if scrcpy.Address == "" {
+		problems.add(configPath(scrcpyPath, "address"), "must not be empty")
+	}
+
+	if scrcpy.RecordingDirectory != "" {
+		info, err := os.Stat(scrcpy.RecordingDirectory)
+		if err != nil {
+			problems.add(configPath(scrcpyPath, "recordingDirectory"), "%v", err)
+		} else if !info.IsDir() {
+			problems.add(configPath(scrcpyPath, "recordingDirectory"), "must be a directory")
+		}
+	}
+
+	if scrcpy.ReplayDuration < 0 {
+		problems.add(configPath(scrcpyPath, "replayDuration"), "must not be negative")
+	}
+
+	if scrcpy.ReplayMaxSize <= 0 {
+		problems.add(configPath(scrcpyPath, "replayMaxSize"), "must be greater than 0")
+	}
+
+	retry := scrcpy.Retry
+	retryPath := configPath(scrcpyPath, "retry")
+
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"maxAttempts", retry.MaxAttempts},
+		{"initialDelay", retry.InitialDelay},
+		{"timeout", retry.Timeout},
+	} {
+		if setting.value < 0 {
+			problems.add(configPath(retryPath, setting.name), "must not be negative")
+		}
+	}
+
+	if retry.MaxDelay < retry.InitialDelay {
+		problems.add(configPath(retryPath, "maxDelay"), "must not be less than initialDelay (%d)", retry.InitialDelay)
+	}
+
+	if retry.Multiplier < 1 {
+		problems.add(configPath(retryPath, "multiplier"), "must be at least 1")
+	}
+
+	watchdog := scrcpy.Watchdog
+	watchdogPath := configPath(scrcpyPath, "watchdog")
+
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"videoTimeout", watchdog.VideoTimeout},
+		{"audioTimeout", watchdog.AudioTimeout},
+		{"controlTimeout", watchdog.ControlTimeout},
+		{"escalateTimeout", watchdog.EscalateTimeout},
+	} {
+		if setting.value < 0 {
+			problems.add(configPath(watchdogPath, setting.name), "must not be negative")
+		}
+	}
+
+	videoDecoder := device.VideoDecoder
+	videoDecoderPath := configPath(prefix, "videoDecoder")
+
+	if videoDecoder.Enabled {
+		for _, setting := range []struct {
+			name  string
+			value int
+		}{
+			{"mjpegMaxFps", videoDecoder.MjpegMaxFps},
+			{"mjpegMaxWidth", videoDecoder.MjpegMaxWidth},
+			{"mjpegMaxHeight", videoDecoder.MjpegMaxHeight},
+		} {
+			if setting.value < 0 {
+				problems.add(configPath(videoDecoderPath, setting.name), "must not be negative")
+			}
+		}
+
+		if videoDecoder.MjpegQuality < 1 || videoDecoder.MjpegQuality > 100 {
+			problems.add(configPath(videoDecoderPath, "mjpegQuality"), "must be between 1 and 100")
+		}
+	}
+
+	return problems
+}
+
+func (c *Config) validate() ConfigProblems {
+	var problems ConfigProblems
+
+	defaultDevice := DeviceConfig{Adb: c.Adb, Scrcpy: c.Scrcpy, VideoDecoder: c.VideoDecoder}
+	problems = append(problems, defaultDevice.validate("")...)
+
+	enabled := c.Adb.Enabled || c.Scrcpy.Enabled
+
+	for _, name := range sortedKeys(c.Devices) {
+		device := c.Devices[name]
+		devicePath := configPath("devices", name)
+
+		if name == "" || strings.ContainsAny(name, "/@") {
+			problems.add(devicePath, "device names must be non-empty and must not contain / or @")
+		}
+
+		problems = append(problems, device.validate(devicePath)...)
+
+		if device.Adb.Enabled || device.Scrcpy.Enabled {
+			enabled = true
+		}
+	}
+
+	if !enabled {
+		problems.add("", "adb and scrcpy are disabled for every device, enable at least one of them")
+	}
+
+	if !c.HttpServer.Enabled && !c.TcpJsonCommands.Enabled && !c.UdpJsonCommands.Enabled && !c.TlsJsonCommands.Enabled && !c.StdinJsonCommands.Enabled {
+		problems.add("", "no command interface is enabled, configure at least one of httpServer, tcpJsonCommands, udpJsonCommands, tlsJsonCommands or stdinJsonCommands")
+	}
+
+	if c.HttpServer.Enabled {
+		if c.HttpServer.Address == "" {
+			problems.add("httpServer.address", "must not be empty")
+		}
+
+		if (c.HttpServer.Cert == "") != (c.HttpServer.Key == "") {
+			problems.add("httpServer", "cert and key must be set together")
+		}
+
+		if c.HttpServer.ClientCa != "" && c.HttpServer.Cert == "" {
+			problems.add("httpServer.clientCa", "client certificates require cert and key")
+		}
+
+		if c.HttpServer.ShutdownTimeout < 0 {
+			problems.add("httpServer.shutdownTimeout", "must not be negative")
+		}
+
+		for _, path := range sortedKeys(c.HttpServer.Endpoints) {
+			if !strings.HasPrefix(path, "/") {
+				problems.add(configPath("httpServer.endpoints", path), "endpoint paths must start with /")
+			}
+		}
+	}
+
+	if !slices.Contains([]string{"", "debug", "info", "warn", "error"}, c.Log.Level) {
+		problems.add("log.level", "unknown log level %q, must be debug, info, warn or error", c.Log.Level)
+	}
+
+	if !slices.Contains([]string{"", "text", "json"}, c.Log.Format) {
+		problems.add("log.format", "unknown log format %q, must be text or json", c.Log.Format)
+	}
+
+	if c.AuditLog.Enabled {
+		if c.AuditLog.File == "" {
+			problems.add("auditLog.file", "must not be empty")
+		}
+
+		if c.AuditLog.MaxSize < 0 {
+			problems.add("auditLog.maxSize", "must not be negative")
+		}
+
+		if c.AuditLog.MaxFiles < 0 {
+			problems.add("auditLog.maxFiles", "must not be negative")
+		}
+	}
+
+	checkHandlerTemplate := func(path string, name string) {
+		if name != "" && c.JsonCommandHandlerTemplates[name] == "" {
+			problems.add(path, "unknown handler template %q, it must be defined in jsonCommandHandlerTemplates", name)
+		}
+	}
+
+	checkFraming := func(path string, framing string) {
+		if !slices.Contains([]string{"", "json", "newline", "length"}, framing) {
+			problems.add(path, "unknown framing %q, must be json, newline or length", framing)
+		}
+	}
+
+	if c.TcpJsonCommands.Enabled {
+		if c.TcpJsonCommands.Address == "" {
+			problems.add("tcpJsonCommands.address", "must not be empty")
+		}
+
+		checkHandlerTemplate("tcpJsonCommands.handlerTemplate", c.TcpJsonCommands.HandlerTemplate)
+		checkFraming("tcpJsonCommands.framing", c.TcpJsonCommands.Framing)
+	}
+
+	if c.UdpJsonCommands.Enabled {
+		if c.UdpJsonCommands.Address == "" {
+			problems.add("udpJsonCommands.address", "must not be empty")
+		}
+
+		checkHandlerTemplate("udpJsonCommands.handlerTemplate", c.UdpJsonCommands.HandlerTemplate)
+	}
+
+	if c.TlsJsonCommands.Enabled {
+		if c.TlsJsonCommands.Address == "" {
+			problems.add("tlsJsonCommands.address", "must not be empty")
+		}
+
+		if c.TlsJsonCommands.Cert == "" {
+			problems.add("tlsJsonCommands.cert", "a certificate is required")
+		}
+
+		if c.TlsJsonCommands.Key == "" {
+			problems.add("tlsJsonCommands.key", "a private key is required")
+		}
+
+		checkHandlerTemplate("tlsJsonCommands.handlerTemplate", c.TlsJsonCommands.HandlerTemplate)
+		checkFraming("tlsJsonCommands.framing", c.TlsJsonCommands.Framing)
+	}
+
+	if c.StdinJsonCommands.Enabled {
+		checkHandlerTemplate("stdinJsonCommands.handlerTemplate", c.StdinJsonCommands.HandlerTemplate)
+	}
+
+	for _, name := range sortedKeys(c.JsonCommandHandlerTemplates) {
+		_, err := template.New("").Funcs(jsonCommandHandlerFuncs).Parse(string(c.JsonCommandHandlerTemplates[name]))
+		if err != nil {
+			problems.add(configPath("jsonCommandHandlerTemplates", name), "%v", err)
+		}
+	}
+
+	return problems
+}
+
+func startJsonCommandHandler(source JsonCommandHandlerTemplate) (*jsonCommandHandler, error) {
+	h := &jsonCommandHandler{
+		source:  source,
+		c:       make(chan *JsonCommandHandlerData),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+
+	t, err := template.New("").Funcs(jsonCommandHandlerFuncs).Parse(string(source))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(h.done)
+
+		err := t.Execute(io.Discard, h.c)
+		if err != nil {
+			slog.Error("json command handler template failed", "error", err)
+		}
+
+		h.finish(nil)
+	}()
+
+	return h, nil
+}
+
+func (h *jsonCommandHandler) track(data *JsonCommandHandlerData) {
+	h.inflightMutex.Lock()
+	defer h.inflightMutex.Unlock()
+
+	h.inflight = append(h.inflight, data)
+}
+
+func (h *jsonCommandHandler) untrack(data *JsonCommandHandlerData) {
+	h.inflightMutex.Lock()
+	defer h.inflightMutex.Unlock()
+
+	h.inflight = slices.DeleteFunc(h.inflight, func(d *JsonCommandHandlerData) bool { return d == data })
+}
+
+func (h *jsonCommandHandler) finish(next *JsonCommandHandlerData) {
+	h.inflightMutex.Lock()
+	defer h.inflightMutex.Unlock()
+
+	i := slices.Index(h.inflight, next)
+	if i < 0 {
+		i = len(h.inflight)
+	}
+
+	for _, d := range h.inflight[:i] {
+		if !d.isStarted() {
+			d.reply(CommandResponse{Id: d.Id, Error: jsonCommandHandlerNotRun})
+		}
+	}
+
+	h.inflight = slices.Delete(h.inflight, 0, i)
+}
+
+func (h *jsonCommandHandler) close() {
+	close(h.closing)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	close(h.c)
+}
+
+func sendJsonCommandHandler(name string, data *JsonCommandHandlerData) bool {
+	for {
+		configMutex.RLock()
+		h, ok := jsonCommandHandlers[name]
+		configMutex.RUnlock()
+
+		if !ok {
+			return false
+		}
+
+		h.mutex.Lock()
+
+		select {
+		case <-h.closing:
+			h.mutex.Unlock()
+			continue
+		default:
+		}
+
+		h.track(data)
+
+		select {
+		case h.c <- data:
+			h.finish(data)
+			h.mutex.Unlock()
+			return true
+		case <-h.done:
+			h.untrack(data)
+			h.mutex.Unlock()
+			return false
+		case <-h.closing:
+			h.untrack(data)
+			h.mutex.Unlock()
+		}
+	}
+}
+
+func (d *JsonCommandHandlerData) expectReply() {
+	d.replies = make(chan CommandResponse, 1)
+	d.started = make(chan struct{})
+}
+
+func (d *JsonCommandHandlerData) Run(cs CommandSlice, wait bool, commands ...[]string) CommandResults {
+	if cs == nil {
+		cs = commands
+	}
+
+	d.start()
+
+	source := d.commandSource()
+
+	if wait {
+		results := defaultSession.runCommands(source, cs)
+		d.reply(CommandResponse{Id: d.id(), CommandResults: results})
+		return results
+	}
+
+	go func() {
+		results := defaultSession.runCommands(source, cs)
+		d.reply(CommandResponse{Id: d.id(), CommandResults: results})
+	}()
+
+	return CommandResults{Ok: true}
+}
+
+func (d *JsonCommandHandlerData) commandSource() CommandSource {
+	if d == nil || d.Server == "" {
+		return CommandSource{Transport: "template"}
+	}
+
+	return CommandSource{Transport: d.Server, RemoteAddress: d.Address, TlsClient: d.TlsClient, HttpEndpoint: d.HttpEndpoint}
+}
+
+func (d *JsonCommandHandlerData) id() string {
+	if d == nil {
+		return ""
+	}
+
+	return d.Id
+}
+
+func (d *JsonCommandHandlerData) start() {
+	if d == nil || d.started == nil {
+		return
+	}
+
+	d.startOnce.Do(func() { close(d.started) })
+}
+
+func (d *JsonCommandHandlerData) isStarted() bool {
+	if d == nil || d.started == nil {
+		return false
+	}
+
+	select {
+	case <-d.started:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *JsonCommandHandlerData) reply(response CommandResponse) {
+	if d == nil || d.replies == nil {
+		return
+	}
+
+	select {
+	case d.replies <- response:
+	default:
+	}
+}
+
+func (d *JsonCommandHandlerData) waitReply() CommandResponse {
+	timer := time.NewTimer(jsonCommandHandlerReplyTimeout)
+	defer timer.Stop()
+
+	started := d.started
+
+	for {
+		select {
+		case response := <-d.replies:
+			return response
+		case <-started:
+			started = nil
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+
+			timer.Reset(jsonCommandHandlerResultTimeout)
+		case <-timer.C:
+			if started == nil {
+				return CommandResponse{Id: d.Id, Error: jsonCommandHandlerTimedOut}
+			}
+
+			return CommandResponse{Id: d.Id, Error: jsonCommandHandlerNotRun}
+		}
+	}
+}
+
+func customCommand(name string) (CommandSlice, bool) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	cs, ok := config.CustomCommands[name]
+	return cs, ok
+}
+
+func endpointClients(path string) []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	return config.HttpServer.Endpoints[path]
+}
+
+func endpointAllowed(path string) bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	if len(config.HttpServer.Endpoints) == 0 {
+		return true
+	}
+
+	_, ok := config.HttpServer.Endpoints[path]
+	return ok
+}
+
+func dynamicEndpointHandler(fallback http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Path[1:]
+
+		configMutex.RLock()
+		_, command := config.CustomCommands[name]
+		_, handler := jsonCommandHandlers[name]
+		configMutex.RUnlock()
+
+		if name != "" && (command || handler) && endpointAllowed(req.URL.Path) {
+			if command {
+				commandHandler(w, req)
+			} else {
+				jsonCommandsHandler(w, req)
+			}
+		} else if fallback != nil {
+			fallback.ServeHTTP(w, req)
+		} else {
+			http.NotFound(w, req)
+		}
+	}
+}
+
+func configChanges(prefix string, a reflect.Value, b reflect.Value) []string {
+	if a.Kind() == reflect.Struct {
+		var changes []string
+
+		for i := 0; i < a.NumField(); i++ {
+			name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+
+			changes = append(changes, configChanges(name, a.Field(i), b.Field(i))...)
+		}
+
+		return changes
+	}
+
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return []string{prefix}
+	}
+
+	return nil
+}
+
+func (s *Session) setPendingConfig(device *DeviceConfig) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	s.pendingConfig = device
+}
+
+func (s *Session) applyPendingConfig() {
+	s.stateMutex.Lock()
+	device := s.pendingConfig
+	s.pendingConfig = nil
+	s.stateMutex.Unlock()
+
+	if device == nil {
+		return
+	}
+
+	if !reflect.DeepEqual(s.device().Scrcpy.ConnectedCommands, device.Scrcpy.ConnectedCommands) {
+		s.setConnectedCommands(device.Scrcpy.ConnectedCommands)
+	}
+
+	s.deviceConfig.Store(device)
+}
+
+func reloadConfig(source string, profile *string) (ReloadResult, error) {
+	result := ReloadResult{Applied: []string{}, ReconnectRequired: []string{}, RestartRequired: []string{}}
+
+	if source == "" {
+		source = configSource
+	}
+
+	if source == "-" {
+		return result, errors.New("configuration was read from stdin, a path or URL is required")
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	configMutex.RLock()
+	newProfile := configProfile
+	configMutex.RUnlock()
+
+	if profile != nil {
+		newProfile = *profile
+	}
+
+	c, err := readConfig(source, newProfile)
+	if err != nil {
+		return result, err
+	}
+
+	for _, handlerTemplate := range []struct {
+		enabled bool
+		name    string
+	}{
+		{config.TcpJsonCommands.Enabled, config.TcpJsonCommands.HandlerTemplate},
+		{config.UdpJsonCommands.Enabled, config.UdpJsonCommands.HandlerTemplate},
+		{config.TlsJsonCommands.Enabled, config.TlsJsonCommands.HandlerTemplate},
+		{config.StdinJsonCommands.Enabled, config.StdinJsonCommands.HandlerTemplate},
+	} {
+		if handlerTemplate.enabled && handlerTemplate.name != "" && c.JsonCommandHandlerTemplates[handlerTemplate.name] == "" {
+			return result, fmt.Errorf("handler template %s is in use", handlerTemplate.name)
+		}
+	}
+
+	handlers := map[string]*jsonCommandHandler{}
+	var started []*jsonCommandHandler
+
+	configMutex.RLock()
+	for name, handlerTemplate := range c.JsonCommandHandlerTemplates {
+		h := jsonCommandHandlers[name]
+		if h == nil || h.source != handlerTemplate {
+			h, err = startJsonCommandHandler(handlerTemplate)
+			if err != nil {
+				configMutex.RUnlock()
+
+				for _, h := range started {
+					h.close()
+				}
+
+				return result, err
+			}
+
+			started = append(started, h)
+		}
+
+		handlers[name] = h
+	}
+	configMutex.RUnlock()
+
+	configMutex.Lock()
+
+	if !reflect.DeepEqual(config.CustomCommands, c.CustomCommands) {
+		result.Applied = append(result.Applied, "customCommands")
+	}
+
+	if !reflect.DeepEqual(config.JsonCommandHandlerTemplates, c.JsonCommandHandlerTemplates) {
+		result.Applied = append(result.Applied, "jsonCommandHandlerTemplates")
+	}
+
+	if !reflect.DeepEqual(config.HttpServer.Endpoints, c.HttpServer.Endpoints) {
+		result.Applied = append(result.Applied, "httpServer.endpoints")
+	}
+
+	var stale []*jsonCommandHandler
+	for name, h := range jsonCommandHandlers {
+		if handlers[name] != h {
+			stale = append(stale, h)
+		}
+	}
+
+	if config.Log.Level != c.Log.Level {
+		result.Applied = append(result.Applied, "log.level")
+		logLevel.Set(c.Log.level())
+	}
+
+	config.CustomCommands = c.CustomCommands
+	config.JsonCommandHandlerTemplates = c.JsonCommandHandlerTemplates
+	config.HttpServer.Endpoints = c.HttpServer.Endpoints
+	config.Log.Level = c.Log.Level
+	configProfile = newProfile
+	jsonCommandHandlers = handlers
+
+	configMutex.Unlock()
+
+	for _, h := range stale {
+		go h.close()
+	}
+
+	newHttpServer := c.HttpServer
+	newHttpServer.Endpoints = config.HttpServer.Endpoints
+
+	for _, section := range []struct {
+		name string
+		a    any
+		b    any
+	}{
+		{"httpServer", config.HttpServer, newHttpServer},
+		{"tcpJsonCommands", config.TcpJsonCommands, c.TcpJsonCommands},
+		{"udpJsonCommands", config.UdpJsonCommands, c.UdpJsonCommands},
+		{"tlsJsonCommands", config.TlsJsonCommands, c.TlsJsonCommands},
+		{"stdinJsonCommands", config.StdinJsonCommands, c.StdinJsonCommands},
+		{"log", config.Log, c.Log},
+		{"auditLog", config.AuditLog, c.AuditLog},
+	} {
+		result.RestartRequired = append(result.RestartRequired, configChanges(section.name, reflect.ValueOf(section.a), reflect.ValueOf(section.b))...)
+	}
+
+	devices := map[string]DeviceConfig{"": {Adb: c.Adb, Scrcpy: c.Scrcpy, VideoDecoder: c.VideoDecoder}}
+	for name, device := range c.Devices {
+		devices[name] = device
+	}
+
+	for name := range devices {
+		if sessions[name] == nil {
+			result.RestartRequired = append(result.RestartRequired, "devices."+name)
+		}
+	}
+
+	for name, s := range sessions {
+		prefix := ""
+		if name != "" {
+			prefix = "devices." + name
+		}
+
+		device, ok := devices[name]
+		if !ok {
+			result.RestartRequired = append(result.RestartRequired, prefix)
+			continue
+		}
+
+		changes := configChanges(prefix, reflect.ValueOf(*s.device()), reflect.ValueOf(device))
+		if len(changes) == 0 {
+			s.setPendingConfig(nil)
+			continue
+		}
+
+		restart := false
+
+		for _, change := range changes {
+			setting := strings.TrimPrefix(strings.TrimPrefix(change, prefix), ".")
+
+			for _, restartSetting := range restartRequiredDeviceSettings {
+				if strings.HasPrefix(setting, restartSetting) || (setting == "scrcpy.address" && !s.device().Scrcpy.Forward) {
+					restart = true
+				}
+			}
+		}
+
+		if restart {
+			s.setPendingConfig(nil)
+			result.RestartRequired = append(result.RestartRequired, changes...)
+		} else {
+			s.setPendingConfig(&device)
+			result.ReconnectRequired = append(result.ReconnectRequired, changes...)
+		}
+	}
+
+	slices.Sort(result.ReconnectRequired)
+	slices.Sort(result.RestartRequired)
+
+	return result, nil
+}
@@ -0,0 +1,1168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var yamlNumberPattern = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+var tomlBareKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+var tomlKeyValuePattern = regexp.MustCompile(`^("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)(\s*\.\s*("[^"]*"|'[^']*'|[A-Za-z0-9_-]+))*\s*=`)
+
+func configFormat(source string, contentType string) string {
+	name := source
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		u, err := url.Parse(source)
+		if err == nil {
+			name = u.Path
+		}
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".json", ".jsonc":
+		return "json"
+	}
+
+	switch {
+	case strings.Contains(contentType, "yaml"):
+		return "yaml"
+	case strings.Contains(contentType, "toml"):
+		return "toml"
+	}
+
+	return "json"
+}
+
+func configContentFormat(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "/*") {
+			return "json"
+		}
+
+		if strings.HasPrefix(line, "[") || tomlKeyValuePattern.MatchString(line) {
+			return "toml"
+		}
+
+		break
+	}
+
+	return "yaml"
+}
+
+func configToJson(format string, data []byte) ([]byte, error) {
+	var v any
+	var err error
+
+	switch format {
+	case "yaml":
+		v, err = parseYaml(string(data))
+	case "toml":
+		v, err = parseToml(string(data))
+	default:
+		return stripJsonComments(data), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func stripJsonComments(data []byte) []byte {
+	stripped := make([]byte, len(data))
+	copy(stripped, data)
+
+	inString := false
+
+	for i := 0; i < len(stripped); i++ {
+		c := stripped[i]
+
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+		} else if c == '/' && i+1 < len(stripped) && stripped[i+1] == '/' {
+			for ; i < len(stripped) && stripped[i] != '\n'; i++ {
+				stripped[i] = ' '
+			}
+		} else if c == '/' && i+1 < len(stripped) && stripped[i+1] == '*' {
+			end := i + 2
+			for end+1 < len(stripped) && !(stripped[end] == '*' && stripped[end+1] == '/') {
+				end++
+			}
+
+			end = min(end+2, len(stripped))
+
+			for ; i < end; i++ {
+				if stripped[i] != '\n' {
+					stripped[i] = ' '
+				}
+			}
+
+			i--
+		}
+	}
+
+	inString = false
+
+	for i := 0; i < len(stripped); i++ {
+		c := stripped[i]
+
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+
+			continue
+		}
+
+		if c == '"' {
+			inString = true
+		} else if c == ',' {
+			j := i + 1
+			for j < len(stripped) && strings.IndexByte(" \t\r\n", stripped[j]) >= 0 {
+				j++
+			}
+
+			if j < len(stripped) && (stripped[j] == ']' || stripped[j] == '}') {
+				stripped[i] = ' '
+			}
+		}
+	}
+
+	return stripped
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+	raw    string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func parseYaml(data string) (any, error) {
+	p := &yamlParser{}
+	ended := false
+
+	for n, raw := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		content := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(content)
+
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", n+1)
+		}
+
+		text := strings.TrimRight(stripYamlComment(content), " \t")
+
+		if indent == 0 && text == "..." {
+			ended = true
+			text = ""
+		} else if indent == 0 && text == "---" {
+			for _, line := range p.lines {
+				if line.text != "" {
+					return nil, fmt.Errorf("line %d: multiple documents are not supported", n+1)
+				}
+			}
+
+			text = ""
+		} else if indent == 0 && strings.HasPrefix(text, "%") {
+			return nil, fmt.Errorf("line %d: directives are not supported", n+1)
+		} else if ended && text != "" {
+			return nil, fmt.Errorf("line %d: multiple documents are not supported", n+1)
+		}
+
+		p.lines = append(p.lines, yamlLine{number: n + 1, indent: indent, text: text, raw: raw})
+	}
+
+	v, err := p.parseNode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipBlank()
+	if p.i < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected content", p.lines[p.i].number)
+	}
+
+	return v, nil
+}
+
+func stripYamlComment(s string) string {
+	var quote byte
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				if quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+					i++
+				} else {
+					quote = 0
+				}
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t[{,:-", s[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.i < len(p.lines) && p.lines[p.i].text == "" {
+		p.i++
+	}
+}
+
+func (p *yamlParser) parseNode(indent int) (any, error) {
+	p.skipBlank()
+	if p.i >= len(p.lines) || p.lines[p.i].indent < indent {
+		return nil, nil
+	}
+
+	line := p.lines[p.i]
+
+	if isYamlSequenceItem(line.text) {
+		return p.parseSequence(line.indent)
+	}
+
+	if _, _, ok := splitYamlKey(line.text); ok {
+		return p.parseMapping(line.indent)
+	}
+
+	p.i++
+	return p.parseInlineValue(line.text, line.indent, line.number)
+}
+
+func isYamlSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseSequence(indent int) ([]any, error) {
+	sequence := []any{}
+
+	for {
+		p.skipBlank()
+		if p.i >= len(p.lines) || p.lines[p.i].indent < indent {
+			return sequence, nil
+		}
+
+		line := p.lines[p.i]
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+
+		if !isYamlSequenceItem(line.text) {
+			return sequence, nil
+		}
+
+		rest := strings.TrimLeft(line.text[1:], " ")
+
+		var item any
+		var err error
+
+		if rest == "" {
+			p.i++
+			item, err = p.parseNode(indent + 1)
+		} else if _, _, ok := splitYamlKey(rest); ok || isYamlSequenceItem(rest) {
+			p.lines[p.i].indent = indent + len(line.text) - len(rest)
+			p.lines[p.i].text = rest
+			item, err = p.parseNode(p.lines[p.i].indent)
+		} else {
+			p.i++
+			item, err = p.parseInlineValue(rest, indent, line.number)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		sequence = append(sequence, item)
+	}
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]any, error) {
+	mapping := map[string]any{}
+
+	for {
+		p.skipBlank()
+		if p.i >= len(p.lines) || p.lines[p.i].indent < indent {
+			return mapping, nil
+		}
+
+		line := p.lines[p.i]
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+
+		key, rest, ok := splitYamlKey(line.text)
+		if !ok {
+			if isYamlSequenceItem(line.text) {
+				return mapping, nil
+			}
+
+			return nil, fmt.Errorf("line %d: expected a key", line.number)
+		}
+
+		if _, ok := mapping[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+
+		p.i++
+
+		var value any
+		var err error
+
+		if rest == "" {
+			p.skipBlank()
+
+			if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+				value, err = p.parseNode(p.lines[p.i].indent)
+			} else if p.i < len(p.lines) && p.lines[p.i].indent == indent && isYamlSequenceItem(p.lines[p.i].text) {
+				value, err = p.parseSequence(indent)
+			}
+		} else {
+			value, err = p.parseInlineValue(rest, indent, line.number)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		mapping[key] = value
+	}
+}
+
+func splitYamlKey(text string) (string, string, bool) {
+	if text == "" || strings.IndexByte("[{&*!|>%@`", text[0]) >= 0 {
+		return "", "", false
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := parseYamlQuoted(text)
+		if err != nil {
+			return "", "", false
+		}
+
+		rest := strings.TrimLeft(text[n:], " ")
+		if rest == ":" || strings.HasPrefix(rest, ": ") {
+			return key, strings.TrimSpace(rest[1:]), true
+		}
+
+		return "", "", false
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimRight(text[:i], " "), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+
+	return "", "", false
+}
+
+func (p *yamlParser) parseInlineValue(text string, indent int, number int) (any, error) {
+	if text[0] == '|' || text[0] == '>' {
+		return p.parseBlockScalar(text, indent, number)
+	}
+
+	if text[0] == '[' || text[0] == '{' {
+		for !yamlFlowComplete(text) && p.i < len(p.lines) {
+			text += " " + strings.TrimSpace(p.lines[p.i].text)
+			p.i++
+		}
+
+		v, n, err := parseYamlFlow(text, 0)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+
+		if strings.TrimSpace(text[n:]) != "" {
+			return nil, fmt.Errorf("line %d: unexpected content after flow collection", number)
+		}
+
+		return v, nil
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+		s, n, err := parseYamlQuoted(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+
+		if strings.TrimSpace(text[n:]) != "" {
+			return nil, fmt.Errorf("line %d: unexpected content after quoted string", number)
+		}
+
+		return s, nil
+	}
+
+	if strings.IndexByte("&*!", text[0]) >= 0 {
+		return nil, fmt.Errorf("line %d: anchors, aliases and tags are not supported", number)
+	}
+
+	return yamlScalar(text), nil
+}
+
+func yamlFlowComplete(text string) bool {
+	depth := 0
+	var quote byte
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+
+	return depth <= 0
+}
+
+func (p *yamlParser) parseBlockScalar(header string, indent int, number int) (any, error) {
+	folded := header[0] == '>'
+	chomping := byte(0)
+
+	for _, c := range []byte(strings.TrimSpace(header[1:])) {
+		if c == '-' || c == '+' {
+			chomping = c
+		} else {
+			return nil, fmt.Errorf("line %d: unsupported block scalar header %q", number, header)
+		}
+	}
+
+	var lines []string
+	contentIndent := -1
+
+	for p.i < len(p.lines) {
+		line := p.lines[p.i]
+
+		if strings.TrimSpace(line.raw) == "" {
+			lines = append(lines, "")
+			p.i++
+			continue
+		}
+
+		if line.indent <= indent {
+			break
+		}
+
+		if contentIndent < 0 {
+			contentIndent = line.indent
+		} else if line.indent < contentIndent {
+			break
+		}
+
+		lines = append(lines, line.raw[contentIndent:])
+		p.i++
+	}
+
+	trailing := 0
+	for trailing < len(lines) && lines[len(lines)-1-trailing] == "" {
+		trailing++
+	}
+
+	lines = lines[:len(lines)-trailing]
+	if trailing > 0 {
+		p.i -= trailing
+		p.skipBlank()
+	}
+
+	var s string
+
+	if folded {
+		var b strings.Builder
+
+		for i, line := range lines {
+			if i > 0 {
+				if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(lines[i-1], " ") {
+					b.WriteByte('\n')
+				} else if lines[i-1] != "" {
+					b.WriteByte(' ')
+				}
+			}
+
+			b.WriteString(line)
+		}
+
+		s = b.String()
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+
+	switch {
+	case len(lines) == 0:
+	case chomping == '+':
+		s += strings.Repeat("\n", trailing+1)
+	case chomping == 0:
+		s += "\n"
+	}
+
+	return s, nil
+}
+
+func parseYamlQuoted(text string) (string, int, error) {
+	if text[0] == '"' {
+		for i := 1; i < len(text); i++ {
+			if text[i] == '\\' {
+				i++
+			} else if text[i] == '"' {
+				var s string
+				err := json.Unmarshal([]byte(text[:i+1]), &s)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid double-quoted string %s", text[:i+1])
+				}
+
+				return s, i + 1, nil
+			}
+		}
+
+		return "", 0, errors.New("unterminated double-quoted string")
+	}
+
+	var b strings.Builder
+
+	for i := 1; i < len(text); i++ {
+		if text[i] == '\'' {
+			if i+1 < len(text) && text[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+
+			return b.String(), i + 1, nil
+		}
+
+		b.WriteByte(text[i])
+	}
+
+	return "", 0, errors.New("unterminated single-quoted string")
+}
+
+func parseYamlFlow(text string, pos int) (any, int, error) {
+	for pos < len(text) && text[pos] == ' ' {
+		pos++
+	}
+
+	if pos >= len(text) {
+		return nil, pos, errors.New("unexpected end of flow collection")
+	}
+
+	switch text[pos] {
+	case '[':
+		sequence := []any{}
+		pos++
+
+		for {
+			for pos < len(text) && text[pos] == ' ' {
+				pos++
+			}
+
+			if pos < len(text) && text[pos] == ']' {
+				return sequence, pos + 1, nil
+			}
+
+			v, n, err := parseYamlFlow(text, pos)
+			if err != nil {
+				return nil, n, err
+			}
+
+			sequence = append(sequence, v)
+			pos = n
+
+			for pos < len(text) && text[pos] == ' ' {
+				pos++
+			}
+
+			if pos < len(text) && text[pos] == ',' {
+				pos++
+			} else if pos >= len(text) || text[pos] != ']' {
+				return nil, pos, errors.New("expected , or ] in flow sequence")
+			}
+		}
+	case '{':
+		mapping := map[string]any{}
+		pos++
+
+		for {
+			for pos < len(text) && text[pos] == ' ' {
+				pos++
+			}
+
+			if pos < len(text) && text[pos] == '}' {
+				return mapping, pos + 1, nil
+			}
+
+			k, n, err := parseYamlFlow(text, pos)
+			if err != nil {
+				return nil, n, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+
+			pos = n
+			for pos < len(text) && text[pos] == ' ' {
+				pos++
+			}
+
+			if pos >= len(text) || text[pos] != ':' {
+				return nil, pos, errors.New("expected : in flow mapping")
+			}
+
+			v, n, err := parseYamlFlow(text, pos+1)
+			if err != nil {
+				return nil, n, err
+			}
+
+			mapping[key] = v
+			pos = n
+
+			for pos < len(text) && text[pos] == ' ' {
+				pos++
+			}
+
+			if pos < len(text) && text[pos] == ',' {
+				pos++
+			} else if pos >= len(text) || text[pos] != '}' {
+				return nil, pos, errors.New("expected , or } in flow mapping")
+			}
+		}
+	case '"', '\'':
+		s, n, err := parseYamlQuoted(text[pos:])
+		return s, pos + n, err
+	}
+
+	end := pos
+	for end < len(text) && strings.IndexByte(",]}", text[end]) < 0 && !(text[end] == ':' && (end+1 == len(text) || text[end+1] == ' ')) {
+		end++
+	}
+
+	return yamlScalar(strings.TrimSpace(text[pos:end])), end, nil
+}
+
+func yamlScalar(s string) any {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	if yamlNumberPattern.MatchString(s) {
+		return json.Number(strings.TrimPrefix(s, "+"))
+	}
+
+	return s
+}
+
+type tomlParser struct {
+	data    string
+	pos     int
+	line    int
+	defined map[string]bool
+}
+
+func parseToml(data string) (any, error) {
+	p := &tomlParser{data: strings.ReplaceAll(data, "\r\n", "\n"), line: 1, defined: map[string]bool{}}
+	root := map[string]any{}
+	current := root
+
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.data) {
+			return root, nil
+		}
+
+		var err error
+
+		if p.data[p.pos] == '[' {
+			current, err = p.parseTableHeader(root)
+		} else {
+			err = p.parseKeyValue(current)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+
+		p.skipSpace(false)
+		if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+			return nil, fmt.Errorf("line %d: expected end of line", p.line)
+		}
+	}
+}
+
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) parseTableHeader(root map[string]any) (map[string]any, error) {
+	array := strings.HasPrefix(p.data[p.pos:], "[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+
+	p.skipSpace(false)
+	if !strings.HasPrefix(p.data[p.pos:], closing) {
+		return nil, fmt.Errorf("expected %s", closing)
+	}
+
+	p.pos += len(closing)
+
+	table, err := tomlTable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := keys[len(keys)-1]
+
+	if array {
+		tables, ok := table[last].([]any)
+		if !ok && table[last] != nil {
+			return nil, fmt.Errorf("%s is already defined", strings.Join(keys, "."))
+		}
+
+		current := map[string]any{}
+		table[last] = append(tables, current)
+		return current, nil
+	}
+
+	name := strings.Join(keys, "\x00")
+	if p.defined[name] {
+		return nil, fmt.Errorf("table %s is already defined", strings.Join(keys, "."))
+	}
+
+	p.defined[name] = true
+
+	return tomlTable(root, keys)
+}
+
+func tomlTable(table map[string]any, keys []string) (map[string]any, error) {
+	for _, key := range keys {
+		switch v := table[key].(type) {
+		case nil:
+			next := map[string]any{}
+			table[key] = next
+			table = next
+		case map[string]any:
+			table = v
+		case []any:
+			next, ok := v[len(v)-1].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s is not a table", key)
+			}
+
+			table = next
+		default:
+			return nil, fmt.Errorf("%s is not a table", key)
+		}
+	}
+
+	return table, nil
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.data) {
+			return nil, errors.New("expected a key")
+		}
+
+		var key string
+		var err error
+
+		switch p.data[p.pos] {
+		case '"':
+			key, err = p.parseBasicString()
+		case '\'':
+			key, err = p.parseLiteralString()
+		default:
+			key = tomlBareKeyPattern.FindString(p.data[p.pos:])
+			if key == "" {
+				return nil, errors.New("expected a key")
+			}
+
+			p.pos += len(key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+
+		p.skipSpace(false)
+		if p.pos >= len(p.data) || p.data[p.pos] != '.' {
+			return keys, nil
+		}
+
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseKeyValue(table map[string]any) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+
+	p.skipSpace(false)
+	if p.pos >= len(p.data) || p.data[p.pos] != '=' {
+		return errors.New("expected =")
+	}
+
+	p.pos++
+
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	table, err = tomlTable(table, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+
+	last := keys[len(keys)-1]
+	if _, ok := table[last]; ok {
+		return fmt.Errorf("%s is already defined", strings.Join(keys, "."))
+	}
+
+	table[last] = value
+	return nil
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	p.skipSpace(false)
+	if p.pos >= len(p.data) {
+		return nil, errors.New("expected a value")
+	}
+
+	switch p.data[p.pos] {
+	case '"':
+		if strings.HasPrefix(p.data[p.pos:], `"""`) {
+			return p.parseMultilineString(`"""`)
+		}
+
+		return p.parseBasicString()
+	case '\'':
+		if strings.HasPrefix(p.data[p.pos:], "'''") {
+			return p.parseMultilineString("'''")
+		}
+
+		return p.parseLiteralString()
+	case '[':
+		p.pos++
+		array := []any{}
+
+		for {
+			p.skipSpace(true)
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+
+			array = append(array, v)
+
+			p.skipSpace(true)
+			if p.pos < len(p.data) && p.data[p.pos] == ',' {
+				p.pos++
+			} else if p.pos >= len(p.data) || p.data[p.pos] != ']' {
+				return nil, errors.New("expected , or ] in array")
+			}
+		}
+	case '{':
+		p.pos++
+		table := map[string]any{}
+
+		p.skipSpace(false)
+		if p.pos < len(p.data) && p.data[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+
+		for {
+			err := p.parseKeyValue(table)
+			if err != nil {
+				return nil, err
+			}
+
+			p.skipSpace(false)
+			if p.pos < len(p.data) && p.data[p.pos] == ',' {
+				p.pos++
+			} else if p.pos < len(p.data) && p.data[p.pos] == '}' {
+				p.pos++
+				return table, nil
+			} else {
+				return nil, errors.New("expected , or } in inline table")
+			}
+		}
+	}
+
+	end := p.pos
+	for end < len(p.data) && strings.IndexByte(" \t\n#,]}", p.data[end]) < 0 {
+		end++
+	}
+
+	token := p.data[p.pos:end]
+	p.pos = end
+
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf", "-inf", "nan", "+nan", "-nan":
+		return nil, fmt.Errorf("unsupported value %s", token)
+	}
+
+	if strings.ContainsAny(token, ":") || strings.Count(strings.TrimLeft(token, "+-"), "-") >= 2 {
+		return nil, fmt.Errorf("dates and times are not supported: %s", token)
+	}
+
+	digits := strings.TrimLeft(token, "+-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' || (len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9') {
+		return nil, fmt.Errorf("invalid value %q", token)
+	}
+
+	if i, err := strconv.ParseInt(token, 0, 64); err == nil {
+		return json.Number(strconv.FormatInt(i, 10)), nil
+	}
+
+	if f, err := strconv.ParseFloat(strings.ReplaceAll(token, "_", ""), 64); err == nil && !strings.ContainsAny(token, "xX") {
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+
+	return nil, fmt.Errorf("invalid value %q", token)
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	var b strings.Builder
+	p.pos++
+
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\n':
+			return "", errors.New("unterminated string")
+		case '\\':
+			err := p.parseEscape(&b)
+			if err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", errors.New("unterminated string")
+}
+
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos+1 >= len(p.data) {
+		return errors.New("unterminated escape sequence")
+	}
+
+	c := p.data[p.pos+1]
+	p.pos += 2
+
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1B)
+	case '"':
+		b.WriteByte('"')
+	case '\\':
+		b.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+
+		if p.pos+n > len(p.data) {
+			return errors.New("invalid unicode escape")
+		}
+
+		r, err := strconv.ParseUint(p.data[p.pos:p.pos+n], 16, 32)
+		if err != nil {
+			return errors.New("invalid unicode escape")
+		}
+
+		b.WriteRune(rune(r))
+		p.pos += n
+	default:
+		return fmt.Errorf("invalid escape sequence \\%c", c)
+	}
+
+	return nil
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	end := strings.IndexAny(p.data[p.pos+1:], "'\n")
+	if end < 0 || p.data[p.pos+1+end] != '\'' {
+		return "", errors.New("unterminated string")
+	}
+
+	s := p.data[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+	return s, nil
+}
+
+func (p *tomlParser) parseMultilineString(delimiter string) (string, error) {
+	var b strings.Builder
+	p.pos += 3
+
+	if strings.HasPrefix(p.data[p.pos:], "\n") {
+		p.pos++
+		p.line++
+	}
+
+	for p.pos < len(p.data) {
+		if strings.HasPrefix(p.data[p.pos:], delimiter) {
+			p.pos += 3
+
+			for i := 0; i < 2 && strings.HasPrefix(p.data[p.pos:], delimiter[:1]); i++ {
+				b.WriteByte(delimiter[0])
+				p.pos++
+			}
+
+			return b.String(), nil
+		}
+
+		c := p.data[p.pos]
+
+		if c == '\n' {
+			p.line++
+		}
+
+		if c == '\\' && delimiter == `"""` {
+			rest := strings.TrimLeft(p.data[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") {
+				p.pos = len(p.data) - len(rest)
+
+				for p.pos < len(p.data) && strings.IndexByte(" \t\n", p.data[p.pos]) >= 0 {
+					if p.data[p.pos] == '\n' {
+						p.line++
+					}
+
+					p.pos++
+				}
+
+				continue
+			}
+
+			err := p.parseEscape(&b)
+			if err != nil {
+				return "", err
+			}
+
+			continue
+		}
+
+		b.WriteByte(c)
+		p.pos++
+	}
+
+	return "", errors.New("unterminated multi-line string")
+}
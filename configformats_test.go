@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+type configFormatTest struct {
+	name  string
+	input string
+	want  string
+	err   string
+}
+
+func runConfigFormatTests(t *testing.T, format string, tests []configFormatTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := configToJson(format, []byte(test.input))
+			if err == nil {
+				_, err = decodeConfigValue(data)
+			}
+
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("got %s, want error %q", data, test.err)
+				}
+
+				if err.Error() != test.err {
+					t.Fatalf("got error %q, want %q", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(data) != test.want {
+				t.Fatalf("got %s, want %s", data, test.want)
+			}
+		})
+	}
+}
+
+func TestYaml(t *testing.T) {
+	runConfigFormatTests(t, "yaml", []configFormatTest{
+		{
+			name:  "numbers",
+			input: "a: 1\nb: -2.5\nc: +3\nd: 1e3\ne: 0\nf: -0.5E-2\n",
+			want:  `{"a":1,"b":-2.5,"c":3,"d":1e3,"e":0,"f":-0.5E-2}`,
+		},
+		{
+			name:  "invalid numbers",
+			input: "a: 00\nb: 0123456789\nc: 1.\nd: .5\ne: 0x10\nf: 1_000\ng: 1e\nh: +-1\n",
+			want:  `{"a":"00","b":"0123456789","c":"1.","d":".5","e":"0x10","f":"1_000","g":"1e","h":"+-1"}`,
+		},
+		{
+			name:  "scalars",
+			input: "a: true\nb: False\nc: ~\nd: null\ne:\nf: hello world\ng: 'it''s'\nh: \"a\\tb\"\ni: \"1\"\nj: http://host:1/x\n",
+			want:  `{"a":true,"b":false,"c":null,"d":null,"e":null,"f":"hello world","g":"it's","h":"a\tb","i":"1","j":"http://host:1/x"}`,
+		},
+		{
+			name:  "nesting",
+			input: "a:\n  b:\n    - c: 1\n      d: [2]\n    -\n      - x\n      - y\n  e: f\ng:\n- 1\n- 2\n",
+			want:  `{"a":{"b":[{"c":1,"d":[2]},["x","y"]],"e":"f"},"g":[1,2]}`,
+		},
+		{
+			name:  "flow collections",
+			input: "a: [1, \"x, y\", {b: c, 'd': [true, ~]}]\ne: {f: [], g: {}}\nh: [\n  1,\n  2\n]\n",
+			want:  `{"a":[1,"x, y",{"b":"c","d":[true,null]}],"e":{"f":[],"g":{}},"h":[1,2]}`,
+		},
+		{
+			name:  "literal block scalars",
+			input: "a: |\n  x\n   y\n\n  z\n\nb: |-\n  x\nc: |+\n  x\n\nd: 1\n",
+			want:  `{"a":"x\n y\n\nz\n","b":"x","c":"x\n\n","d":1}`,
+		},
+		{
+			name:  "folded block scalars",
+			input: "a: >\n  x\n  y\n\n  z\nb: >-\n  x\n    y\n  z\n",
+			want:  `{"a":"x y\nz\n","b":"x\n  y\nz"}`,
+		},
+		{
+			name:  "comments",
+			input: "# header\n---\na: b # trailing\nc: \"d # not a comment\"\ne: f#g\n  # indented\nh: [1, 2] # after flow\n...\n",
+			want:  `{"a":"b","c":"d # not a comment","e":"f#g","h":[1,2]}`,
+		},
+		{
+			name:  "tab indentation",
+			input: "a:\n\tb: 1\n",
+			err:   "line 2: tabs are not allowed in indentation",
+		},
+		{
+			name:  "duplicate key",
+			input: "a: 1\nb: 2\na: 3\n",
+			err:   `line 3: duplicate key "a"`,
+		},
+		{
+			name:  "unexpected indentation",
+			input: "a:\n  b: 1\n    c: 2\n",
+			err:   "line 3: unexpected indentation",
+		},
+		{
+			name:  "unterminated string",
+			input: "a: 1\nb: \"x\n",
+			err:   "line 2: unterminated double-quoted string",
+		},
+		{
+			name:  "unterminated flow collection",
+			input: "a: [1, 2\nb: 3\n",
+			err:   "line 1: expected , or ] in flow sequence",
+		},
+		{
+			name:  "aliases",
+			input: "a: &x 1\n",
+			err:   "line 1: anchors, aliases and tags are not supported",
+		},
+		{
+			name:  "multiple documents",
+			input: "a: 1\n---\nb: 2\n",
+			err:   "line 2: multiple documents are not supported",
+		},
+		{
+			name:  "content after document end",
+			input: "a: 1\n...\n\nb: 2\n",
+			err:   "line 4: multiple documents are not supported",
+		},
+	})
+}
+
+func TestToml(t *testing.T) {
+	runConfigFormatTests(t, "toml", []configFormatTest{
+		{
+			name:  "scalars",
+			input: "a = 1\nb = -2.5\nc = 0x10\nd = 1_000\ne = 1.5e3\nf = true\ng = \"x\\ty\"\nh = 'C:\\path'\n",
+			want:  `{"a":1,"b":-2.5,"c":16,"d":1000,"e":1500,"f":true,"g":"x\ty","h":"C:\\path"}`,
+		},
+		{
+			name:  "tables",
+			input: "a.b = 1\n[c]\nd = 2\n[c.e]\nf = 3\n[[g]]\nh = 4\n[[g]]\nh = 5\n",
+			want:  `{"a":{"b":1},"c":{"d":2,"e":{"f":3}},"g":[{"h":4},{"h":5}]}`,
+		},
+		{
+			name:  "inline collections",
+			input: "a = [1, [\"x\", 'y'], { b = 2 }]\nc = {}\nd = [\n  1,\n  2,\n]\n",
+			want:  `{"a":[1,["x","y"],{"b":2}],"c":{},"d":[1,2]}`,
+		},
+		{
+			name:  "multi-line strings",
+			input: "a = \"\"\"\nx\ny\"\"\"\nb = '''\nc:\\x\n'''\nc = \"\"\"x \\\n   y\"\"\"\n",
+			want:  `{"a":"x\ny","b":"c:\\x\n","c":"x y"}`,
+		},
+		{
+			name:  "comments",
+			input: "# header\na = \"# not a comment\" # trailing\n[b] # table\nc = 1\n",
+			want:  `{"a":"# not a comment","b":{"c":1}}`,
+		},
+		{
+			name:  "duplicate key",
+			input: "a = 1\n\na = 2\n",
+			err:   "line 3: a is already defined",
+		},
+		{
+			name:  "duplicate table",
+			input: "[a]\nb = 1\n[a]\n",
+			err:   "line 3: table a is already defined",
+		},
+		{
+			name:  "leading zero",
+			input: "a = 1\nb = 01\n",
+			err:   `line 2: invalid value "01"`,
+		},
+		{
+			name:  "dates",
+			input: "a = 2024-01-01\n",
+			err:   "line 1: dates and times are not supported: 2024-01-01",
+		},
+		{
+			name:  "missing equals",
+			input: "a = 1\nb 2\n",
+			err:   "line 2: expected =",
+		},
+		{
+			name:  "error after multi-line string",
+			input: "a = \"\"\"\nx\n\"\"\"\nb = ?\n",
+			err:   `line 4: invalid value "?"`,
+		},
+	})
+}
+
+func TestJsonc(t *testing.T) {
+	runConfigFormatTests(t, "json", []configFormatTest{
+		{
+			name:  "comments",
+			input: "// header\n{\"a\": \"// not a comment\", /* block\n */ \"b\": \"/* x */\"}",
+			want:  "         \n{\"a\": \"// not a comment\",         \n    \"b\": \"/* x */\"}",
+		},
+		{
+			name:  "trailing commas",
+			input: `{"a": [1, 2,], "b": {"c": "x,]"},}`,
+			want:  `{"a": [1, 2 ], "b": {"c": "x,]"} }`,
+		},
+		{
+			name:  "error position",
+			input: "{\n  \"a\": 1,\n  \"b\": ?\n}",
+			err:   "line 3: invalid character '?' looking for beginning of value",
+		},
+	})
+}
+
+func TestConfigContentFormat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"{\"a\": 1}", "json"},
+		{"// c\n{}", "json"},
+		{"# c\n\na = 1", "toml"},
+		{"[table]\na = 1", "toml"},
+		{"\"quoted.key\" = 1", "toml"},
+		{"a.b = 1", "toml"},
+		{"a: 1", "yaml"},
+		{"a: x = y", "yaml"},
+		{"- 1", "yaml"},
+		{"", "yaml"},
+	}
+
+	for _, test := range tests {
+		got := configContentFormat([]byte(test.input))
+		if got != test.want {
+			t.Errorf("configContentFormat(%q) = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestReadStdinConfigData(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		rest  string
+	}{
+		{
+			name:  "json",
+			input: " {\"a\": {\"b\": \"}\"}}\n{\"commands\": []}\n",
+			want:  `{"a": {"b": "}"}}`,
+			rest:  "\n{\"commands\": []}\n",
+		},
+		{
+			name:  "jsonc",
+			input: "// }\n{\"a\": 1, /* } */}{\"commands\": []}",
+			want:  "    \n{\"a\": 1         }",
+			rest:  `{"commands": []}`,
+		},
+		{
+			name:  "yaml",
+			input: "a: 1\nb: [x]\n...\n{\"commands\": []}\n",
+			want:  `{"a":1,"b":["x"]}`,
+			rest:  "{\"commands\": []}\n",
+		},
+		{
+			name:  "yaml until end of input",
+			input: "a: 1",
+			want:  `{"a":1}`,
+		},
+		{
+			name:  "toml",
+			input: "[a]\nb = 1\n...\n{\"commands\": []}\n",
+			want:  `{"a":{"b":1}}`,
+			rest:  "{\"commands\": []}\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.input))
+
+			data, err := readStdinConfigData(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(data) != test.want {
+				t.Fatalf("got %q, want %q", data, test.want)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if string(rest) != test.rest {
+				t.Fatalf("left %q, want %q", rest, test.rest)
+			}
+		})
+	}
+
+	_, err := readStdinConfigData(bufio.NewReader(strings.NewReader(`{"a": [1`)))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
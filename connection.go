@@ -0,0 +1,775 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type connectionRequest struct {
+	connect   bool
+	reconnect bool
+	address   string
+	reason    error
+}
+
+var ConnectionStates = struct {
+	Idle           string
+	StartingServer string
+	Connecting     string
+	Connected      string
+	Reconnecting   string
+	Failed         string
+}{
+	Idle:           "idle",
+	StartingServer: "startingserver",
+	Connecting:     "connecting",
+	Connected:      "connected",
+	Reconnecting:   "reconnecting",
+	Failed:         "failed",
+}
+
+type ConnectionStatus struct {
+	State         string `json:"state"`
+	LastError     string `json:"lastError"`
+	Attempts      int    `json:"attempts"`
+	DeviceName    string `json:"deviceName"`
+	ServerRunning bool   `json:"serverRunning"`
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+func (c RetryConfig) delay(attempt int) time.Duration {
+	delay := float64(c.InitialDelay) * math.Pow(c.Multiplier, float64(attempt-1))
+	return time.Duration(min(delay, float64(c.MaxDelay))) * time.Millisecond
+}
+
+func (s *Session) setState(state string, err error) {
+	s.stateMutex.Lock()
+	changed := s.state != state
+	s.state = state
+	if changed && state == ConnectionStates.Reconnecting {
+		s.reconnects++
+	}
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	s.stateMutex.Unlock()
+
+	if changed {
+		if err != nil {
+			slog.Info("connection state changed", "device", s.Name, "state", state, "error", err)
+		} else {
+			slog.Info("connection state changed", "device", s.Name, "state", state)
+		}
+
+		s.events.publish(Event{Type: "statechange", Data: state})
+	}
+}
+
+func (s *Session) currentState() string {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	return s.state
+}
+
+func (s *Session) setAttempts(attempts int) {
+	s.stateMutex.Lock()
+	s.attempts = attempts
+	s.stateMutex.Unlock()
+}
+
+func (s *Session) status() ConnectionStatus {
+	s.stateMutex.Lock()
+	status := ConnectionStatus{State: s.state, LastError: s.lastError, Attempts: s.attempts}
+	s.stateMutex.Unlock()
+
+	if status.State == ConnectionStates.Connected {
+		status.DeviceName = s.deviceName
+	}
+
+	s.scrcpyServerMutex.Lock()
+	status.ServerRunning = s.scrcpyServer != nil
+	s.scrcpyServerMutex.Unlock()
+
+	return status
+}
+
+func (s *Session) closeSockets() {
+	if s.videoSocket != nil {
+		s.videoSocket.Close()
+	}
+
+	if s.audioSocket != nil {
+		s.audioSocket.Close()
+	}
+
+	if s.controlSocket != nil {
+		s.controlSocket.Close()
+	}
+}
+
+func (s *Session) runConnection() {
+	var err error
+
+	if !s.device().Scrcpy.Forward {
+		s.scrcpyListener, err = net.Listen("tcp", s.device().Scrcpy.Address)
+		if err != nil {
+			slog.Error("scrcpy listen failed", "device", s.Name, "address", s.device().Scrcpy.Address, "error", err)
+			s.setState(ConnectionStates.Failed, err)
+			return
+		}
+		defer s.scrcpyListener.Close()
+	}
+
+	var address string
+	var attempts int
+	var reconnecting bool
+	var retry <-chan time.Time
+
+	pending := make(chan connectionRequest, 1)
+
+	for {
+		var lost error
+		var restart bool
+		var r connectionRequest
+		var requested bool
+
+		select {
+		case r = <-pending:
+			requested = true
+		case r = <-s.connectionControlChannel:
+			requested = true
+		case generation := <-s.connectionLostChannel:
+			if generation != s.connectionGeneration || s.currentState() != ConnectionStates.Connected {
+				continue
+			}
+
+			if !s.device().Scrcpy.Retry.Reconnect {
+				s.closeSockets()
+				s.setConnected(false, errConnectionLost.Error())
+				s.setState(ConnectionStates.Idle, errConnectionLost)
+				continue
+			}
+
+			lost = errConnectionLost
+			restart = s.device().Scrcpy.Retry.RestartServer
+		case <-retry:
+			retry = nil
+
+			if s.device().Scrcpy.Retry.RestartServer {
+				err = s.restartScrcpyServer(false)
+				if err != nil {
+					s.setState(ConnectionStates.Failed, err)
+					continue
+				}
+			}
+		}
+
+		if requested {
+			retry = nil
+
+			if r.reconnect {
+				if s.currentState() != ConnectionStates.Connected {
+					continue
+				}
+
+				lost = r.reason
+				restart = true
+			} else if !r.connect {
+				s.closeSockets()
+				s.setConnected(false, "disconnect")
+				s.setAttempts(0)
+				s.setState(ConnectionStates.Idle, nil)
+				continue
+			} else {
+				s.applyPendingConfig()
+
+				address = r.address
+				if address == "" {
+					address = s.device().Scrcpy.Address
+				}
+
+				attempts = 0
+				reconnecting = false
+				s.setAttempts(0)
+			}
+		}
+
+		if lost != nil {
+			s.closeSockets()
+			s.setConnected(false, lost.Error())
+
+			attempts = 0
+			reconnecting = true
+			s.setAttempts(0)
+			s.setState(ConnectionStates.Reconnecting, lost)
+
+			if restart {
+				err = s.restartScrcpyServer(true)
+				if err != nil {
+					s.setState(ConnectionStates.Failed, err)
+					continue
+				}
+			}
+		}
+
+		if reconnecting {
+			s.setState(ConnectionStates.Reconnecting, nil)
+		} else {
+			s.setState(ConnectionStates.Connecting, nil)
+		}
+
+		err = s.interruptibleConnect(address, pending)
+		if err == nil {
+			attempts = 0
+			s.setAttempts(0)
+			s.watchdog.reset()
+			s.setState(ConnectionStates.Connected, nil)
+			s.setConnected(true, "")
+			continue
+		}
+
+		s.closeSockets()
+
+		if errors.Is(err, net.ErrClosed) {
+			s.setState(ConnectionStates.Failed, err)
+			return
+		}
+
+		if errors.Is(err, context.Canceled) {
+			continue
+		}
+
+		attempts++
+		s.setAttempts(attempts)
+
+		if s.device().Scrcpy.Retry.MaxAttempts > 0 && attempts >= s.device().Scrcpy.Retry.MaxAttempts {
+			s.setState(ConnectionStates.Failed, err)
+			continue
+		}
+
+		s.setState(s.currentState(), err)
+		retry = time.After(s.device().Scrcpy.Retry.delay(attempts))
+	}
+}
+
+func (s *Session) interruptibleConnect(address string, pending chan<- connectionRequest) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+
+	go func() {
+		defer close(watching)
+
+		for {
+			select {
+			case r := <-s.connectionControlChannel:
+				if r.reconnect {
+					continue
+				}
+
+				pending <- r
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	err := s.connect(ctx, address)
+	if err != nil && ctx.Err() != nil {
+		err = context.Canceled
+	}
+
+	cancel()
+	<-watching
+
+	return err
+}
+
+func (s *Session) connect(ctx context.Context, address string) error {
+	device := s.device()
+
+	var err error
+
+	s.closeSockets()
+	s.connectionGeneration++
+
+	var deadline time.Time
+	if device.Scrcpy.Retry.Timeout > 0 {
+		deadline = time.Now().Add(time.Duration(device.Scrcpy.Retry.Timeout) * time.Millisecond)
+	}
+
+	var openedMutex sync.Mutex
+	var opened []net.Conn
+
+	stop := context.AfterFunc(ctx, func() {
+		if !device.Scrcpy.Forward {
+			s.scrcpyListener.(*net.TCPListener).SetDeadline(time.Now())
+		}
+
+		openedMutex.Lock()
+		defer openedMutex.Unlock()
+
+		for _, c := range opened {
+			c.SetDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	sockets := []*net.Conn{}
+	streams := []string{}
+	if device.Scrcpy.Video {
+		sockets = append(sockets, &s.videoSocket)
+		streams = append(streams, "video")
+	}
+	if device.Scrcpy.Audio {
+		sockets = append(sockets, &s.audioSocket)
+		streams = append(streams, "audio")
+	}
+	if device.Scrcpy.Control {
+		sockets = append(sockets, &s.controlSocket)
+		streams = append(streams, "control")
+	}
+
+	if !device.Scrcpy.Forward {
+		s.scrcpyListener.(*net.TCPListener).SetDeadline(deadline)
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+
+	for i, socket := range sockets {
+		if device.Scrcpy.Forward {
+			*socket, err = dialer.DialContext(ctx, "tcp", address)
+		} else {
+			*socket, err = s.scrcpyListener.Accept()
+		}
+		if err != nil {
+			return err
+		}
+
+		slog.Debug("scrcpy socket opened", "device", s.Name, "stream", streams[i], "remoteAddress", (*socket).RemoteAddr().String())
+
+		(*socket).SetDeadline(deadline)
+
+		openedMutex.Lock()
+		opened = append(opened, *socket)
+		openedMutex.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if device.Scrcpy.Forward && i == 0 && !readDummyByte(*socket) {
+			return errors.New("scrcpy server is not ready")
+		}
+	}
+
+	if !s.readDeviceMeta() {
+		return errors.New("failed to read device metadata")
+	}
+
+	if device.Scrcpy.Video {
+		data := make([]byte, 12)
+		n, err := io.ReadFull(s.videoSocket, data)
+		if err != nil {
+			return err
+		}
+		if n != 12 {
+			return io.ErrUnexpectedEOF
+		}
+
+		s.videoCodec = binary.BigEndian.Uint32(data[:4])
+		s.initialVideoWidth = int(binary.BigEndian.Uint32(data[4:8]))
+		s.initialVideoHeight = int(binary.BigEndian.Uint32(data[8:]))
+	}
+
+	if device.Scrcpy.Audio {
+		data := make([]byte, 4)
+		n, err := io.ReadFull(s.audioSocket, data)
+		if err != nil {
+			return err
+		}
+		if n != 4 {
+			return io.ErrUnexpectedEOF
+		}
+
+		s.audioCodec = binary.BigEndian.Uint32(data)
+	}
+
+	if !stop() {
+		return context.Canceled
+	}
+
+	for _, socket := range sockets {
+		(*socket).SetDeadline(time.Time{})
+	}
+
+	if device.Scrcpy.Control {
+		s.controlSocket = &timedConn{Conn: s.controlSocket, latency: &s.controlWriteLatency}
+	}
+
+	generation := s.connectionGeneration
+
+	if device.Scrcpy.Control {
+		err = s.createUhidDevices()
+		if err != nil {
+			return err
+		}
+
+		go func(controlSocket net.Conn) {
+			s.readControl(controlSocket)
+			slog.Debug("scrcpy socket closed", "device", s.Name, "stream", "control")
+			s.connectionLostChannel <- generation
+		}(s.controlSocket)
+	}
+
+	if device.Scrcpy.Video {
+		go func(videoSocket net.Conn) {
+			readPackets(&s.video, videoSocket)
+			slog.Debug("scrcpy socket closed", "device", s.Name, "stream", "video")
+			s.connectionLostChannel <- generation
+		}(s.videoSocket)
+	}
+
+	if device.Scrcpy.Audio {
+		go func(audioSocket net.Conn) {
+			readPackets(&s.audio, audioSocket)
+			slog.Debug("scrcpy socket closed", "device", s.Name, "stream", "audio")
+			s.connectionLostChannel <- generation
+		}(s.audioSocket)
+	}
+
+	return nil
+}
+
+func (s *Session) readControl(controlSocket net.Conn) {
+	data := make([]byte, 262130)
+
+	for {
+		n, err := io.ReadFull(controlSocket, data[:1])
+		if err != nil {
+			return
+		}
+		if n != 1 {
+			return
+		}
+
+		s.watchdog.touchControl()
+
+		switch data[0] {
+		case ScrcpyDeviceMessageTypes.Clipboard:
+			n, err = io.ReadFull(controlSocket, data[:4])
+			if err != nil {
+				return
+			}
+			if n != 4 {
+				return
+			}
+
+			clipboardLength := int(binary.BigEndian.Uint32(data[:4]))
+
+			n, err = io.ReadFull(controlSocket, data[:clipboardLength])
+			if err != nil {
+				return
+			}
+			if n != clipboardLength {
+				return
+			}
+
+			s.events.publish(Event{Type: "clipboard", Data: string(data[:clipboardLength])})
+		case ScrcpyDeviceMessageTypes.AckClipboard:
+			n, err = io.ReadFull(controlSocket, data[:8])
+			if err != nil {
+				return
+			}
+			if n != 8 {
+				return
+			}
+
+			s.events.publish(Event{Type: "ackclipboard", Data: strconv.FormatUint(binary.BigEndian.Uint64(data[:8]), 10)})
+		case ScrcpyDeviceMessageTypes.UhidOutput:
+			n, err = io.ReadFull(controlSocket, data[:4])
+			if err != nil {
+				return
+			}
+			if n != 4 {
+				return
+			}
+
+			size := int(binary.BigEndian.Uint16(data[:4]))
+
+			n, err = io.ReadFull(controlSocket, data[:size])
+			if err != nil {
+				return
+			}
+			if n != size {
+				return
+			}
+
+			s.events.publish(Event{Type: "uhidoutput", Data: hex.EncodeToString(data[:size])})
+		}
+	}
+}
+
+func (s *Session) scrcpyServerArguments(options []string) ([]string, error) {
+	device := s.device()
+
+	var args []string
+	if device.Adb.Device == "usb" {
+		args = append(device.Adb.Options, "-d")
+	} else if device.Adb.Device == "tcpip" {
+		args = append(device.Adb.Options, "-e")
+	} else if device.Adb.Device != "" {
+		args = append(device.Adb.Options, "-s", device.Adb.Device)
+	} else {
+		args = device.Adb.Options
+	}
+
+	args = append(
+		args,
+		"shell",
+		fmt.Sprintf("CLASSPATH=%s", device.Scrcpy.Server),
+		"app_process",
+		"/",
+		"com.genymobile.scrcpy.Server",
+		device.Scrcpy.ServerVersion,
+	)
+
+	if !device.Scrcpy.Video {
+		args = append(args, "video=false")
+	}
+
+	if !device.Scrcpy.Audio {
+		args = append(args, "audio=false")
+	}
+
+	if device.Scrcpy.Control {
+		if !device.Scrcpy.ClipboardAutosync {
+			args = append(args, "clipboard_autosync=false")
+		}
+	} else {
+		args = append(args, "control=false")
+	}
+
+	if !device.Scrcpy.Cleanup {
+		args = append(args, "cleanup=false")
+	}
+
+	if !device.Scrcpy.PowerOn {
+		args = append(args, "power_on=false")
+	}
+
+	if device.Scrcpy.Forward {
+		args = append(args, "tunnel_forward=true")
+	}
+
+	if len(device.Scrcpy.ServerOptions) > 0 {
+		args = append(args, device.Scrcpy.ServerOptions...)
+	}
+
+	if len(options) == 1 && len(options[0]) > 0 && options[0][0] == '[' {
+		var jsonOptions []string
+		err := json.Unmarshal([]byte(options[0]), &jsonOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, jsonOptions...)
+	} else {
+		args = append(args, options...)
+	}
+
+	return args, nil
+}
+
+func (s *Session) killScrcpyServer() {
+	if s.scrcpyServer == nil {
+		return
+	}
+
+	s.scrcpyServer.Process.Kill()
+	<-s.scrcpyServerDone
+	s.scrcpyServer = nil
+}
+
+func (s *Session) execScrcpyServer() error {
+	device := s.device()
+
+	if s.closed.Load() {
+		return errSessionClosed
+	}
+
+	s.scrcpyServer = s.adbCommand(s.scrcpyServerArgs)
+	logProcessOutput(s.scrcpyServer, "device", s.Name)
+
+	err := s.scrcpyServer.Start()
+	if err != nil {
+		s.scrcpyServer = nil
+		return err
+	}
+
+	done := make(chan struct{})
+	s.scrcpyServerDone = done
+
+	slog.Info("scrcpy server started", "device", s.Name, "pid", s.scrcpyServer.Process.Pid)
+
+	go s.runHook(device.Scrcpy.ServerStartedCommands, map[string]string{
+		"PID": strconv.Itoa(s.scrcpyServer.Process.Pid),
+	})
+
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		close(done)
+
+		slog.Info("scrcpy server exited", "device", s.Name, "pid", cmd.Process.Pid, "exitCode", cmd.ProcessState.ExitCode())
+
+		s.runHook(device.Scrcpy.ServerExitedCommands, map[string]string{
+			"PID":       strconv.Itoa(cmd.Process.Pid),
+			"EXIT_CODE": strconv.Itoa(cmd.ProcessState.ExitCode()),
+			"REASON":    cmd.ProcessState.String(),
+		})
+	}(s.scrcpyServer)
+
+	return nil
+}
+
+func (s *Session) startScrcpyServer(args []string) error {
+	s.scrcpyServerMutex.Lock()
+	running := s.scrcpyServer != nil
+	s.scrcpyServerMutex.Unlock()
+
+	if running {
+		select {
+		case s.connectionControlChannel <- connectionRequest{}:
+			time.Sleep(1 * time.Second)
+		default:
+		}
+	}
+
+	s.scrcpyServerMutex.Lock()
+	defer s.scrcpyServerMutex.Unlock()
+
+	s.killScrcpyServer()
+	s.scrcpyServerArgs = args
+
+	return s.execScrcpyServer()
+}
+
+func (s *Session) stopScrcpyServer() error {
+	s.scrcpyServerMutex.Lock()
+	running := s.scrcpyServer != nil
+	s.scrcpyServerMutex.Unlock()
+
+	if !running {
+		return errors.New("scrcpy server is not running")
+	}
+
+	select {
+	case s.connectionControlChannel <- connectionRequest{}:
+		time.Sleep(1 * time.Second)
+	default:
+	}
+
+	s.scrcpyServerMutex.Lock()
+	defer s.scrcpyServerMutex.Unlock()
+
+	s.killScrcpyServer()
+	s.scrcpyServerArgs = nil
+
+	return nil
+}
+
+func (s *Session) restartScrcpyServer(force bool) error {
+	s.scrcpyServerMutex.Lock()
+	defer s.scrcpyServerMutex.Unlock()
+
+	if s.scrcpyServerArgs == nil {
+		return nil
+	}
+
+	if !force && s.scrcpyServer != nil {
+		select {
+		case <-s.scrcpyServerDone:
+		default:
+			return nil
+		}
+	}
+
+	previous := s.currentState()
+	s.setState(ConnectionStates.StartingServer, nil)
+
+	s.killScrcpyServer()
+
+	err := s.execScrcpyServer()
+	if err != nil {
+		return err
+	}
+
+	s.setState(previous, nil)
+	return nil
+}
+
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, GET")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodGet:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		statusBytes, err := json.Marshal(s.status())
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(statusBytes)
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
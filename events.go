@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventSubscriberBuffer = 256
+const eventStreamKeepAlive = 15 * time.Second
+
+type Event struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+}
+
+type EventBus struct {
+	device      string
+	mutex       sync.Mutex
+	subscribers map[chan Event][]string
+	dropped     uint64
+}
+
+func (b *EventBus) subscribe(size int, types ...string) chan Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = map[chan Event][]string{}
+	}
+
+	c := make(chan Event, size)
+	b.subscribers[c] = types
+	return c
+}
+
+func (b *EventBus) unsubscribe(c chan Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, c)
+}
+
+func (b *EventBus) publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for c, types := range b.subscribers {
+		if len(types) > 0 && !slices.Contains(types, e.Type) {
+			continue
+		}
+
+		select {
+		case c <- e:
+		default:
+			delete(b.subscribers, c)
+			close(c)
+
+			b.dropped++
+			slog.Warn("event subscriber dropped, buffer full", "device", b.device, "event", e.Type)
+		}
+	}
+}
+
+func waitEvent(events chan Event, timeout time.Duration, match func(Event) bool) (Event, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return Event{}, false
+			}
+
+			if match(e) {
+				return e, true
+			}
+		case <-timer.C:
+			return Event{}, false
+		}
+	}
+}
+
+func (s *Session) printEvents() {
+	for {
+		events := s.events.subscribe(eventSubscriberBuffer, "clipboard", "ackclipboard", "uhidoutput")
+
+		for e := range events {
+			var line string
+			var stdout, stderr bool
+
+			switch e.Type {
+			case "clipboard":
+				lineBytes, err := json.Marshal(e.Data)
+				if err != nil {
+					panic(err)
+				}
+
+				line = string(lineBytes)
+				stdout, stderr = s.device().Scrcpy.StdoutClipboard, s.device().Scrcpy.StderrClipboard
+			case "ackclipboard":
+				line = e.Data
+				stdout, stderr = s.device().Scrcpy.StdoutClipboard, s.device().Scrcpy.StderrClipboard
+			case "uhidoutput":
+				line = e.Data
+				stdout, stderr = s.device().Scrcpy.StdoutUhidOutput, s.device().Scrcpy.StderrUhidOutput
+			}
+
+			if stdout {
+				fmt.Println(line)
+			}
+
+			if stderr {
+				fmt.Fprintln(os.Stderr, line)
+			}
+		}
+	}
+}
+
+func eventStreamHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, GET")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodGet:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		var types []string
+		if req.URL.Query().Get("types") != "" {
+			types = strings.Split(req.URL.Query().Get("types"), ",")
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		events := s.events.subscribe(eventSubscriberBuffer, types...)
+		defer s.events.unsubscribe(events)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher.Flush()
+
+		ticker := time.NewTicker(eventStreamKeepAlive)
+		defer ticker.Stop()
+
+		var err error
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+
+				var data []byte
+
+				data, err = json.Marshal(e)
+				if err != nil {
+					panic(err)
+				}
+
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+				if err != nil {
+					return
+				}
+			case <-ticker.C:
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+				if err != nil {
+					return
+				}
+			case <-req.Context().Done():
+				return
+			}
+
+			flusher.Flush()
+		}
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
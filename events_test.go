@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestEventBus(t *testing.T) {
+	var b EventBus
+
+	all := b.subscribe(4)
+	clipboard := b.subscribe(1, "clipboard")
+
+	b.publish(Event{Type: "stall", Data: "video"})
+	b.publish(Event{Type: "clipboard", Data: "x"})
+
+	if e := <-clipboard; e.Type != "clipboard" || e.Data != "x" {
+		t.Fatalf("got %+v, want the clipboard event", e)
+	}
+
+	for _, want := range []string{"stall", "clipboard"} {
+		if e := <-all; e.Type != want {
+			t.Fatalf("got %s event, want %s", e.Type, want)
+		}
+	}
+
+	b.publish(Event{Type: "clipboard", Data: "y"})
+	b.publish(Event{Type: "clipboard", Data: "z"})
+
+	if e := <-clipboard; e.Data != "y" {
+		t.Fatalf("got %+v, want the first buffered event", e)
+	}
+
+	if _, ok := <-clipboard; ok {
+		t.Fatal("expected the full subscriber to be closed")
+	}
+
+	subscribers, dropped := b.metrics()
+	if subscribers != 1 || dropped != 1 {
+		t.Fatalf("got %d subscribers and %d dropped, want 1 and 1", subscribers, dropped)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func (s *Session) runHook(cs CommandSlice, vars map[string]string) {
+	if len(cs) == 0 {
+		return
+	}
+
+	vars["SESSION"] = s.Name
+
+	expanded := make(CommandSlice, len(cs))
+
+	for i, command := range cs {
+		expanded[i] = make([]string, len(command))
+
+		for j, arg := range command {
+			expanded[i][j] = os.Expand(arg, func(k string) string {
+				v, ok := vars[k]
+				if !ok {
+					return "$" + k
+				}
+
+				return v
+			})
+		}
+	}
+
+	s.runCommands(CommandSource{Transport: "hook"}, expanded)
+}
+
+func (s *Session) videoSizeChanged(oldWidth int, oldHeight int, width int, height int) {
+	s.events.publish(Event{Type: "frame-size-change", Data: fmt.Sprintf("%dx%d", width, height)})
+
+	go s.runHook(s.device().Scrcpy.VideoSizeChangedCommands, map[string]string{
+		"OLD_WIDTH":  strconv.Itoa(oldWidth),
+		"OLD_HEIGHT": strconv.Itoa(oldHeight),
+		"WIDTH":      strconv.Itoa(width),
+		"HEIGHT":     strconv.Itoa(height),
+	})
+}
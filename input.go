@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 )
@@ -115,7 +116,7 @@ var keycodeMap = map[string]int{
 	"allapps":        284,
 }
 
-func injectKeycode(up bool, keycode int, repeat int, metaState int) bool {
+func (s *Session) injectKeycode(up bool, keycode int, repeat int, metaState int) error {
 	data := make([]byte, 14)
 	data[0] = ScrcpyControlMessageTypes.InjectKeycode
 	if up {
@@ -125,35 +126,35 @@ func injectKeycode(up bool, keycode int, repeat int, metaState int) bool {
 	binary.BigEndian.PutUint32(data[6:10], uint32(repeat))
 	binary.BigEndian.PutUint32(data[10:], uint32(metaState))
 
-	n, err := controlSocket.Write(data)
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != 14 {
-		return false
+		return io.ErrShortWrite
 	}
 
-	return true
+	return nil
 }
 
-func injectText(text string) bool {
+func (s *Session) injectText(text string) error {
 	data := make([]byte, 5+len(text))
 	data[0] = ScrcpyControlMessageTypes.InjectText
 	binary.BigEndian.PutUint32(data[1:5], uint32(len(text)))
 	copy(data[5:], []byte(text))
 
-	n, err := controlSocket.Write(data)
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != len(data) {
-		return false
+		return io.ErrShortWrite
 	}
 
-	return true
+	return nil
 }
 
-func injectTouchEvent(action int, pointerId int, x int, y int, width int, height int, button int) bool {
+func (s *Session) injectTouchEvent(action int, pointerId int, x int, y int, width int, height int, button int) error {
 	data := make([]byte, 32)
 	data[0] = ScrcpyControlMessageTypes.InjectTouchEvent
 	data[1] = byte(action)
@@ -171,18 +172,18 @@ func injectTouchEvent(action int, pointerId int, x int, y int, width int, height
 		binary.BigEndian.PutUint32(data[28:], uint32(button))
 	}
 
-	n, err := controlSocket.Write(data)
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != 32 {
-		return false
+		return io.ErrShortWrite
 	}
 
-	return true
+	return nil
 }
 
-func injectScrollEvent(x int, y int, width int, height int, direction string) bool {
+func (s *Session) injectScrollEvent(x int, y int, width int, height int, direction string) error {
 	data := make([]byte, 21)
 	data[0] = ScrcpyControlMessageTypes.InjectScrollEvent
 	binary.BigEndian.PutUint32(data[1:], uint32(x))
@@ -202,61 +203,63 @@ func injectScrollEvent(x int, y int, width int, height int, direction string) bo
 		data[15] = 0x80
 	}
 
-	n, err := controlSocket.Write(data)
+	n, err := s.controlSocket.Write(data)
 	if err != nil {
-		return false
+		return err
 	}
 	if n != 21 {
-		return false
+		return io.ErrShortWrite
 	}
 
-	return true
+	return nil
 }
 
-func createUhidDevices() bool {
-	for i := range config.Scrcpy.UhidDevices {
-		reportDesc, err := hex.DecodeString(config.Scrcpy.UhidDevices[i].ReportDesc)
+func (s *Session) createUhidDevices() error {
+	device := s.device()
+
+	for i := range device.Scrcpy.UhidDevices {
+		reportDesc, err := hex.DecodeString(device.Scrcpy.UhidDevices[i].ReportDesc)
 		if err != nil {
-			return false
+			return err
 		}
 
 		var b bytes.Buffer
 
 		b.WriteByte(ScrcpyControlMessageTypes.UhidCreate)
-		binary.Write(&b, binary.BigEndian, uint16(config.Scrcpy.UhidDevices[i].Id))
-		if config.Scrcpy.UhidDevices[i].VendorId == "" || config.Scrcpy.UhidDevices[i].ProductId == "" {
+		binary.Write(&b, binary.BigEndian, uint16(device.Scrcpy.UhidDevices[i].Id))
+		if device.Scrcpy.UhidDevices[i].VendorId == "" || device.Scrcpy.UhidDevices[i].ProductId == "" {
 			binary.Write(&b, binary.BigEndian, uint32(0))
-		} else if len(config.Scrcpy.UhidDevices[i].VendorId) == 4 && len(config.Scrcpy.UhidDevices[i].ProductId) == 4 {
-			vendorId, err := strconv.ParseUint(config.Scrcpy.UhidDevices[i].VendorId, 16, 16)
+		} else if len(device.Scrcpy.UhidDevices[i].VendorId) == 4 && len(device.Scrcpy.UhidDevices[i].ProductId) == 4 {
+			vendorId, err := strconv.ParseUint(device.Scrcpy.UhidDevices[i].VendorId, 16, 16)
 			if err != nil {
-				return false
+				return err
 			}
 
-			productId, err := strconv.ParseUint(config.Scrcpy.UhidDevices[i].ProductId, 16, 16)
+			productId, err := strconv.ParseUint(device.Scrcpy.UhidDevices[i].ProductId, 16, 16)
 			if err != nil {
-				return false
+				return err
 			}
 
 			binary.Write(&b, binary.BigEndian, uint16(vendorId))
 			binary.Write(&b, binary.BigEndian, uint16(productId))
 		}
-		b.WriteByte(byte(len(config.Scrcpy.UhidDevices[i].Name)))
-		if config.Scrcpy.UhidDevices[i].Name != "" {
-			b.WriteString(config.Scrcpy.UhidDevices[i].Name)
+		b.WriteByte(byte(len(device.Scrcpy.UhidDevices[i].Name)))
+		if device.Scrcpy.UhidDevices[i].Name != "" {
+			b.WriteString(device.Scrcpy.UhidDevices[i].Name)
 		}
 		binary.Write(&b, binary.BigEndian, uint16(len(reportDesc)))
 		b.Write(reportDesc)
 
-		_, err = b.WriteTo(controlSocket)
+		_, err = b.WriteTo(s.controlSocket)
 		if err != nil {
-			return false
+			return err
 		}
 	}
 
-	return true
+	return nil
 }
 
-func uhidInput(id int, data []byte) bool {
+func (s *Session) uhidInput(id int, data []byte) error {
 	var b bytes.Buffer
 
 	b.WriteByte(ScrcpyControlMessageTypes.UhidInput)
@@ -264,12 +267,12 @@ func uhidInput(id int, data []byte) bool {
 	binary.Write(&b, binary.BigEndian, uint16(len(data)))
 	b.Write(data)
 
-	_, err := b.WriteTo(controlSocket)
+	_, err := b.WriteTo(s.controlSocket)
 	if err != nil {
-		return false
+		return err
 	}
 
-	return true
+	return nil
 }
 
 func getMouseButton(buttonString string) int {
@@ -286,9 +289,10 @@ func getMouseButton(buttonString string) int {
 }
 
 func keyHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -334,27 +338,26 @@ func keyHandler(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		switch req.URL.Path {
-		case "/key":
-			if !injectKeycode(false, keycode, 0, 0) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		err := s.runAction(httpCommandSource("http", req), []string{req.URL.Path[1:], strconv.Itoa(keycode)}, func() error {
+			switch req.URL.Path {
+			case "/key":
+				err := s.injectKeycode(false, keycode, 0, 0)
+				if err != nil {
+					return err
+				}
 
-			if !injectKeycode(true, keycode, 0, 0) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/keydown":
-			if !injectKeycode(false, keycode, 0, 0) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/keyup":
-			if !injectKeycode(true, keycode, 0, 0) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				return s.injectKeycode(true, keycode, 0, 0)
+			case "/keydown":
+				return s.injectKeycode(false, keycode, 0, 0)
+			case "/keyup":
+				return s.injectKeycode(true, keycode, 0, 0)
 			}
+
+			return nil
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
 		w.WriteHeader(http.StatusNoContent)
@@ -370,9 +373,10 @@ func keyHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func typeHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -406,7 +410,10 @@ func typeHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if !injectText(text) {
+		err := s.runAction(httpCommandSource("http", req), []string{"type", text}, func() error {
+			return s.injectText(text)
+		})
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -424,9 +431,10 @@ func typeHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func touchHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -480,32 +488,30 @@ func touchHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		switch req.URL.Path {
-		case "/touch":
-			if !injectTouchEvent(0, -2, x, y, width, height, 1) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		command := []string{req.URL.Path[1:], query.Get("x"), query.Get("y"), query.Get("w"), query.Get("h")}
 
-			if !injectTouchEvent(1, -2, x, y, width, height, 1) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/touchdown":
-			if !injectTouchEvent(0, -2, x, y, width, height, 1) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/touchup":
-			if !injectTouchEvent(1, -2, x, y, width, height, 1) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/touchmove":
-			if !injectTouchEvent(2, -2, x, y, width, height, 1) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		err = s.runAction(httpCommandSource("http", req), command, func() error {
+			switch req.URL.Path {
+			case "/touch":
+				err := s.injectTouchEvent(0, -2, x, y, width, height, 1)
+				if err != nil {
+					return err
+				}
+
+				return s.injectTouchEvent(1, -2, x, y, width, height, 1)
+			case "/touchdown":
+				return s.injectTouchEvent(0, -2, x, y, width, height, 1)
+			case "/touchup":
+				return s.injectTouchEvent(1, -2, x, y, width, height, 1)
+			case "/touchmove":
+				return s.injectTouchEvent(2, -2, x, y, width, height, 1)
 			}
+
+			return nil
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
 		w.WriteHeader(http.StatusNoContent)
@@ -521,9 +527,10 @@ func touchHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func mouseHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -583,32 +590,30 @@ func mouseHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		switch req.URL.Path {
-		case "/mouseclick":
-			if !injectTouchEvent(0, -1, x, y, width, height, button) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		command := []string{req.URL.Path[1:], query.Get("button"), query.Get("x"), query.Get("y"), query.Get("w"), query.Get("h")}
 
-			if !injectTouchEvent(1, -1, x, y, width, height, button) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/mousedown":
-			if !injectTouchEvent(0, -1, x, y, width, height, button) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/mouseup":
-			if !injectTouchEvent(1, -1, x, y, width, height, button) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		case "/mousemove":
-			if !injectTouchEvent(2, -1, x, y, width, height, button) {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		err = s.runAction(httpCommandSource("http", req), command, func() error {
+			switch req.URL.Path {
+			case "/mouseclick":
+				err := s.injectTouchEvent(0, -1, x, y, width, height, button)
+				if err != nil {
+					return err
+				}
+
+				return s.injectTouchEvent(1, -1, x, y, width, height, button)
+			case "/mousedown":
+				return s.injectTouchEvent(0, -1, x, y, width, height, button)
+			case "/mouseup":
+				return s.injectTouchEvent(1, -1, x, y, width, height, button)
+			case "/mousemove":
+				return s.injectTouchEvent(2, -1, x, y, width, height, button)
 			}
+
+			return nil
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 
 		w.WriteHeader(http.StatusNoContent)
@@ -624,9 +629,10 @@ func mouseHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func scrollHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -680,7 +686,12 @@ func scrollHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if !injectScrollEvent(x, y, width, height, req.URL.Path[7:]) {
+		command := []string{req.URL.Path[1:], query.Get("x"), query.Get("y"), query.Get("w"), query.Get("h")}
+
+		err = s.runAction(httpCommandSource("http", req), command, func() error {
+			return s.injectScrollEvent(x, y, width, height, req.URL.Path[7:])
+		})
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -698,9 +709,10 @@ func scrollHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func uhidInputHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -746,7 +758,10 @@ func uhidInputHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if !uhidInput(id, data) {
+		err = s.runAction(httpCommandSource("http", req), []string{"uhidinput", query.Get("id"), query.Get("data")}, func() error {
+			return s.uhidInput(id, data)
+		})
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -764,9 +779,10 @@ func uhidInputHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func uhidOutputStreamHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -794,12 +810,19 @@ func uhidOutputStreamHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
+		events := s.events.subscribe(eventSubscriberBuffer, "uhidoutput")
+		defer s.events.unsubscribe(events)
+
 		var err error
 
 		for {
 			select {
-			case line := <-uhidOutputChannel:
-				_, err = fmt.Fprintln(w, line)
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+
+				_, err = fmt.Fprintln(w, e.Data)
 				if err != nil {
 					return
 				}
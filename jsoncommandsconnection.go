@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+)
+
+const defaultMaxMessageSize = 1 << 20
+
+var errMessageTooLarge = errors.New("message too large")
+
+type messageLimitReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *messageLimitReader) Read(p []byte) (int, error) {
+	if l.read >= l.limit {
+		return 0, errMessageTooLarge
+	}
+
+	if int64(len(p)) > l.limit-l.read {
+		p = p[:l.limit-l.read]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+func serveJsonCommands(c net.Conn, server string, framing string, maxMessageSize int, handlerTemplate string, tlsClient string) {
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+
+	reply := func(response CommandResponse) bool {
+		responseBytes, err := json.Marshal(response)
+		if err != nil {
+			panic(err)
+		}
+
+		if framing == "length" {
+			data := make([]byte, 4+len(responseBytes))
+			binary.BigEndian.PutUint32(data, uint32(len(responseBytes)))
+			copy(data[4:], responseBytes)
+			_, err = c.Write(data)
+		} else {
+			_, err = c.Write(append(responseBytes, '\n'))
+		}
+
+		return err == nil
+	}
+
+	handle := func(r CommandRequest) bool {
+		if len(r.Commands) == 0 {
+			return reply(CommandResponse{Id: r.Id, Error: "empty command list"})
+		}
+
+		if handlerTemplate != "" {
+			data := &JsonCommandHandlerData{
+				Server:    server,
+				Address:   c.RemoteAddr().String(),
+				TlsClient: tlsClient,
+				Id:        r.Id,
+				Commands:  r.Commands,
+			}
+			data.expectReply()
+
+			if !sendJsonCommandHandler(handlerTemplate, data) {
+				return reply(CommandResponse{Id: r.Id, Error: "unknown handler template"})
+			}
+
+			return reply(data.waitReply())
+		}
+
+		return reply(CommandResponse{Id: r.Id, CommandResults: defaultSession.runCommands(CommandSource{Transport: server, RemoteAddress: c.RemoteAddr().String(), TlsClient: tlsClient}, r.Commands)})
+	}
+
+	switch framing {
+	case "newline":
+		scanner := bufio.NewScanner(c)
+		scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			var r CommandRequest
+
+			err := json.Unmarshal(line, &r)
+			if err != nil {
+				if !reply(CommandResponse{Error: err.Error()}) {
+					return
+				}
+
+				continue
+			}
+
+			if !handle(r) {
+				return
+			}
+		}
+
+		if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+			reply(CommandResponse{Error: errMessageTooLarge.Error()})
+		}
+	case "length":
+		header := make([]byte, 4)
+
+		for {
+			_, err := io.ReadFull(c, header)
+			if err != nil {
+				return
+			}
+
+			size := int(binary.BigEndian.Uint32(header))
+			if size > maxMessageSize {
+				reply(CommandResponse{Error: errMessageTooLarge.Error()})
+				return
+			}
+
+			data := make([]byte, size)
+
+			_, err = io.ReadFull(c, data)
+			if err != nil {
+				return
+			}
+
+			var r CommandRequest
+
+			err = json.Unmarshal(data, &r)
+			if err != nil {
+				if !reply(CommandResponse{Error: err.Error()}) {
+					return
+				}
+
+				continue
+			}
+
+			if !handle(r) {
+				return
+			}
+		}
+	default:
+		limitReader := &messageLimitReader{r: c}
+		decoder := json.NewDecoder(limitReader)
+
+		for {
+			start := decoder.InputOffset()
+			limitReader.limit = start + int64(maxMessageSize)
+
+			var r CommandRequest
+
+			err := decoder.Decode(&r)
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					reply(CommandResponse{Error: err.Error()})
+				}
+
+				return
+			}
+
+			if decoder.InputOffset()-start > int64(maxMessageSize) {
+				reply(CommandResponse{Id: r.Id, Error: errMessageTooLarge.Error()})
+				return
+			}
+
+			if !handle(r) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxProcessOutputLine = 64 << 10
+
+var logLevel slog.LevelVar
+
+type logLineWriter struct {
+	mutex  sync.Mutex
+	buffer []byte
+	attrs  []any
+}
+
+func (w *logLineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer = append(w.buffer, p...)
+
+	for {
+		i := bytes.IndexAny(w.buffer, "\r\n")
+		if i < 0 {
+			break
+		}
+
+		if i > 0 {
+			slog.Info("process output", append([]any{"line", string(w.buffer[:i])}, w.attrs...)...)
+		}
+
+		w.buffer = w.buffer[i+1:]
+	}
+
+	if len(w.buffer) > maxProcessOutputLine {
+		slog.Info("process output", append([]any{"line", string(w.buffer)}, w.attrs...)...)
+		w.buffer = nil
+	}
+
+	return len(p), nil
+}
+
+func setupLogging(c LogConfig, stderrReserved bool) error {
+	var w io.Writer = os.Stderr
+
+	if c.File != "" {
+		logFile, err := os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+
+		w = logFile
+	} else if stderrReserved {
+		w = io.Discard
+	}
+
+	logLevel.Set(c.level())
+
+	options := &slog.HandlerOptions{Level: &logLevel}
+
+	if c.Format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, options)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, options)))
+	}
+
+	return nil
+}
+
+func logProcessOutput(cmd *exec.Cmd, attrs ...any) {
+	w := &logLineWriter{attrs: append([]any{"process", filepath.Base(cmd.Path)}, attrs...)}
+
+	if cmd.Stdout == nil {
+		cmd.Stdout = w
+	}
+
+	cmd.Stderr = w
+	cmd.WaitDelay = time.Second
+}
+
+func (s *Session) adbCommand(args []string) *exec.Cmd {
+	slog.Info("running adb", "device", s.Name, "args", args)
+
+	return exec.Command(s.device().Adb.Executable, args...)
+}
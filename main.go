@@ -1,27 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
-	"time"
+	"syscall"
 )
 
 type CommandSlice [][]string
@@ -74,6 +75,33 @@ func (cs *CommandSlice) UnmarshalJSON(data []byte) error {
 	return err
 }
 
+type CommandRequest struct {
+	Id       string
+	Commands CommandSlice
+}
+
+func (r *CommandRequest) UnmarshalJSON(data []byte) error {
+	if len(data) > 2 && data[0] == '{' && data[len(data)-1] == '}' {
+		var envelope struct {
+			Id       string          `json:"id"`
+			Commands json.RawMessage `json:"commands"`
+		}
+
+		if json.Unmarshal(data, &envelope) == nil && len(envelope.Commands) > 0 && envelope.Commands[0] == '[' {
+			r.Id = envelope.Id
+			return r.Commands.UnmarshalJSON(envelope.Commands)
+		}
+	}
+
+	return r.Commands.UnmarshalJSON(data)
+}
+
+type CommandResponse struct {
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	CommandResults
+}
+
 type JsonCommandHandlerTemplate string
 
 func (t *JsonCommandHandlerTemplate) UnmarshalJSON(data []byte) error {
@@ -84,7 +112,9 @@ func (t *JsonCommandHandlerTemplate) UnmarshalJSON(data []byte) error {
 			return err
 		}
 
-		if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		if strings.Contains(s, "\n") {
+			*t = JsonCommandHandlerTemplate(s)
+		} else if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
 			resp, err := http.Get(s)
 			if err != nil {
 				return err
@@ -133,6 +163,7 @@ type HttpServerConfig struct {
 	ClientCa          string              `json:"clientCa"`
 	RequireClientCert bool                `json:"requireClientCert"`
 	Endpoints         map[string][]string `json:"endpoints"`
+	ShutdownTimeout   int                 `json:"shutdownTimeout"`
 }
 
 func (c *HttpServerConfig) UnmarshalJSON(data []byte) error {
@@ -141,6 +172,7 @@ func (c *HttpServerConfig) UnmarshalJSON(data []byte) error {
 		if json.Unmarshal(data, &wdStatic) == nil {
 			c.Enabled = true
 			c.Address = "127.0.0.1:27199"
+			c.ShutdownTimeout = 5000
 
 			if wdStatic {
 				wd, err := os.Getwd()
@@ -158,8 +190,9 @@ func (c *HttpServerConfig) UnmarshalJSON(data []byte) error {
 	type HttpServerC HttpServerConfig
 
 	httpServerC := HttpServerC{
-		Enabled: true,
-		Address: "127.0.0.1:27199",
+		Enabled:         true,
+		Address:         "127.0.0.1:27199",
+		ShutdownTimeout: 5000,
 	}
 
 	err := json.Unmarshal(data, &httpServerC)
@@ -174,6 +207,8 @@ type TcpJsonCommandsConfig struct {
 	Enabled         bool   `json:"enabled"`
 	Address         string `json:"address"`
 	HandlerTemplate string `json:"handlerTemplate"`
+	Framing         string `json:"framing"`
+	MaxMessageSize  int    `json:"maxMessageSize"`
 }
 
 func (c *TcpJsonCommandsConfig) UnmarshalJSON(data []byte) error {
@@ -225,6 +260,8 @@ type TlsJsonCommandsConfig struct {
 	RequireClientCert bool     `json:"requireClientCert"`
 	Clients           []string `json:"clients"`
 	HandlerTemplate   string   `json:"handlerTemplate"`
+	Framing           string   `json:"framing"`
+	MaxMessageSize    int      `json:"maxMessageSize"`
 }
 
 type StdinJsonCommandsConfig struct {
@@ -295,28 +332,58 @@ func (c *AdbConfig) UnmarshalJSON(data []byte) error {
 }
 
 type ScrcpyConfig struct {
-	Enabled              bool         `json:"enabled"`
-	Address              string       `json:"address"`
-	Video                bool         `json:"video"`
-	Audio                bool         `json:"audio"`
-	Control              bool         `json:"control"`
-	Forward              bool         `json:"forward"`
-	UhidDevices          []UhidDevice `json:"uhidDevices"`
-	StdoutClipboard      bool         `json:"stdoutClipboard"`
-	StdoutUhidOutput     bool         `json:"stdoutUhidOutput"`
-	StderrClipboard      bool         `json:"stderrClipboard"`
-	StderrUhidOutput     bool         `json:"stderrUhidOutput"`
-	StdoutVideoStream    bool         `json:"stdoutVideoStream"`
-	StdoutVideoStreamRaw bool         `json:"stdoutVideoStreamRaw"`
-	StdoutAudioStream    bool         `json:"stdoutAudioStream"`
-	StdoutAudioStreamRaw bool         `json:"stdoutAudioStreamRaw"`
-	ConnectedCommands    CommandSlice `json:"connectedCommands"`
-	Server               string       `json:"server"`
-	ServerVersion        string       `json:"serverVersion"`
-	ServerOptions        []string     `json:"serverOptions"`
-	ClipboardAutosync    bool         `json:"clipboardAutosync"`
-	Cleanup              bool         `json:"cleanup"`
-	PowerOn              bool         `json:"powerOn"`
+	Enabled                  bool           `json:"enabled"`
+	Address                  string         `json:"address"`
+	Video                    bool           `json:"video"`
+	Audio                    bool           `json:"audio"`
+	Control                  bool           `json:"control"`
+	Forward                  bool           `json:"forward"`
+	UhidDevices              []UhidDevice   `json:"uhidDevices"`
+	StdoutClipboard          bool           `json:"stdoutClipboard"`
+	StdoutUhidOutput         bool           `json:"stdoutUhidOutput"`
+	StderrClipboard          bool           `json:"stderrClipboard"`
+	StderrUhidOutput         bool           `json:"stderrUhidOutput"`
+	StdoutVideoStream        bool           `json:"stdoutVideoStream"`
+	StdoutVideoStreamRaw     bool           `json:"stdoutVideoStreamRaw"`
+	StdoutAudioStream        bool           `json:"stdoutAudioStream"`
+	StdoutAudioStreamRaw     bool           `json:"stdoutAudioStreamRaw"`
+	ConnectedCommands        CommandSlice   `json:"connectedCommands"`
+	DisconnectedCommands     CommandSlice   `json:"disconnectedCommands"`
+	ServerStartedCommands    CommandSlice   `json:"serverStartedCommands"`
+	ServerExitedCommands     CommandSlice   `json:"serverExitedCommands"`
+	VideoSizeChangedCommands CommandSlice   `json:"videoSizeChangedCommands"`
+	ShutdownCommands         CommandSlice   `json:"shutdownCommands"`
+	Server                   string         `json:"server"`
+	ServerVersion            string         `json:"serverVersion"`
+	ServerOptions            []string       `json:"serverOptions"`
+	ClipboardAutosync        bool           `json:"clipboardAutosync"`
+	Cleanup                  bool           `json:"cleanup"`
+	PowerOn                  bool           `json:"powerOn"`
+	RecordingDirectory       string         `json:"recordingDirectory"`
+	ReplayDuration           int            `json:"replayDuration"`
+	ReplayMaxSize            int            `json:"replayMaxSize"`
+	Retry                    RetryConfig    `json:"retry"`
+	Watchdog                 WatchdogConfig `json:"watchdog"`
+}
+
+type RetryConfig struct {
+	Reconnect     bool    `json:"reconnect"`
+	RestartServer bool    `json:"restartServer"`
+	MaxAttempts   int     `json:"maxAttempts"`
+	InitialDelay  int     `json:"initialDelay"`
+	MaxDelay      int     `json:"maxDelay"`
+	Multiplier    float64 `json:"multiplier"`
+	Timeout       int     `json:"timeout"`
+}
+
+type WatchdogConfig struct {
+	Enabled          bool         `json:"enabled"`
+	VideoTimeout     int          `json:"videoTimeout"`
+	AudioTimeout     int          `json:"audioTimeout"`
+	ControlTimeout   int          `json:"controlTimeout"`
+	EscalateTimeout  int          `json:"escalateTimeout"`
+	StallCommands    CommandSlice `json:"stallCommands"`
+	RecoveryCommands CommandSlice `json:"recoveryCommands"`
 }
 
 func (c *ScrcpyConfig) UnmarshalJSON(data []byte) error {
@@ -327,6 +394,18 @@ func (c *ScrcpyConfig) UnmarshalJSON(data []byte) error {
 		Address:       "127.0.0.1:27183",
 		Server:        "/data/local/tmp/scrcpy-server.jar",
 		ServerVersion: "3.3.4",
+		ReplayMaxSize: 256 << 20,
+		Retry: RetryConfig{
+			MaxAttempts:  100,
+			InitialDelay: 100,
+			MaxDelay:     5000,
+			Multiplier:   1,
+			Timeout:      10000,
+		},
+		Watchdog: WatchdogConfig{
+			VideoTimeout:    5000,
+			EscalateTimeout: 10000,
+		},
 	}
 
 	err := json.Unmarshal(data, &scrcpyC)
@@ -338,9 +417,13 @@ func (c *ScrcpyConfig) UnmarshalJSON(data []byte) error {
 }
 
 type VideoDecoderConfig struct {
-	Enabled    bool   `json:"enabled"`
-	Executable string `json:"executable"`
-	Alpha      bool   `json:"alpha"`
+	Enabled        bool   `json:"enabled"`
+	Executable     string `json:"executable"`
+	Alpha          bool   `json:"alpha"`
+	MjpegMaxFps    int    `json:"mjpegMaxFps"`
+	MjpegMaxWidth  int    `json:"mjpegMaxWidth"`
+	MjpegMaxHeight int    `json:"mjpegMaxHeight"`
+	MjpegQuality   int    `json:"mjpegQuality"`
 }
 
 func (c *VideoDecoderConfig) UnmarshalJSON(data []byte) error {
@@ -367,6 +450,14 @@ func (c *VideoDecoderConfig) UnmarshalJSON(data []byte) error {
 		*c = VideoDecoderConfig(videoDecoderC)
 	}
 
+	if c.MjpegMaxFps == 0 {
+		c.MjpegMaxFps = 10
+	}
+
+	if c.MjpegQuality == 0 {
+		c.MjpegQuality = 75
+	}
+
 	if c.Enabled && c.Executable == "" {
 		var err error
 		c.Executable, err = exec.LookPath("ffmpeg")
@@ -376,6 +467,46 @@ func (c *VideoDecoderConfig) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	File   string `json:"file"`
+}
+
+type AuditLogConfig struct {
+	Enabled  bool     `json:"enabled"`
+	File     string   `json:"file"`
+	MaxSize  int64    `json:"maxSize"`
+	MaxFiles int      `json:"maxFiles"`
+	Redact   []string `json:"redact"`
+}
+
+func (c *AuditLogConfig) UnmarshalJSON(data []byte) error {
+	type AuditLogC AuditLogConfig
+	auditLogC := AuditLogC{
+		Enabled:  true,
+		MaxSize:  10 << 20,
+		MaxFiles: 5,
+		Redact:   []string{"type", "setclipboard", "setclipboardpaste"},
+	}
+
+	if len(data) > 1 && data[0] == '"' && data[len(data)-1] == '"' {
+		err := json.Unmarshal(data, &auditLogC.File)
+		if err == nil {
+			*c = AuditLogConfig(auditLogC)
+		}
+
+		return err
+	}
+
+	err := json.Unmarshal(data, &auditLogC)
+	if err == nil {
+		*c = AuditLogConfig(auditLogC)
+	}
+
+	return err
+}
+
 type UhidDevice struct {
 	Id         int    `json:"id"`
 	ReportDesc string `json:"reportDesc"`
@@ -395,6 +526,12 @@ type Config struct {
 	Adb                         AdbConfig                             `json:"adb"`
 	Scrcpy                      ScrcpyConfig                          `json:"scrcpy"`
 	VideoDecoder                VideoDecoderConfig                    `json:"videoDecoder"`
+	Devices                     map[string]DeviceConfig               `json:"devices"`
+	Log                         LogConfig                             `json:"log"`
+	AuditLog                    AuditLogConfig                        `json:"auditLog"`
+	Include                     json.RawMessage                       `json:"include"`
+	Profiles                    map[string]json.RawMessage            `json:"profiles"`
+	Profile                     string                                `json:"profile"`
 }
 
 type JsonCommandHandlerData struct {
@@ -404,32 +541,16 @@ type JsonCommandHandlerData struct {
 	HttpQuery    map[string][]string
 	HttpHeaders  map[string][]string
 	TlsClient    string
+	Device       string
+	Id           string
 	Commands     CommandSlice
+	replies      chan CommandResponse
+	started      chan struct{}
+	startOnce    sync.Once
 }
 
-var stdinDecoder *json.Decoder
+var stdinReader = bufio.NewReader(os.Stdin)
 var config Config
-var scrcpyListener net.Listener
-var videoSocket net.Conn
-var audioSocket net.Conn
-var controlSocket net.Conn
-var connectionControlChannel chan string = make(chan string)
-var videoConnectedChannel chan struct{} = make(chan struct{})
-var audioConnectedChannel chan struct{} = make(chan struct{})
-var clipboardChannel chan string = make(chan string)
-var uhidOutputChannel chan string = make(chan string)
-var deviceName string
-var videoCodec uint32
-var audioCodec uint32
-var initialVideoWidth int
-var initialVideoHeight int
-var scrcpyServer *exec.Cmd
-var scrcpyConnectedCommands CommandSlice
-var videoFrame []byte
-var videoFrameWidth int
-var videoFrameHeight int
-var videoFrameMutex sync.RWMutex
-var jsonCommandHandlerChannels map[string]chan *JsonCommandHandlerData = map[string]chan *JsonCommandHandlerData{}
 
 func readDummyByte(c net.Conn) bool {
 	data := make([]byte, 1)
@@ -445,17 +566,17 @@ func readDummyByte(c net.Conn) bool {
 	return true
 }
 
-func readDeviceMeta() bool {
+func (s *Session) readDeviceMeta() bool {
 	data := make([]byte, 64)
 	var n int
 	var err error
 
-	if config.Scrcpy.Video {
-		n, err = io.ReadFull(videoSocket, data)
-	} else if config.Scrcpy.Audio {
-		n, err = io.ReadFull(audioSocket, data)
+	if s.device().Scrcpy.Video {
+		n, err = io.ReadFull(s.videoSocket, data)
+	} else if s.device().Scrcpy.Audio {
+		n, err = io.ReadFull(s.audioSocket, data)
 	} else {
-		n, err = io.ReadFull(controlSocket, data)
+		n, err = io.ReadFull(s.controlSocket, data)
 	}
 
 	if err != nil {
@@ -466,7 +587,7 @@ func readDeviceMeta() bool {
 		return false
 	}
 
-	deviceName = string(data[:bytes.IndexByte(data, 0)])
+	s.deviceName = string(data[:bytes.IndexByte(data, 0)])
 	return true
 }
 
@@ -511,44 +632,48 @@ func tlsClientAuth(clients []string, tlsState *tls.ConnectionState) string {
 	return " "
 }
 
-func list(serverArgs []string) string {
+func httpCommandSource(transport string, req *http.Request) CommandSource {
+	client := tlsClientAuth(endpointClients(req.URL.Path), req.TLS)
+	if client == " " {
+		client = ""
+	}
+
+	return CommandSource{Transport: transport, RemoteAddress: req.RemoteAddr, TlsClient: client, HttpEndpoint: req.URL.Path}
+}
+
+func (s *Session) list(serverArgs []string) string {
+	device := s.device()
+
 	var args []string
-	if config.Adb.Device == "usb" {
-		args = append(config.Adb.Options, "-d")
-	} else if config.Adb.Device == "tcpip" {
-		args = append(config.Adb.Options, "-e")
-	} else if config.Adb.Device != "" {
-		args = append(config.Adb.Options, "-s", config.Adb.Device)
+	if device.Adb.Device == "usb" {
+		args = append(device.Adb.Options, "-d")
+	} else if device.Adb.Device == "tcpip" {
+		args = append(device.Adb.Options, "-e")
+	} else if device.Adb.Device != "" {
+		args = append(device.Adb.Options, "-s", device.Adb.Device)
 	} else {
-		args = config.Adb.Options
+		args = device.Adb.Options
 	}
 
 	args = append(
 		args,
 		"shell",
-		fmt.Sprintf("CLASSPATH=%s", config.Scrcpy.Server),
+		fmt.Sprintf("CLASSPATH=%s", device.Scrcpy.Server),
 		"app_process",
 		"/",
 		"com.genymobile.scrcpy.Server",
-		config.Scrcpy.ServerVersion,
+		device.Scrcpy.ServerVersion,
 	)
 
 	args = append(args, serverArgs...)
 
-	if !config.Scrcpy.Cleanup {
+	if !device.Scrcpy.Cleanup {
 		args = append(args, "cleanup=false")
 	}
 
-	output, err := exec.Command(config.Adb.Executable, args...).CombinedOutput()
+	output, err := s.adbCommand(args).CombinedOutput()
 	if err != nil {
-		if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrClipboard {
-			fmt.Fprintln(os.Stderr, err)
-
-			if len(output) > 0 {
-				fmt.Fprintln(os.Stderr, string(output))
-			}
-		}
-
+		slog.Error("list failed", "device", s.Name, "error", err, "output", string(output))
 		return ""
 	}
 
@@ -556,9 +681,10 @@ func list(serverArgs []string) string {
 }
 
 func commandHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -586,8 +712,20 @@ func commandHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		go runCommands([][]string{{req.URL.Path[1:]}})
-		w.WriteHeader(http.StatusNoContent)
+		results := s.runCommands(httpCommandSource("http", req), [][]string{{req.URL.Path[1:]}})
+
+		resultsBytes, err := json.Marshal(results)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !results.Ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		w.Write(resultsBytes)
 	default:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
@@ -600,9 +738,10 @@ func commandHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func infoHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -632,40 +771,40 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 
 		switch req.URL.Path {
 		case "/devicename":
-			if deviceName == "" {
+			if s.deviceName == "" {
 				http.NotFound(w, req)
 				return
 			}
 
-			w.Write([]byte(deviceName))
+			w.Write([]byte(s.deviceName))
 		case "/videocodec":
-			if videoCodec == 0 {
+			if s.videoCodec == 0 {
 				http.NotFound(w, req)
 				return
 			}
 
-			w.Write([]byte(strconv.FormatUint(uint64(videoCodec), 10)))
+			w.Write([]byte(strconv.FormatUint(uint64(s.videoCodec), 10)))
 		case "/audiocodec":
-			if audioCodec == 0 {
+			if s.audioCodec == 0 {
 				http.NotFound(w, req)
 				return
 			}
 
-			w.Write([]byte(strconv.FormatUint(uint64(audioCodec), 10)))
+			w.Write([]byte(strconv.FormatUint(uint64(s.audioCodec), 10)))
 		case "/initialvideowidth":
-			if initialVideoWidth == 0 {
+			if s.initialVideoWidth == 0 {
 				http.NotFound(w, req)
 				return
 			}
 
-			w.Write([]byte(strconv.Itoa(initialVideoWidth)))
+			w.Write([]byte(strconv.Itoa(s.initialVideoWidth)))
 		case "/initialvideoheight":
-			if initialVideoHeight == 0 {
+			if s.initialVideoHeight == 0 {
 				http.NotFound(w, req)
 				return
 			}
 
-			w.Write([]byte(strconv.Itoa(initialVideoHeight)))
+			w.Write([]byte(strconv.Itoa(s.initialVideoHeight)))
 		}
 	default:
 		if origin != "" {
@@ -679,9 +818,10 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func listHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -716,7 +856,7 @@ func listHandler(w http.ResponseWriter, req *http.Request) {
 			serverArg = fmt.Sprintf("list_%s=true", req.URL.Path[1:])
 		}
 
-		output := list([]string{serverArg})
+		output := s.list([]string{serverArg})
 
 		if output == "" {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -736,11 +876,12 @@ func listHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func jsonCommandsHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
 	var tlsClient string
 	if config.HttpServer.ClientCa != "" {
-		tlsClient = tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS)
+		tlsClient = tlsClientAuth(endpointClients(req.URL.Path), req.TLS)
 		if tlsClient == " " {
 			w.WriteHeader(http.StatusForbidden)
 			return
@@ -771,28 +912,76 @@ func jsonCommandsHandler(w http.ResponseWriter, req *http.Request) {
 		}
 
 		decoder := json.NewDecoder(req.Body)
-		var err error
+		var responses []CommandResponse
 
 		for {
-			var cs CommandSlice
+			var r CommandRequest
 
-			err = decoder.Decode(&cs)
-			if err != nil {
+			err := decoder.Decode(&r)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				responses = append(responses, CommandResponse{Error: err.Error()})
 				break
 			}
 
-			if len(cs) > 0 {
-				jsonCommandHandlerChannels[req.URL.Path[1:]] <- &JsonCommandHandlerData{
-					Server:       "http",
-					Address:      req.RemoteAddr,
-					HttpEndpoint: req.URL.Path,
-					HttpQuery:    req.URL.Query(),
-					HttpHeaders:  req.Header,
-					TlsClient:    tlsClient,
-					Commands:     cs,
-				}
+			if len(r.Commands) == 0 {
+				responses = append(responses, CommandResponse{Id: r.Id, Error: "empty command list"})
+				continue
+			}
+
+			cs := r.Commands
+			if s.Name != "" {
+				cs = append(CommandSlice{{"@" + s.Name}}, cs...)
+			}
+
+			data := &JsonCommandHandlerData{
+				Server:       "http",
+				Address:      req.RemoteAddr,
+				HttpEndpoint: req.URL.Path,
+				HttpQuery:    req.URL.Query(),
+				HttpHeaders:  req.Header,
+				TlsClient:    tlsClient,
+				Device:       s.Name,
+				Id:           r.Id,
+				Commands:     cs,
+			}
+			data.expectReply()
+
+			if !sendJsonCommandHandler(req.URL.Path[1:], data) {
+				responses = append(responses, CommandResponse{Id: r.Id, Error: "unknown handler template"})
+				continue
+			}
+
+			responses = append(responses, data.waitReply())
+		}
+
+		if len(responses) == 0 {
+			responses = append(responses, CommandResponse{Error: "empty command list"})
+		}
+
+		var responseBytes []byte
+		var err error
+
+		if len(responses) == 1 {
+			responseBytes, err = json.Marshal(responses[0])
+		} else {
+			responseBytes, err = json.Marshal(responses)
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		for _, response := range responses {
+			if !response.Ok {
+				w.WriteHeader(http.StatusInternalServerError)
+				break
 			}
 		}
+
+		w.Write(responseBytes)
 	default:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
@@ -805,542 +994,193 @@ func jsonCommandsHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func main() {
-	if len(os.Args) != 1 && len(os.Args) != 2 {
-		os.Exit(1)
+	var configFlag, profileFlag, deviceFlag, httpAddressFlag, serverVersionFlag, logLevelFlag string
+	var checkConfig, printVersion bool
+
+	flag.StringVar(&configFlag, "config", "", "config file path or URL, - for stdin")
+	flag.StringVar(&profileFlag, "profile", "", "config profile to apply")
+	flag.StringVar(&deviceFlag, "device", "", "adb device of the default session (serial, usb or tcpip)")
+	flag.StringVar(&httpAddressFlag, "http-address", "", "enable the HTTP server on this address")
+	flag.StringVar(&serverVersionFlag, "server-version", "", "scrcpy server version")
+	flag.StringVar(&logLevelFlag, "log-level", "", "log level (debug, info, warn or error)")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the configuration and exit")
+	flag.BoolVar(&printVersion, "version", false, "print the version and exit")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [config]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
 	}
 
-	var err error
+	flag.Parse()
 
-	if len(os.Args) == 1 || os.Args[1] == "-" {
-		stdinDecoder = json.NewDecoder(os.Stdin)
-		err = stdinDecoder.Decode(&config)
-	} else if strings.HasPrefix(os.Args[1], "http://") || strings.HasPrefix(os.Args[1], "https://") {
-		var resp *http.Response
-		resp, err = http.Get(os.Args[1])
-		if err != nil {
-			panic(err)
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			fmt.Fprintln(os.Stderr, os.Args[1], "returned", resp.Status)
-			os.Exit(1)
-		}
-
-		err = json.NewDecoder(resp.Body).Decode(&config)
-		resp.Body.Close()
-	} else {
-		var configFile *os.File
-		configFile, err = os.Open(os.Args[1])
-		if err != nil {
-			panic(err)
-		}
-
-		err = json.NewDecoder(configFile).Decode(&config)
-		configFile.Close()
+	if printVersion {
+		fmt.Println("headless-scrcpy-client", version)
+		os.Exit(0)
 	}
 
-	if err != nil {
-		panic(err)
-	}
-
-	if !config.Adb.Enabled && !config.Scrcpy.Enabled {
-		os.Exit(1)
+	if flag.NArg() > 1 || (flag.NArg() == 1 && configFlag != "") {
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	if !config.HttpServer.Enabled && !config.TcpJsonCommands.Enabled && !config.UdpJsonCommands.Enabled && !config.TlsJsonCommands.Enabled && !config.StdinJsonCommands.Enabled {
-		os.Exit(1)
-	}
+	var err error
 
-	if config.VideoDecoder.Enabled && !config.Scrcpy.Enabled {
-		os.Exit(1)
+	configSource = "-"
+	if configFlag != "" {
+		configSource = configFlag
+	} else if flag.NArg() == 1 {
+		configSource = flag.Arg(0)
+	} else if os.Getenv("HSC_CONFIG") != "" {
+		configSource = os.Getenv("HSC_CONFIG")
 	}
 
-	if config.HttpServer.Enabled && config.HttpServer.Address == "" {
-		os.Exit(1)
+	configProfile = os.Getenv("HSC_PROFILE")
+	if profileFlag != "" {
+		configProfile = profileFlag
 	}
 
-	if config.TcpJsonCommands.Enabled {
-		if config.TcpJsonCommands.Address == "" {
-			os.Exit(1)
+	var unknownEnv []string
+	configOverrides, unknownEnv = envConfigOverrides(os.Environ())
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "device":
+			configOverrides = append(configOverrides, configOverride{source: "--device", path: "adb.device", value: deviceFlag})
+		case "http-address":
+			configOverrides = append(configOverrides, configOverride{source: "--http-address", path: "httpServer.address", value: httpAddressFlag, enable: true})
+		case "server-version":
+			configOverrides = append(configOverrides, configOverride{source: "--server-version", path: "scrcpy.serverVersion", value: serverVersionFlag})
+		case "log-level":
+			configOverrides = append(configOverrides, configOverride{source: "--log-level", path: "log.level", value: logLevelFlag})
 		}
+	})
 
-		if config.TcpJsonCommands.HandlerTemplate != "" && config.JsonCommandHandlerTemplates[config.TcpJsonCommands.HandlerTemplate] == "" {
-			os.Exit(1)
-		}
-	}
+	if configSource == "-" {
+		var data []byte
 
-	if config.UdpJsonCommands.Enabled {
-		if config.UdpJsonCommands.Address == "" {
-			os.Exit(1)
-		}
-
-		if config.UdpJsonCommands.HandlerTemplate != "" && config.JsonCommandHandlerTemplates[config.UdpJsonCommands.HandlerTemplate] == "" {
-			os.Exit(1)
+		data, err = readStdinConfigData(stdinReader)
+		if err == nil {
+			config, err = parseConfig(configSource, data, configProfile)
 		}
+	} else {
+		config, err = readConfig(configSource, configProfile)
 	}
 
-	if config.TlsJsonCommands.Enabled {
-		if config.TlsJsonCommands.Address == "" {
-			os.Exit(1)
+	if checkConfig {
+		for _, name := range unknownEnv {
+			fmt.Fprintf(os.Stderr, "%s: unknown environment variable, ignored\n", name)
 		}
 
-		if config.TlsJsonCommands.Cert == "" {
-			os.Exit(1)
-		}
-
-		if config.TlsJsonCommands.Key == "" {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
-		if config.TlsJsonCommands.HandlerTemplate != "" && config.JsonCommandHandlerTemplates[config.TlsJsonCommands.HandlerTemplate] == "" {
-			os.Exit(1)
-		}
+		fmt.Println("configuration is valid")
+		os.Exit(0)
 	}
 
-	if config.StdinJsonCommands.Enabled && config.StdinJsonCommands.HandlerTemplate != "" && config.JsonCommandHandlerTemplates[config.StdinJsonCommands.HandlerTemplate] == "" {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	for handlerTemplateName, handlerTemplate := range config.JsonCommandHandlerTemplates {
-		t := template.Must(template.New("").Funcs(jsonCommandHandlerFuncs).Parse(string(handlerTemplate)))
-		jsonCommandHandlerChannels[handlerTemplateName] = make(chan *JsonCommandHandlerData)
+	defaultSession = newSession("", config.Adb, config.Scrcpy, config.VideoDecoder)
+	sessions[""] = defaultSession
 
-		go func(c chan *JsonCommandHandlerData) {
-			err := t.Execute(io.Discard, c)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
-		}(jsonCommandHandlerChannels[handlerTemplateName])
+	for name, device := range config.Devices {
+		sessions[name] = newSession(name, device.Adb, device.Scrcpy, device.VideoDecoder)
 	}
 
-	if config.Scrcpy.Enabled {
-		scrcpyConnectedCommands = config.Scrcpy.ConnectedCommands
-
-		if config.Scrcpy.Video {
-			if config.Scrcpy.StdoutVideoStream {
-				go func() {
-					for {
-						<-videoConnectedChannel
-						writeVideoStream(config.Scrcpy.StdoutVideoStreamRaw, os.Stdout, nil)
-					}
-				}()
-			} else if config.VideoDecoder.Enabled {
-				if runtime.GOOS == "windows" {
-					go decodeVideoFfmpeg()
-				} else {
-					_, ok := exec.Command(config.VideoDecoder.Executable).Run().(*exec.ExitError)
-					if ok {
-						go decodeVideoFfmpeg()
-					} else {
-						go decodeVideo()
-					}
-				}
-			}
+	stderrReserved := false
+	for _, s := range sessions {
+		if s.device().Scrcpy.StderrClipboard || s.device().Scrcpy.StderrUhidOutput {
+			stderrReserved = true
 		}
+	}
 
-		if config.Scrcpy.Audio && config.Scrcpy.StdoutAudioStream {
-			go func() {
-				for {
-					<-audioConnectedChannel
-					writeAudioStream(config.Scrcpy.StdoutAudioStreamRaw, os.Stdout, nil)
-				}
-			}()
-		}
-
-		go func() {
-			var err error
-
-			if !config.Scrcpy.Forward {
-				scrcpyListener, err = net.Listen("tcp", config.Scrcpy.Address)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					return
-				}
-				defer scrcpyListener.Close()
-			}
-
-			for address := range connectionControlChannel {
-				if address == "" {
-					if videoSocket != nil {
-						videoSocket.Close()
-					}
-
-					if audioSocket != nil {
-						audioSocket.Close()
-					}
-
-					if controlSocket != nil {
-						controlSocket.Close()
-					}
-				} else {
-					if config.Scrcpy.Forward {
-						var connected bool
-
-						for i := 0; i < 100; i++ {
-							if videoSocket != nil {
-								videoSocket.Close()
-							}
-
-							if audioSocket != nil {
-								audioSocket.Close()
-							}
-
-							if controlSocket != nil {
-								controlSocket.Close()
-							}
-
-							if i != 0 {
-								time.Sleep(100 * time.Millisecond)
-							}
-
-							if config.Scrcpy.Video {
-								videoSocket, err = net.Dial("tcp", address)
-								if err != nil {
-									break
-								}
-
-								if !readDummyByte(videoSocket) {
-									continue
-								}
-							}
-
-							if config.Scrcpy.Audio {
-								audioSocket, err = net.Dial("tcp", address)
-								if err != nil {
-									break
-								}
-
-								if !config.Scrcpy.Video && !readDummyByte(audioSocket) {
-									continue
-								}
-							}
-
-							if config.Scrcpy.Control {
-								controlSocket, err = net.Dial("tcp", address)
-								if err != nil {
-									break
-								}
-
-								if !config.Scrcpy.Video && !config.Scrcpy.Audio && !readDummyByte(controlSocket) {
-									continue
-								}
-							}
-
-							connected = true
-							break
-						}
-
-						if !connected {
-							continue
-						}
-					} else {
-						if videoSocket != nil {
-							videoSocket.Close()
-						}
-
-						if audioSocket != nil {
-							audioSocket.Close()
-						}
-
-						if controlSocket != nil {
-							controlSocket.Close()
-						}
-
-						if config.Scrcpy.Video {
-							videoSocket, err = scrcpyListener.Accept()
-							if err != nil {
-								return
-							}
-						}
-
-						if config.Scrcpy.Audio {
-							audioSocket, err = scrcpyListener.Accept()
-							if err != nil {
-								return
-							}
-						}
-
-						if config.Scrcpy.Control {
-							controlSocket, err = scrcpyListener.Accept()
-							if err != nil {
-								return
-							}
-						}
-					}
-
-					if !readDeviceMeta() {
-						continue
-					}
-
-					if config.Scrcpy.Video {
-						data := make([]byte, 12)
-						n, err := io.ReadFull(videoSocket, data)
-						if err != nil {
-							continue
-						}
-						if n != 12 {
-							continue
-						}
-
-						videoCodec = binary.BigEndian.Uint32(data[:4])
-						initialVideoWidth = int(binary.BigEndian.Uint32(data[4:8]))
-						initialVideoHeight = int(binary.BigEndian.Uint32(data[8:]))
-					}
-
-					if config.Scrcpy.Audio {
-						data := make([]byte, 4)
-						n, err := io.ReadFull(audioSocket, data)
-						if err != nil {
-							continue
-						}
-						if n != 4 {
-							continue
-						}
-
-						audioCodec = binary.BigEndian.Uint32(data)
-					}
-
-					if config.Scrcpy.Control {
-						if !createUhidDevices() {
-							go func() { connectionControlChannel <- "" }()
-							continue
-						}
+	err = setupLogging(config.Log, stderrReserved)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-						go func() {
-							data := make([]byte, 262130)
-
-							for {
-								n, err := io.ReadFull(controlSocket, data[:1])
-								if err != nil {
-									return
-								}
-								if n != 1 {
-									return
-								}
-
-								switch data[0] {
-								case ScrcpyDeviceMessageTypes.Clipboard:
-									n, err = io.ReadFull(controlSocket, data[:4])
-									if err != nil {
-										return
-									}
-									if n != 4 {
-										return
-									}
-
-									clipboardLength := int(binary.BigEndian.Uint32(data[:4]))
-
-									n, err = io.ReadFull(controlSocket, data[:clipboardLength])
-									if err != nil {
-										return
-									}
-									if n != clipboardLength {
-										return
-									}
-
-									lineBytes, err := json.Marshal(string(data[:clipboardLength]))
-									if err != nil {
-										panic(err)
-									}
-
-									if config.Scrcpy.StdoutClipboard {
-										fmt.Println(string(lineBytes))
-									}
-
-									if config.Scrcpy.StderrClipboard {
-										fmt.Fprintln(os.Stderr, string(lineBytes))
-									}
-
-									select {
-									case clipboardChannel <- string(lineBytes):
-									default:
-									}
-								case ScrcpyDeviceMessageTypes.AckClipboard:
-									n, err = io.ReadFull(controlSocket, data[:8])
-									if err != nil {
-										return
-									}
-									if n != 8 {
-										return
-									}
-
-									line := strconv.FormatUint(binary.BigEndian.Uint64(data[:8]), 10)
-
-									if config.Scrcpy.StdoutClipboard {
-										fmt.Println(line)
-									}
-
-									if config.Scrcpy.StderrClipboard {
-										fmt.Fprintln(os.Stderr, line)
-									}
-
-									select {
-									case clipboardChannel <- line:
-									default:
-									}
-								case ScrcpyDeviceMessageTypes.UhidOutput:
-									n, err = io.ReadFull(controlSocket, data[:4])
-									if err != nil {
-										return
-									}
-									if n != 4 {
-										return
-									}
-
-									size := int(binary.BigEndian.Uint16(data[:4]))
-
-									n, err = io.ReadFull(controlSocket, data[:size])
-									if err != nil {
-										return
-									}
-									if n != size {
-										return
-									}
-
-									line := hex.EncodeToString(data[:size])
-
-									if config.Scrcpy.StdoutUhidOutput {
-										fmt.Println(line)
-									}
-
-									if config.Scrcpy.StderrUhidOutput {
-										fmt.Fprintln(os.Stderr, line)
-									}
-
-									select {
-									case uhidOutputChannel <- line:
-									default:
-									}
-								}
-							}
-						}()
-					}
+	if config.AuditLog.Enabled {
+		auditLog, err = openAuditLog(config.AuditLog)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 
-					if config.Scrcpy.Video {
-						videoConnectedChannel <- struct{}{}
-					}
+	slog.Info("starting", "version", version, "config", configSource, "profile", configProfile)
 
-					if config.Scrcpy.Audio {
-						audioConnectedChannel <- struct{}{}
-					}
-
-					if len(scrcpyConnectedCommands) > 0 {
-						go runCommands(scrcpyConnectedCommands)
-					}
-				}
-			}
-		}()
+	for _, name := range unknownEnv {
+		slog.Warn("unknown environment variable ignored", "name", name)
 	}
 
-	if config.HttpServer.Enabled {
-		endpoint := func(path string, handler func(http.ResponseWriter, *http.Request)) {
-			if len(config.HttpServer.Endpoints) > 0 {
-				_, ok := config.HttpServer.Endpoints[path]
-				if !ok {
-					return
-				}
-			}
-
-			http.HandleFunc(path, handler)
+	for handlerTemplateName, handlerTemplate := range config.JsonCommandHandlerTemplates {
+		jsonCommandHandlers[handlerTemplateName], err = startJsonCommandHandler(handlerTemplate)
+		if err != nil {
+			panic(err)
 		}
+	}
 
-		if config.Scrcpy.Enabled {
-			endpoint("/connect", commandHandler)
-			endpoint("/disconnect", commandHandler)
-			endpoint("/devicename", infoHandler)
+	for _, s := range sessions {
+		if s.device().Scrcpy.Enabled {
+			s.start()
+		}
+	}
 
-			if config.Scrcpy.Video {
-				endpoint("/videocodec", infoHandler)
-				endpoint("/initialvideowidth", infoHandler)
-				endpoint("/initialvideoheight", infoHandler)
+	if config.HttpServer.Enabled {
+		defaultSession.registerEndpoints(http.DefaultServeMux)
 
-				if !config.Scrcpy.StdoutVideoStream {
-					if config.VideoDecoder.Enabled {
-						endpoint("/videoframe", videoFrameHandler)
-					} else {
-						endpoint("/videostream", videoStreamHandler)
-						endpoint("/rawvideostream", videoStreamHandler)
-					}
-				}
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+			if !endpointAllowed(req.URL.Path) {
+				http.NotFound(w, req)
+				return
 			}
 
-			if config.Scrcpy.Audio {
-				endpoint("/audiocodec", infoHandler)
-
-				if !config.Scrcpy.StdoutAudioStream {
-					endpoint("/audiostream", audioStreamHandler)
-					endpoint("/rawaudiostream", audioStreamHandler)
-				}
-			}
+			metricsHandler(w, req)
+		})
 
-			if config.Scrcpy.Control {
-				endpoint("/key", keyHandler)
-				endpoint("/keydown", keyHandler)
-				endpoint("/keyup", keyHandler)
-				endpoint("/type", typeHandler)
-				endpoint("/touch", touchHandler)
-				endpoint("/touchdown", touchHandler)
-				endpoint("/touchup", touchHandler)
-				endpoint("/touchmove", touchHandler)
-				endpoint("/mouseclick", mouseHandler)
-				endpoint("/mousedown", mouseHandler)
-				endpoint("/mouseup", mouseHandler)
-				endpoint("/mousemove", mouseHandler)
-				endpoint("/scrollleft", scrollHandler)
-				endpoint("/scrollright", scrollHandler)
-				endpoint("/scrollup", scrollHandler)
-				endpoint("/scrolldown", scrollHandler)
-				endpoint("/getclipboard", commandHandler)
-				endpoint("/getclipboardcut", commandHandler)
-				endpoint("/clipboard", clipboardHandler)
-				endpoint("/clipboardcut", clipboardHandler)
-				endpoint("/setclipboard", setClipboardHandler)
-				endpoint("/setclipboardpaste", setClipboardHandler)
-				endpoint("/clipboardstream", clipboardStreamHandler)
-				endpoint("/uhidinput", uhidInputHandler)
-				endpoint("/uhidoutputstream", uhidOutputStreamHandler)
-				endpoint("/openhardkeyboardsettings", commandHandler)
-				endpoint("/backorscreenon", commandHandler)
-				endpoint("/expandnotificationspanel", commandHandler)
-				endpoint("/expandsettingspanel", commandHandler)
-				endpoint("/collapsepanels", commandHandler)
-				endpoint("/turnscreenon", commandHandler)
-				endpoint("/turnscreenoff", commandHandler)
-				endpoint("/rotate", commandHandler)
-				endpoint("/resetvideo", commandHandler)
+		for name, s := range sessions {
+			if name == "" {
+				continue
 			}
 
-			if config.Adb.Enabled {
-				endpoint("/startscrcpyserver", commandHandler)
-				endpoint("/stopscrcpyserver", commandHandler)
-				endpoint("/encoders", listHandler)
-				endpoint("/displays", listHandler)
-				endpoint("/cameras", listHandler)
-				endpoint("/apps", listHandler)
-				endpoint("/camerasizes", listHandler)
-			}
+			mux := http.NewServeMux()
+			s.registerEndpoints(mux)
+			mux.Handle("/", dynamicEndpointHandler(nil))
+			http.Handle(fmt.Sprintf("/dev/%s/", name), http.StripPrefix(fmt.Sprintf("/dev/%s", name), s.handler(mux)))
 		}
 
-		for name := range config.CustomCommands {
-			endpoint(fmt.Sprintf("/%s", name), commandHandler)
+		if config.HttpServer.Static != "" {
+			http.Handle("/", dynamicEndpointHandler(http.FileServer(http.Dir(config.HttpServer.Static))))
+		} else {
+			http.Handle("/", dynamicEndpointHandler(nil))
 		}
 
-		for name := range config.JsonCommandHandlerTemplates {
-			endpoint(fmt.Sprintf("/%s", name), jsonCommandsHandler)
-		}
+		ctx, cancel := context.WithCancel(context.Background())
 
-		if config.HttpServer.Static != "" {
-			http.Handle("/", http.FileServer(http.Dir(config.HttpServer.Static)))
+		server := &http.Server{
+			Addr:        config.HttpServer.Address,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+			ConnState: func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					slog.Info("connection accepted", "transport", "http", "remoteAddress", c.RemoteAddr().String())
+				}
+			},
+			ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
 		}
-
-		server := &http.Server{Addr: config.HttpServer.Address}
+		server.RegisterOnShutdown(cancel)
+		httpServer = server
 
 		if config.HttpServer.Cert == "" && config.HttpServer.Key == "" {
 			go func() {
 				err := server.ListenAndServe()
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
+				if err != nil && err != http.ErrServerClosed {
+					slog.Error("http server failed", "address", config.HttpServer.Address, "error", err)
 				}
 			}()
 		} else {
@@ -1368,8 +1208,8 @@ func main() {
 
 			go func() {
 				err := server.ListenAndServeTLS("", "")
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
+				if err != nil && err != http.ErrServerClosed {
+					slog.Error("https server failed", "address", config.HttpServer.Address, "error", err)
 				}
 			}()
 		}
@@ -1379,10 +1219,11 @@ func main() {
 		go func() {
 			listener, err := net.Listen("tcp", config.TcpJsonCommands.Address)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				slog.Error("tcp listen failed", "address", config.TcpJsonCommands.Address, "error", err)
 				return
 			}
 			defer listener.Close()
+			addShutdownCloser(listener)
 
 			for {
 				c, err := listener.Accept()
@@ -1390,36 +1231,11 @@ func main() {
 					break
 				}
 
+				slog.Info("connection accepted", "transport", "tcp", "remoteAddress", c.RemoteAddr().String())
+
 				go func() {
 					defer c.Close()
-					data := make([]byte, 1024)
-
-					for {
-						n, err := c.Read(data)
-						if err != nil {
-							break
-						}
-
-						var cs CommandSlice
-
-						if json.Unmarshal(data[:n], &cs) != nil {
-							break
-						}
-
-						if len(cs) == 0 {
-							break
-						}
-
-						if len(config.TcpJsonCommands.HandlerTemplate) == 0 {
-							go runCommands(cs)
-						} else {
-							jsonCommandHandlerChannels[config.TcpJsonCommands.HandlerTemplate] <- &JsonCommandHandlerData{
-								Server:   "tcp",
-								Address:  c.RemoteAddr().String(),
-								Commands: cs,
-							}
-						}
-					}
+					serveJsonCommands(c, "tcp", config.TcpJsonCommands.Framing, config.TcpJsonCommands.MaxMessageSize, config.TcpJsonCommands.HandlerTemplate, "")
 				}()
 			}
 		}()
@@ -1429,10 +1245,11 @@ func main() {
 		go func() {
 			c, err := net.ListenPacket("udp", config.UdpJsonCommands.Address)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				slog.Error("udp listen failed", "address", config.UdpJsonCommands.Address, "error", err)
 				return
 			}
 			defer c.Close()
+			addShutdownCloser(c)
 
 			data := make([]byte, 1024)
 
@@ -1442,24 +1259,57 @@ func main() {
 					break
 				}
 
-				var cs CommandSlice
+				var r CommandRequest
 
-				if json.Unmarshal(data[:n], &cs) != nil {
-					break
-				}
+				err = json.Unmarshal(data[:n], &r)
+				if err != nil || len(r.Commands) == 0 {
+					response := CommandResponse{Id: r.Id, Error: "empty command list"}
+					if err != nil {
+						response.Error = err.Error()
+					}
 
-				if len(cs) == 0 {
-					break
+					responseBytes, err := json.Marshal(response)
+					if err != nil {
+						panic(err)
+					}
+
+					c.WriteTo(responseBytes, addr)
+					continue
 				}
 
 				if len(config.UdpJsonCommands.HandlerTemplate) == 0 {
-					go runCommands(cs)
+					go func(r CommandRequest, addr net.Addr) {
+						resultsBytes, err := json.Marshal(CommandResponse{Id: r.Id, CommandResults: defaultSession.runCommands(CommandSource{Transport: "udp", RemoteAddress: addr.String()}, r.Commands)})
+						if err != nil {
+							panic(err)
+						}
+
+						c.WriteTo(resultsBytes, addr)
+					}(r, addr)
 				} else {
-					jsonCommandHandlerChannels[config.UdpJsonCommands.HandlerTemplate] <- &JsonCommandHandlerData{
+					data := &JsonCommandHandlerData{
 						Server:   "udp",
 						Address:  addr.String(),
-						Commands: cs,
+						Id:       r.Id,
+						Commands: r.Commands,
 					}
+					data.expectReply()
+
+					response := CommandResponse{Id: r.Id, Error: "unknown handler template"}
+					sent := sendJsonCommandHandler(config.UdpJsonCommands.HandlerTemplate, data)
+
+					go func(addr net.Addr) {
+						if sent {
+							response = data.waitReply()
+						}
+
+						responseBytes, err := json.Marshal(response)
+						if err != nil {
+							panic(err)
+						}
+
+						c.WriteTo(responseBytes, addr)
+					}(addr)
 				}
 			}
 		}()
@@ -1467,9 +1317,9 @@ func main() {
 
 	if config.TlsJsonCommands.Enabled {
 		go func() {
-			serverCert, err := tls.LoadX509KeyPair(config.HttpServer.Cert, config.HttpServer.Key)
+			serverCert, err := tls.LoadX509KeyPair(config.TlsJsonCommands.Cert, config.TlsJsonCommands.Key)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				slog.Error("loading tls certificate failed", "error", err)
 				return
 			}
 
@@ -1490,10 +1340,11 @@ func main() {
 
 			listener, err := tls.Listen("tcp", config.TlsJsonCommands.Address, tlsConfig)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				slog.Error("tls listen failed", "address", config.TlsJsonCommands.Address, "error", err)
 				return
 			}
 			defer listener.Close()
+			addShutdownCloser(listener)
 
 			for {
 				c, err := listener.Accept()
@@ -1511,6 +1362,7 @@ func main() {
 
 					err := tlsConn.Handshake()
 					if err != nil {
+						slog.Warn("tls handshake failed", "remoteAddress", c.RemoteAddr().String(), "error", err)
 						return
 					}
 
@@ -1519,39 +1371,14 @@ func main() {
 						state := tlsConn.ConnectionState()
 						client = tlsClientAuth(config.TlsJsonCommands.Clients, &state)
 						if client == " " {
+							slog.Warn("tls client rejected", "remoteAddress", c.RemoteAddr().String())
 							return
 						}
 					}
 
-					data := make([]byte, 1024)
+					slog.Info("connection accepted", "transport", "tls", "remoteAddress", c.RemoteAddr().String(), "tlsClient", client)
 
-					for {
-						n, err := c.Read(data)
-						if err != nil {
-							break
-						}
-
-						var cs CommandSlice
-
-						if json.Unmarshal(data[:n], &cs) != nil {
-							break
-						}
-
-						if len(cs) == 0 {
-							break
-						}
-
-						if len(config.TlsJsonCommands.HandlerTemplate) == 0 {
-							go runCommands(cs)
-						} else {
-							jsonCommandHandlerChannels[config.TlsJsonCommands.HandlerTemplate] <- &JsonCommandHandlerData{
-								Server:    "tls",
-								Address:   c.RemoteAddr().String(),
-								TlsClient: client,
-								Commands:  cs,
-							}
-						}
-					}
+					serveJsonCommands(c, "tls", config.TlsJsonCommands.Framing, config.TlsJsonCommands.MaxMessageSize, config.TlsJsonCommands.HandlerTemplate, client)
 				}()
 			}
 		}()
@@ -1559,38 +1386,82 @@ func main() {
 
 	if config.StdinJsonCommands.Enabled {
 		go func() {
-			if stdinDecoder == nil {
-				stdinDecoder = json.NewDecoder(os.Stdin)
-			}
+			stdinDecoder := json.NewDecoder(stdinReader)
 
 			for {
-				var cs CommandSlice
+				var r CommandRequest
 
-				err := stdinDecoder.Decode(&cs)
+				err := stdinDecoder.Decode(&r)
 				if err != nil {
 					if err == io.EOF {
 						break
 					}
 
-					stdinDecoder = json.NewDecoder(os.Stdin)
-					fmt.Fprintln(os.Stderr, err)
-				} else if len(cs) > 0 {
+					stdinDecoder = json.NewDecoder(stdinReader)
+					slog.Warn("invalid stdin command request", "error", err)
+				} else if len(r.Commands) > 0 {
 					if len(config.StdinJsonCommands.HandlerTemplate) == 0 {
-						runCommands(cs)
+						results := defaultSession.runCommands(CommandSource{Transport: "stdin"}, r.Commands)
+
+						if r.Id != "" && !stdoutStreaming() {
+							resultsBytes, err := json.Marshal(CommandResponse{Id: r.Id, CommandResults: results})
+							if err != nil {
+								panic(err)
+							}
+
+							fmt.Println(string(resultsBytes))
+						}
 					} else {
-						jsonCommandHandlerChannels[config.StdinJsonCommands.HandlerTemplate] <- &JsonCommandHandlerData{Commands: cs}
+						data := &JsonCommandHandlerData{Server: "stdin", Id: r.Id, Commands: r.Commands}
+
+						if r.Id != "" && !stdoutStreaming() {
+							data.expectReply()
+						}
+
+						sent := sendJsonCommandHandler(config.StdinJsonCommands.HandlerTemplate, data)
+
+						if data.replies != nil {
+							response := CommandResponse{Id: r.Id, Error: "unknown handler template"}
+							if sent {
+								response = data.waitReply()
+							}
+
+							responseBytes, err := json.Marshal(response)
+							if err != nil {
+								panic(err)
+							}
+
+							fmt.Println(string(responseBytes))
+						}
 					}
 				}
 			}
 		}()
 	}
 
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for range hangup {
+			result, err := reloadConfig("", nil)
+			if err != nil {
+				slog.Error("reloading configuration failed", "error", err)
+				continue
+			}
+
+			slog.Info("configuration reloaded", "applied", result.Applied, "reconnectRequired", result.ReconnectRequired, "restartRequired", result.RestartRequired)
+		}
+	}()
+
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	sig := <-interrupt
 
-	select {
-	case connectionControlChannel <- "":
-	default:
-	}
+	go func() {
+		<-interrupt
+		os.Exit(1)
+	}()
+
+	shutdown(sig.String())
 }
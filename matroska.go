@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const matroskaClusterDuration = 5000
+
+type matroskaMuxer struct {
+	w              io.Writer
+	tracks         []*recordingTrack
+	offset         int64
+	segmentOffset  int64
+	durationOffset int64
+	seekHeadOffset int64
+	cluster        []byte
+	clusterOpen    bool
+	clusterTime    int64
+	lastTime       int64
+	cues           [][]byte
+}
+
+func ebmlId(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+func ebmlSize(size uint64) []byte {
+	n := 1
+	for n < 8 && size >= (1<<(7*n))-1 {
+		n++
+	}
+
+	data := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		data[i] = byte(size)
+		size >>= 8
+	}
+
+	data[0] |= 0x80 >> (n - 1)
+	return data
+}
+
+func ebmlElement(id uint32, children ...[]byte) []byte {
+	var size int
+	for _, child := range children {
+		size += len(child)
+	}
+
+	element := append(ebmlId(id), ebmlSize(uint64(size))...)
+	for _, child := range children {
+		element = append(element, child...)
+	}
+
+	return element
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	data := binary.BigEndian.AppendUint64(nil, v)
+	for len(data) > 1 && data[0] == 0 {
+		data = data[1:]
+	}
+
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func ebmlString(id uint32, v string) []byte {
+	return ebmlElement(id, []byte(v))
+}
+
+func matroskaSeekHead(cuesPosition uint64) []byte {
+	return ebmlElement(
+		0x114D9B74,
+		ebmlElement(0x4DBB, ebmlElement(0x53AB, ebmlId(0x1C53BB6B)), ebmlElement(0x53AC, binary.BigEndian.AppendUint64(nil, cuesPosition))),
+	)
+}
+
+func newMatroskaMuxer(w io.Writer, tracks []*recordingTrack) (*matroskaMuxer, error) {
+	m := &matroskaMuxer{w: w, tracks: tracks}
+
+	header := ebmlElement(
+		0x1A45DFA3,
+		ebmlUint(0x4286, 1),
+		ebmlUint(0x42F7, 1),
+		ebmlUint(0x42F2, 4),
+		ebmlUint(0x42F3, 8),
+		ebmlString(0x4282, "matroska"),
+		ebmlUint(0x4287, 4),
+		ebmlUint(0x4285, 2),
+	)
+
+	header = append(header, ebmlId(0x18538067)...)
+	header = append(header, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	m.segmentOffset = int64(len(header))
+	m.seekHeadOffset = int64(len(header))
+
+	header = append(header, ebmlElement(0xEC, make([]byte, len(matroskaSeekHead(0))-2))...)
+
+	info := ebmlElement(
+		0x1549A966,
+		ebmlUint(0x2AD7B1, 1000000),
+		ebmlString(0x4D80, "headless-scrcpy-client"),
+		ebmlString(0x5741, "headless-scrcpy-client"),
+		ebmlFloat(0x4489, 0),
+	)
+
+	header = append(header, info...)
+	m.durationOffset = int64(len(header)) - 8
+
+	var entries [][]byte
+
+	for i, t := range tracks {
+		entry := [][]byte{
+			ebmlUint(0xD7, uint64(i+1)),
+			ebmlUint(0x73C5, uint64(i+1)),
+			ebmlUint(0x9C, 0),
+		}
+
+		if t.video {
+			entry = append(entry, ebmlUint(0x83, 1))
+		} else {
+			entry = append(entry, ebmlUint(0x83, 2))
+		}
+
+		switch t.codec {
+		case ScrcpyCodecs.H264:
+			entry = append(entry, ebmlString(0x86, "V_MPEG4/ISO/AVC"), ebmlElement(0x63A2, t.codecConfig))
+		case ScrcpyCodecs.H265:
+			entry = append(entry, ebmlString(0x86, "V_MPEGH/ISO/HEVC"), ebmlElement(0x63A2, t.codecConfig))
+		case ScrcpyCodecs.Av1:
+			entry = append(entry, ebmlString(0x86, "V_AV1"), ebmlElement(0x63A2, t.codecConfig))
+		case ScrcpyCodecs.Opus:
+			entry = append(
+				entry,
+				ebmlString(0x86, "A_OPUS"),
+				ebmlElement(0x63A2, t.codecConfig),
+				ebmlUint(0x56AA, uint64(binary.LittleEndian.Uint16(t.codecConfig[10:]))*1000000000/48000),
+				ebmlUint(0x56BB, 80000000),
+			)
+		case ScrcpyCodecs.Aac:
+			entry = append(entry, ebmlString(0x86, "A_AAC"), ebmlElement(0x63A2, t.codecConfig))
+		case ScrcpyCodecs.Flac:
+			entry = append(entry, ebmlString(0x86, "A_FLAC"), ebmlElement(0x63A2, []byte("fLaC"), []byte{0x80, 0, 0, 34}, t.codecConfig))
+		case ScrcpyCodecs.Raw:
+			entry = append(entry, ebmlString(0x86, "A_PCM/INT/LIT"))
+		}
+
+		if t.video {
+			entry = append(entry, ebmlElement(0xE0, ebmlUint(0xB0, uint64(t.width)), ebmlUint(0xBA, uint64(t.height))))
+		} else if t.codec == ScrcpyCodecs.Raw {
+			entry = append(entry, ebmlElement(0xE1, ebmlFloat(0xB5, 48000), ebmlUint(0x9F, 2), ebmlUint(0x6264, 16)))
+		} else {
+			entry = append(entry, ebmlElement(0xE1, ebmlFloat(0xB5, 48000), ebmlUint(0x9F, 2)))
+		}
+
+		entries = append(entries, ebmlElement(0xAE, entry...))
+	}
+
+	header = append(header, ebmlElement(0x1654AE6B, entries...)...)
+
+	return m, m.write(header)
+}
+
+func (m *matroskaMuxer) write(data []byte) error {
+	n, err := m.w.Write(data)
+	m.offset += int64(n)
+
+	if err != nil {
+		return err
+	}
+	if n < len(data) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+func (m *matroskaMuxer) flushCluster() error {
+	if !m.clusterOpen {
+		return nil
+	}
+
+	m.clusterOpen = false
+	cluster := m.cluster
+	m.cluster = nil
+
+	return m.write(ebmlElement(0x1F43B675, ebmlUint(0xE7, uint64(m.clusterTime)), cluster))
+}
+
+func (m *matroskaMuxer) writeSample(track int, timestamp int64, keyFrame bool, data []byte) error {
+	milliseconds := timestamp / 1000
+	relative := milliseconds - m.clusterTime
+
+	if !m.clusterOpen || (m.tracks[track].video && keyFrame) || relative >= matroskaClusterDuration || relative < math.MinInt16 {
+		err := m.flushCluster()
+		if err != nil {
+			return err
+		}
+
+		if keyFrame && (m.tracks[track].video || !m.tracks[0].video) {
+			m.cues = append(m.cues, ebmlElement(
+				0xBB,
+				ebmlUint(0xB3, uint64(milliseconds)),
+				ebmlElement(0xB7, ebmlUint(0xF7, uint64(track+1)), ebmlUint(0xF1, uint64(m.offset-m.segmentOffset))),
+			))
+		}
+
+		m.clusterOpen = true
+		m.clusterTime = milliseconds
+		relative = 0
+	}
+
+	var flags byte
+	if keyFrame {
+		flags = 0x80
+	}
+
+	m.cluster = append(m.cluster, ebmlElement(0xA3, []byte{0x80 | byte(track+1), byte(relative >> 8), byte(relative), flags}, data)...)
+
+	if milliseconds > m.lastTime {
+		m.lastTime = milliseconds
+	}
+
+	return nil
+}
+
+func (m *matroskaMuxer) close() error {
+	err := m.flushCluster()
+	if err != nil {
+		return err
+	}
+
+	cuesPosition := m.offset - m.segmentOffset
+
+	if len(m.cues) > 0 {
+		err = m.write(ebmlElement(0x1C53BB6B, m.cues...))
+		if err != nil {
+			return err
+		}
+	}
+
+	wa, ok := m.w.(io.WriterAt)
+	if !ok {
+		return nil
+	}
+
+	if len(m.cues) > 0 {
+		_, err = wa.WriteAt(matroskaSeekHead(uint64(cuesPosition)), m.seekHeadOffset)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = wa.WriteAt(binary.BigEndian.AppendUint64(nil, math.Float64bits(float64(m.lastTime))), m.durationOffset)
+	if err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.AppendUint64(nil, uint64(m.offset-m.segmentOffset))
+	size[0] = 0x01
+
+	_, err = wa.WriteAt(size, m.segmentOffset-8)
+	return err
+}
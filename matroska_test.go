@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"slices"
+	"testing"
+)
+
+type memoryFile struct {
+	data []byte
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memoryFile) WriteAt(p []byte, offset int64) (int, error) {
+	copy(f.data[offset:], p)
+	return len(p), nil
+}
+
+type testSample struct {
+	track     int
+	timestamp int64
+	keyFrame  bool
+	data      []byte
+}
+
+func testRecordingTracks(t *testing.T, video bool, audio bool) []*recordingTrack {
+	var tracks []*recordingTrack
+
+	if video {
+		config, err := avcDecoderConfiguration(annexB(testH264Sps, testH264Pps))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tracks = append(tracks, &recordingTrack{video: true, codec: ScrcpyCodecs.H264, width: 1080, height: 1920, codecConfig: config})
+	}
+
+	if audio {
+		config, err := opusHead(append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tracks = append(tracks, &recordingTrack{codec: ScrcpyCodecs.Opus, codecConfig: config})
+	}
+
+	return tracks
+}
+
+type ebmlTestElement struct {
+	id     uint32
+	offset int
+	start  int
+	data   []byte
+}
+
+func readEbmlVint(t *testing.T, data []byte, marker bool) (uint64, int) {
+	t.Helper()
+
+	if len(data) == 0 || data[0] == 0 {
+		t.Fatalf("invalid ebml variable size integer %x", data)
+	}
+
+	n := bits.LeadingZeros8(data[0]) + 1
+	if len(data) < n {
+		t.Fatalf("truncated ebml variable size integer %x", data)
+	}
+
+	v := uint64(data[0])
+	if !marker {
+		v &= 0xFF >> n
+	}
+
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+
+	return v, n
+}
+
+func readEbmlElements(t *testing.T, data []byte, base int) []ebmlTestElement {
+	t.Helper()
+
+	var elements []ebmlTestElement
+
+	for pos := 0; pos < len(data); {
+		id, idLength := readEbmlVint(t, data[pos:], true)
+		size, sizeLength := readEbmlVint(t, data[pos+idLength:], false)
+
+		start := pos + idLength + sizeLength
+		end := start + int(size)
+
+		if size == 1<<(7*sizeLength)-1 {
+			end = len(data)
+		} else if end > len(data) {
+			t.Fatalf("element %x at %d overruns its parent", id, base+pos)
+		}
+
+		elements = append(elements, ebmlTestElement{id: uint32(id), offset: base + pos, start: base + start, data: data[start:end]})
+		pos = end
+	}
+
+	return elements
+}
+
+func (e ebmlTestElement) children(t *testing.T) []ebmlTestElement {
+	return readEbmlElements(t, e.data, e.start)
+}
+
+func findEbmlElements(elements []ebmlTestElement, id uint32) []ebmlTestElement {
+	var found []ebmlTestElement
+	for _, e := range elements {
+		if e.id == id {
+			found = append(found, e)
+		}
+	}
+
+	return found
+}
+
+func findEbmlElement(t *testing.T, elements []ebmlTestElement, id uint32) ebmlTestElement {
+	t.Helper()
+
+	found := findEbmlElements(elements, id)
+	if len(found) != 1 {
+		t.Fatalf("found %d elements with id %x, want 1", len(found), id)
+	}
+
+	return found[0]
+}
+
+func (e ebmlTestElement) uint() uint64 {
+	var v uint64
+	for _, b := range e.data {
+		v = v<<8 | uint64(b)
+	}
+
+	return v
+}
+
+type matroskaTestFile struct {
+	segment      ebmlTestElement
+	children     []ebmlTestElement
+	blocks       []testSample
+	clusterTimes []uint64
+}
+
+func parseMatroska(t *testing.T, data []byte) matroskaTestFile {
+	t.Helper()
+
+	top := readEbmlElements(t, data, 0)
+	if len(top) != 2 || top[0].id != 0x1A45DFA3 || top[1].id != 0x18538067 {
+		t.Fatalf("expected an ebml header and a segment, got %v", top)
+	}
+
+	if docType := findEbmlElement(t, top[0].children(t), 0x4282); string(docType.data) != "matroska" {
+		t.Fatalf("got doc type %q, want matroska", docType.data)
+	}
+
+	f := matroskaTestFile{segment: top[1], children: top[1].children(t)}
+
+	for _, cluster := range findEbmlElements(f.children, 0x1F43B675) {
+		children := cluster.children(t)
+		clusterTime := findEbmlElement(t, children, 0xE7).uint()
+		f.clusterTimes = append(f.clusterTimes, clusterTime)
+
+		for _, block := range findEbmlElements(children, 0xA3) {
+			track, n := readEbmlVint(t, block.data, false)
+			relative := int16(binary.BigEndian.Uint16(block.data[n:]))
+
+			f.blocks = append(f.blocks, testSample{
+				track:     int(track) - 1,
+				timestamp: int64(clusterTime) + int64(relative),
+				keyFrame:  block.data[n+2]&0x80 != 0,
+				data:      block.data[n+3:],
+			})
+		}
+	}
+
+	return f
+}
+
+func (f matroskaTestFile) elementAt(t *testing.T, position uint64) ebmlTestElement {
+	t.Helper()
+
+	for _, e := range f.children {
+		if e.offset == f.segment.start+int(position) {
+			return e
+		}
+	}
+
+	t.Fatalf("no segment child at position %d", position)
+	return ebmlTestElement{}
+}
+
+func writeTestSamples(t *testing.T, m muxer, samples []testSample) {
+	t.Helper()
+
+	for _, sample := range samples {
+		err := m.writeSample(sample.track, sample.timestamp, sample.keyFrame, sample.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := m.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var matroskaTestSamples = []testSample{
+	{0, 0, true, []byte{0, 0xAA}},
+	{1, 0, true, []byte{1, 0xBB}},
+	{0, 33000, false, []byte{2, 0xAA}},
+	{1, 20000, true, []byte{3, 0xBB}},
+	{0, 6000000, true, []byte{4, 0xAA}},
+	{1, 5990000, true, []byte{5, 0xBB}},
+	{1, 11500000, true, []byte{6, 0xBB}},
+	{0, 45000000, true, []byte{7, 0xAA}},
+	{1, 11520000, true, []byte{8, 0xBB}},
+	{0, 45033000, false, []byte{9, 0xAA}},
+}
+
+func TestMatroskaMuxer(t *testing.T) {
+	tracks := testRecordingTracks(t, true, true)
+	file := &memoryFile{}
+
+	m, err := newMatroskaMuxer(file, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestSamples(t, m, matroskaTestSamples)
+
+	f := parseMatroska(t, file.data)
+
+	if end := f.segment.start + len(f.segment.data); end != len(file.data) || file.data[f.segment.start-8] != 0x01 {
+		t.Fatalf("segment ends at %d, want a known size ending at %d", end, len(file.data))
+	}
+
+	var ids []uint32
+	for _, e := range f.children {
+		ids = append(ids, e.id)
+	}
+
+	wantIds := []uint32{0x114D9B74, 0x1549A966, 0x1654AE6B, 0x1F43B675, 0x1F43B675, 0x1F43B675, 0x1F43B675, 0x1F43B675, 0x1F43B675, 0x1C53BB6B}
+	if !slices.Equal(ids, wantIds) {
+		t.Fatalf("got segment children %x, want %x", ids, wantIds)
+	}
+
+	info := f.children[1].children(t)
+	if duration := math.Float64frombits(findEbmlElement(t, info, 0x4489).uint()); duration != 45033 {
+		t.Fatalf("got duration %v, want 45033", duration)
+	}
+
+	entries := findEbmlElements(f.children[2].children(t), 0xAE)
+	if len(entries) != 2 {
+		t.Fatalf("got %d track entries, want 2", len(entries))
+	}
+
+	for i, want := range []string{"V_MPEG4/ISO/AVC", "A_OPUS"} {
+		children := entries[i].children(t)
+
+		if codec := string(findEbmlElement(t, children, 0x86).data); codec != want {
+			t.Errorf("track %d has codec %s, want %s", i+1, codec, want)
+		}
+
+		if private := findEbmlElement(t, children, 0x63A2).data; !bytes.Equal(private, tracks[i].codecConfig) {
+			t.Errorf("track %d has codec private %x, want %x", i+1, private, tracks[i].codecConfig)
+		}
+	}
+
+	if len(f.blocks) != len(matroskaTestSamples) {
+		t.Fatalf("got %d blocks, want %d", len(f.blocks), len(matroskaTestSamples))
+	}
+
+	for i, want := range matroskaTestSamples {
+		got := f.blocks[i]
+		if got.track != want.track || got.timestamp != want.timestamp/1000 || got.keyFrame != want.keyFrame || !bytes.Equal(got.data, want.data) {
+			t.Errorf("block %d is %+v, want %+v at %d ms", i, got, want, want.timestamp/1000)
+		}
+	}
+
+	wantClusters := []uint64{0, 6000, 11500, 45000, 11520, 45033}
+	if !slices.Equal(f.clusterTimes, wantClusters) {
+		t.Fatalf("got cluster times %v, want %v", f.clusterTimes, wantClusters)
+	}
+
+	seek := findEbmlElement(t, f.children[0].children(t), 0x4DBB).children(t)
+	if seekId := findEbmlElement(t, seek, 0x53AB).data; !bytes.Equal(seekId, []byte{0x1C, 0x53, 0xBB, 0x6B}) {
+		t.Fatalf("got seek id %x, want cues", seekId)
+	}
+
+	if cues := f.elementAt(t, findEbmlElement(t, seek, 0x53AC).uint()); cues.id != 0x1C53BB6B {
+		t.Fatalf("seek head points at %x, want cues", cues.id)
+	}
+
+	var cueTimes []uint64
+
+	for _, point := range findEbmlElements(f.children[len(f.children)-1].children(t), 0xBB) {
+		children := point.children(t)
+		positions := findEbmlElement(t, children, 0xB7).children(t)
+		cueTime := findEbmlElement(t, children, 0xB3).uint()
+		cueTimes = append(cueTimes, cueTime)
+
+		if track := findEbmlElement(t, positions, 0xF7).uint(); track != 1 {
+			t.Errorf("cue at %d ms is for track %d, want the video track", cueTime, track)
+		}
+
+		cluster := f.elementAt(t, findEbmlElement(t, positions, 0xF1).uint())
+		if cluster.id != 0x1F43B675 || findEbmlElement(t, cluster.children(t), 0xE7).uint() != cueTime {
+			t.Errorf("cue at %d ms does not point at a cluster starting at that time", cueTime)
+		}
+	}
+
+	if wantCues := []uint64{0, 6000, 45000}; !slices.Equal(cueTimes, wantCues) {
+		t.Fatalf("got cue times %v, want %v", cueTimes, wantCues)
+	}
+}
+
+func TestMatroskaMuxerAudioOnly(t *testing.T) {
+	file := &memoryFile{}
+
+	m, err := newMatroskaMuxer(file, testRecordingTracks(t, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []testSample
+	for i := 0; i < 600; i++ {
+		samples = append(samples, testSample{0, int64(i) * 20000, true, []byte{byte(i)}})
+	}
+
+	writeTestSamples(t, m, samples)
+
+	f := parseMatroska(t, file.data)
+
+	if len(f.blocks) != len(samples) {
+		t.Fatalf("got %d blocks, want %d", len(f.blocks), len(samples))
+	}
+
+	if wantClusters := []uint64{0, 5000, 10000}; !slices.Equal(f.clusterTimes, wantClusters) {
+		t.Fatalf("got cluster times %v, want %v", f.clusterTimes, wantClusters)
+	}
+
+	cues := findEbmlElements(f.children[len(f.children)-1].children(t), 0xBB)
+	if len(cues) != len(f.clusterTimes) {
+		t.Fatalf("got %d cue points, want one per cluster", len(cues))
+	}
+}
+
+func TestMatroskaMuxerStream(t *testing.T) {
+	var b bytes.Buffer
+
+	m, err := newMatroskaMuxer(&b, testRecordingTracks(t, true, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestSamples(t, m, matroskaTestSamples)
+
+	f := parseMatroska(t, b.Bytes())
+
+	if !bytes.Equal(b.Bytes()[f.segment.start-8:f.segment.start], []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Fatal("expected an unknown segment size")
+	}
+
+	if f.children[0].id != 0xEC {
+		t.Fatalf("got %x as the first segment child, want a void element", f.children[0].id)
+	}
+
+	if last := f.children[len(f.children)-1]; last.id != 0x1C53BB6B {
+		t.Fatalf("got %x as the last segment child, want cues", last.id)
+	}
+
+	if len(f.blocks) != len(matroskaTestSamples) {
+		t.Fatalf("got %d blocks, want %d", len(f.blocks), len(matroskaTestSamples))
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type metricHistogram struct {
+	mutex  sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *metricHistogram) observe(d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]uint64, len(metricBuckets))
+	}
+
+	v := d.Seconds()
+
+	for i, bucket := range metricBuckets {
+		if v <= bucket {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+func (h *metricHistogram) write(w io.Writer, name string, labels string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bucket := range metricBuckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bucket, 'g', -1, 64), count)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+var metricCommandNames = map[string]struct{}{
+	"connect": {}, "disconnect": {}, "startscrcpyserver": {}, "stopscrcpyserver": {}, "status": {},
+	"useprofile": {}, "reloadconfig": {}, "uhidinput": {}, "key": {}, "key2": {}, "key3": {}, "key4": {},
+	"keydown": {}, "keyup": {}, "type": {}, "touch": {}, "touchdown": {}, "touchup": {}, "touchmove": {},
+	"mouseclick": {}, "mousedown": {}, "mouseup": {}, "mousemove": {}, "scrollleft": {}, "scrollright": {},
+	"scrollup": {}, "scrolldown": {}, "openhardkeyboardsettings": {}, "backorscreenon": {},
+	"expandnotificationspanel": {}, "expandsettingspanel": {}, "collapsepanels": {}, "getclipboard": {},
+	"getclipboardcut": {}, "setclipboard": {}, "setclipboardpaste": {}, "clipboard": {}, "clipboardcut": {},
+	"list": {}, "turnscreenon": {}, "turnscreenoff": {}, "rotate": {}, "startapp": {}, "resetvideo": {},
+	"senddata": {}, "startrecording": {}, "stoprecording": {}, "savereplay": {}, "screenshot": {}, "sleep": {},
+	"adb": {}, "adb2": {}, "setconnectedcommands": {},
+}
+
+type commandMetricKey struct {
+	device    string
+	command   string
+	transport string
+}
+
+var commandMetrics = struct {
+	mutex    sync.Mutex
+	executed map[commandMetricKey]uint64
+	failed   map[commandMetricKey]uint64
+}{
+	executed: map[commandMetricKey]uint64{},
+	failed:   map[commandMetricKey]uint64{},
+}
+
+func countCommand(device string, command string, transport string, err error) {
+	key := commandMetricKey{device: device, command: metricCommandName(command), transport: transport}
+
+	commandMetrics.mutex.Lock()
+	defer commandMetrics.mutex.Unlock()
+
+	if err != nil {
+		commandMetrics.failed[key]++
+	} else {
+		commandMetrics.executed[key]++
+	}
+}
+
+func metricCommandName(name string) string {
+	if _, ok := metricCommandNames[name]; ok {
+		return name
+	}
+
+	if _, ok := customCommand(name); ok {
+		return name
+	}
+
+	if strings.HasPrefix(name, "@") && sessions[name[1:]] != nil {
+		return name
+	}
+
+	return "unknown"
+}
+
+type timedConn struct {
+	net.Conn
+	latency *metricHistogram
+}
+
+func (c *timedConn) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.Conn.Write(p)
+	c.latency.observe(time.Since(start))
+
+	return n, err
+}
+
+func (s *Session) countDecodedFrame() {
+	now := time.Now()
+
+	if s.decodeRateStart.IsZero() {
+		s.decodeRateStart = now
+		s.decodeRateSequence = s.videoFrameSequence
+		return
+	}
+
+	elapsed := now.Sub(s.decodeRateStart)
+	if elapsed >= time.Second {
+		s.decodeRate = float64(s.videoFrameSequence-s.decodeRateSequence) / elapsed.Seconds()
+		s.decodeRateStart = now
+		s.decodeRateSequence = s.videoFrameSequence
+	}
+}
+
+func metricLabels(pairs ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, 0, len(pairs)/2)
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", pairs[i], escaper.Replace(pairs[i+1])))
+	}
+
+	return strings.Join(labels, ",")
+}
+
+func metricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeCommandMetrics(w io.Writer, name string, help string, values map[commandMetricKey]uint64) {
+	metricHeader(w, name, "counter", help)
+
+	keys := make([]commandMetricKey, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, func(a commandMetricKey, b commandMetricKey) int {
+		return cmp.Or(strings.Compare(a.device, b.device), strings.Compare(a.command, b.command), strings.Compare(a.transport, b.transport))
+	})
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, metricLabels("device", key.device, "command", key.command, "transport", key.transport), values[key])
+	}
+}
+
+func (b *PacketBroadcaster) metrics() (packets uint64, received uint64, subscribers int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.packets, b.bytes, len(b.subscribers)
+}
+
+func (b *EventBus) metrics() (subscribers int, dropped uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.subscribers), b.dropped
+}
+
+func writeMetrics(w io.Writer) {
+	commandMetrics.mutex.Lock()
+	writeCommandMetrics(w, "hsc_commands_executed_total", "Commands executed successfully.", commandMetrics.executed)
+	writeCommandMetrics(w, "hsc_commands_failed_total", "Commands that returned an error.", commandMetrics.failed)
+	commandMetrics.mutex.Unlock()
+
+	names := sortedKeys(sessions)
+
+	metricHeader(w, "hsc_connected", "gauge", "Whether the device is connected.")
+	for _, name := range names {
+		s := sessions[name]
+
+		s.connectedMutex.Lock()
+		connected := 0
+		if s.connected {
+			connected = 1
+		}
+		s.connectedMutex.Unlock()
+
+		fmt.Fprintf(w, "hsc_connected{%s} %d\n", metricLabels("device", name), connected)
+	}
+
+	metricHeader(w, "hsc_reconnects_total", "counter", "Times the connection to the device was lost and reestablishment started.")
+	for _, name := range names {
+		s := sessions[name]
+
+		s.stateMutex.Lock()
+		reconnects := s.reconnects
+		s.stateMutex.Unlock()
+
+		fmt.Fprintf(w, "hsc_reconnects_total{%s} %d\n", metricLabels("device", name), reconnects)
+	}
+
+	var packets, received, subscribers, dropped bytes.Buffer
+
+	metricHeader(&packets, "hsc_packets_received_total", "counter", "Stream packets received from the scrcpy server.")
+	metricHeader(&received, "hsc_received_bytes_total", "counter", "Stream bytes received from the scrcpy server, including packet headers.")
+	metricHeader(&subscribers, "hsc_stream_subscribers", "gauge", "Active stream subscribers.")
+	metricHeader(&dropped, "hsc_event_subscribers_dropped_total", "counter", "Event subscribers dropped because their buffer was full.")
+
+	for _, name := range names {
+		s := sessions[name]
+
+		for _, stream := range []struct {
+			name        string
+			broadcaster *PacketBroadcaster
+		}{{"video", &s.video}, {"audio", &s.audio}} {
+			p, b, n := stream.broadcaster.metrics()
+			labels := metricLabels("device", name, "stream", stream.name)
+
+			fmt.Fprintf(&packets, "hsc_packets_received_total{%s} %d\n", labels, p)
+			fmt.Fprintf(&received, "hsc_received_bytes_total{%s} %d\n", labels, b)
+			fmt.Fprintf(&subscribers, "hsc_stream_subscribers{%s} %d\n", labels, n)
+		}
+
+		n, d := s.events.metrics()
+		fmt.Fprintf(&subscribers, "hsc_stream_subscribers{%s} %d\n", metricLabels("device", name, "stream", "events"), n)
+		fmt.Fprintf(&dropped, "hsc_event_subscribers_dropped_total{%s} %d\n", metricLabels("device", name), d)
+	}
+
+	packets.WriteTo(w)
+	received.WriteTo(w)
+	subscribers.WriteTo(w)
+	dropped.WriteTo(w)
+
+	var width, height, rate bytes.Buffer
+
+	metricHeader(&width, "hsc_video_frame_width", "gauge", "Width of the current decoded video frame in pixels.")
+	metricHeader(&height, "hsc_video_frame_height", "gauge", "Height of the current decoded video frame in pixels.")
+	metricHeader(&rate, "hsc_decode_frames_per_second", "gauge", "Decoded video frames per second.")
+
+	for _, name := range names {
+		s := sessions[name]
+		labels := metricLabels("device", name)
+
+		s.videoFrameMutex.RLock()
+		decodeRate := s.decodeRate
+		if time.Since(s.decodeRateStart) > 2*time.Second {
+			decodeRate = 0
+		}
+
+		fmt.Fprintf(&width, "hsc_video_frame_width{%s} %d\n", labels, s.videoFrameWidth)
+		fmt.Fprintf(&height, "hsc_video_frame_height{%s} %d\n", labels, s.videoFrameHeight)
+		fmt.Fprintf(&rate, "hsc_decode_frames_per_second{%s} %s\n", labels, strconv.FormatFloat(decodeRate, 'g', -1, 64))
+		s.videoFrameMutex.RUnlock()
+	}
+
+	width.WriteTo(w)
+	height.WriteTo(w)
+	rate.WriteTo(w)
+
+	metricHeader(w, "hsc_control_write_duration_seconds", "histogram", "Time taken to write control messages to the scrcpy server.")
+	for _, name := range names {
+		sessions[name].controlWriteLatency.write(w, "hsc_control_write_duration_seconds", metricLabels("device", name))
+	}
+
+	metricHeader(w, "hsc_clipboard_round_trip_seconds", "histogram", "Time from sending a clipboard to the device until it is acknowledged.")
+	for _, name := range names {
+		sessions[name].clipboardRoundTrip.write(w, "hsc_clipboard_round_trip_seconds", metricLabels("device", name))
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, GET")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodGet:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		var b bytes.Buffer
+		writeMetrics(&b)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		b.WriteTo(w)
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const mjpegBoundary = "mjpegframe"
+
+func mjpegHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, GET")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodGet:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		device := s.device()
+
+		fps := device.VideoDecoder.MjpegMaxFps
+		quality := device.VideoDecoder.MjpegQuality
+		maxWidth := device.VideoDecoder.MjpegMaxWidth
+		maxHeight := device.VideoDecoder.MjpegMaxHeight
+
+		query := req.URL.Query()
+
+		for _, parameter := range []struct {
+			name  string
+			value *int
+			limit int
+		}{
+			{"fps", &fps, device.VideoDecoder.MjpegMaxFps},
+			{"quality", &quality, 100},
+			{"width", &maxWidth, device.VideoDecoder.MjpegMaxWidth},
+			{"height", &maxHeight, device.VideoDecoder.MjpegMaxHeight},
+		} {
+			if query.Get(parameter.name) == "" {
+				continue
+			}
+
+			v, err := strconv.Atoi(query.Get(parameter.name))
+			if err != nil || v <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if parameter.limit > 0 {
+				v = min(v, parameter.limit)
+			}
+
+			*parameter.value = v
+		}
+
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+		w.Header().Set("Device-Name", s.deviceName)
+
+		flusher := w.(http.Flusher)
+		flusher.Flush()
+
+		ticker := time.NewTicker(time.Second / time.Duration(fps))
+		defer ticker.Stop()
+
+		var sequence uint64
+		var buffer bytes.Buffer
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-req.Context().Done():
+				return
+			}
+
+			s.videoFrameMutex.RLock()
+			currentSequence := s.videoFrameSequence
+			width := s.videoFrameWidth
+			height := s.videoFrameHeight
+			s.videoFrameMutex.RUnlock()
+
+			if currentSequence == sequence || width == 0 || height == 0 {
+				continue
+			}
+
+			sequence = currentSequence
+
+			options := screenshotOptions{quality: quality, scale: 1}
+
+			if maxWidth > 0 && width > maxWidth {
+				options.scale = min(options.scale, float64(maxWidth)/float64(width))
+			}
+
+			if maxHeight > 0 && height > maxHeight {
+				options.scale = min(options.scale, float64(maxHeight)/float64(height))
+			}
+
+			img, err := s.screenshot(options)
+			if err != nil {
+				continue
+			}
+
+			buffer.Reset()
+
+			err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality})
+			if err != nil {
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, buffer.Len())
+			if err != nil {
+				return
+			}
+
+			_, err = w.Write(append(buffer.Bytes(), '\r', '\n'))
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const mp4AudioFragmentDuration = 48000
+
+type mp4Sample struct {
+	data     []byte
+	duration uint32
+	flags    uint32
+}
+
+type mp4PendingSample struct {
+	timestamp int64
+	keyFrame  bool
+	data      []byte
+}
+
+type mp4Muxer struct {
+	w            io.Writer
+	tracks       []*recordingTrack
+	videoTrack   int
+	timescales   []uint64
+	decodeTimes  []uint64
+	pending      []*mp4PendingSample
+	samples      [][]mp4Sample
+	lastDuration []uint32
+	sequence     uint32
+}
+
+var mp4Matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], boxType)
+
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	return mp4Box(boxType, append([][]byte{{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}}, payload...)...)
+}
+
+func mp4Uint32s(values ...uint32) []byte {
+	data := make([]byte, 0, 4*len(values))
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+
+	return data
+}
+
+func mp4Descriptor(tag byte, payload ...[]byte) []byte {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	descriptor := []byte{tag, 0x80 | byte(size>>21&0x7F), 0x80 | byte(size>>14&0x7F), 0x80 | byte(size>>7&0x7F), byte(size & 0x7F)}
+	for _, p := range payload {
+		descriptor = append(descriptor, p...)
+	}
+
+	return descriptor
+}
+
+func mp4SampleEntry(t *recordingTrack) []byte {
+	if t.video {
+		var boxType, configType string
+
+		switch t.codec {
+		case ScrcpyCodecs.H264:
+			boxType, configType = "avc1", "avcC"
+		case ScrcpyCodecs.H265:
+			boxType, configType = "hvc1", "hvcC"
+		case ScrcpyCodecs.Av1:
+			boxType, configType = "av01", "av1C"
+		}
+
+		entry := make([]byte, 78)
+		binary.BigEndian.PutUint16(entry[6:], 1)
+		binary.BigEndian.PutUint16(entry[24:], uint16(t.width))
+		binary.BigEndian.PutUint16(entry[26:], uint16(t.height))
+		binary.BigEndian.PutUint32(entry[28:], 0x00480000)
+		binary.BigEndian.PutUint32(entry[32:], 0x00480000)
+		binary.BigEndian.PutUint16(entry[40:], 1)
+		binary.BigEndian.PutUint16(entry[74:], 0x0018)
+		binary.BigEndian.PutUint16(entry[76:], 0xFFFF)
+
+		return mp4Box(boxType, entry, mp4Box(configType, t.codecConfig))
+	}
+
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[6:], 1)
+	binary.BigEndian.PutUint16(entry[16:], 2)
+	binary.BigEndian.PutUint16(entry[18:], 16)
+	binary.BigEndian.PutUint32(entry[24:], 48000<<16)
+
+	switch t.codec {
+	case ScrcpyCodecs.Opus:
+		head := t.codecConfig
+		dops := []byte{0, head[9]}
+		dops = binary.BigEndian.AppendUint16(dops, binary.LittleEndian.Uint16(head[10:]))
+		dops = binary.BigEndian.AppendUint32(dops, binary.LittleEndian.Uint32(head[12:]))
+		dops = binary.BigEndian.AppendUint16(dops, binary.LittleEndian.Uint16(head[16:]))
+		dops = append(dops, head[18:]...)
+
+		return mp4Box("Opus", entry, mp4Box("dOps", dops))
+	case ScrcpyCodecs.Aac:
+		esds := mp4Descriptor(
+			0x03,
+			[]byte{0, 0, 0},
+			mp4Descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, mp4Descriptor(0x05, t.codecConfig)),
+			mp4Descriptor(0x06, []byte{0x02}),
+		)
+
+		return mp4Box("mp4a", entry, mp4FullBox("esds", 0, 0, esds))
+	default:
+		return mp4Box("fLaC", entry, mp4FullBox("dfLa", 0, 0, []byte{0x80, 0, 0, 34}, t.codecConfig))
+	}
+}
+
+func newMp4Muxer(w io.Writer, tracks []*recordingTrack) (*mp4Muxer, error) {
+	m := &mp4Muxer{
+		w:            w,
+		tracks:       tracks,
+		videoTrack:   -1,
+		timescales:   make([]uint64, len(tracks)),
+		decodeTimes:  make([]uint64, len(tracks)),
+		pending:      make([]*mp4PendingSample, len(tracks)),
+		samples:      make([][]mp4Sample, len(tracks)),
+		lastDuration: make([]uint32, len(tracks)),
+	}
+
+	brands := []byte("isomiso6mp41")
+	var traks, trexs [][]byte
+
+	for i, t := range tracks {
+		id := uint32(i + 1)
+		tkhd := mp4Uint32s(0, 0, id, 0, 0, 0, 0)
+
+		var mediaHeader, handler []byte
+
+		if t.video {
+			m.videoTrack = i
+			m.timescales[i] = 1000000
+
+			if t.codec == ScrcpyCodecs.Av1 {
+				brands = append(brands, "av01"...)
+			}
+
+			tkhd = append(tkhd, 0, 0, 0, 0, 0, 0, 0, 0)
+			tkhd = append(tkhd, mp4Uint32s(mp4Matrix...)...)
+			tkhd = append(tkhd, mp4Uint32s(uint32(t.width)<<16, uint32(t.height)<<16)...)
+			mediaHeader = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+			handler = mp4FullBox("hdlr", 0, 0, mp4Uint32s(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+		} else {
+			if t.codec == ScrcpyCodecs.Raw {
+				return nil, errors.New("raw audio cannot be recorded to mp4")
+			}
+
+			m.timescales[i] = 48000
+
+			tkhd = append(tkhd, 0, 0, 0, 0, 0x01, 0x00, 0, 0)
+			tkhd = append(tkhd, mp4Uint32s(mp4Matrix...)...)
+			tkhd = append(tkhd, mp4Uint32s(0, 0)...)
+			mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+			handler = mp4FullBox("hdlr", 0, 0, mp4Uint32s(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+		}
+
+		traks = append(traks, mp4Box(
+			"trak",
+			mp4FullBox("tkhd", 0, 3, tkhd),
+			mp4Box(
+				"mdia",
+				mp4FullBox("mdhd", 0, 0, mp4Uint32s(0, 0, uint32(m.timescales[i]), 0), []byte{0x55, 0xC4, 0, 0}),
+				handler,
+				mp4Box(
+					"minf",
+					mediaHeader,
+					mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32s(1), mp4FullBox("url ", 0, 1))),
+					mp4Box(
+						"stbl",
+						mp4FullBox("stsd", 0, 0, mp4Uint32s(1), mp4SampleEntry(t)),
+						mp4FullBox("stts", 0, 0, mp4Uint32s(0)),
+						mp4FullBox("stsc", 0, 0, mp4Uint32s(0)),
+						mp4FullBox("stsz", 0, 0, mp4Uint32s(0, 0)),
+						mp4FullBox("stco", 0, 0, mp4Uint32s(0)),
+					),
+				),
+			),
+		))
+
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4Uint32s(id, 1, 0, 0, 0)))
+	}
+
+	mvhd := mp4Uint32s(0, 0, 1000, 0, 0x00010000)
+	mvhd = append(mvhd, 0x01, 0x00)
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, mp4Uint32s(mp4Matrix...)...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = append(mvhd, mp4Uint32s(uint32(len(tracks)+1))...)
+
+	moov := mp4Box("moov", append(append([][]byte{mp4FullBox("mvhd", 0, 0, mvhd)}, traks...), mp4Box("mvex", trexs...))...)
+	ftyp := mp4Box("ftyp", []byte("isom"), mp4Uint32s(0x200), brands)
+
+	return m, m.write(append(ftyp, moov...))
+}
+
+func (m *mp4Muxer) write(data []byte) error {
+	n, err := m.w.Write(data)
+	if err != nil {
+		return err
+	}
+	if n < len(data) {
+		return io.ErrShortWrite
+	}
+
+	return nil
+}
+
+func (m *mp4Muxer) scale(track int, timestamp int64) uint64 {
+	return uint64(timestamp) * m.timescales[track] / 1000000
+}
+
+func (m *mp4Muxer) sampleFlags(track int, keyFrame bool) uint32 {
+	if track != m.videoTrack || keyFrame {
+		return 0x02000000
+	}
+
+	return 0x01010000
+}
+
+func (m *mp4Muxer) writeSample(track int, timestamp int64, keyFrame bool, data []byte) error {
+	pending := m.pending[track]
+
+	if pending == nil {
+		m.decodeTimes[track] = m.scale(track, timestamp)
+	} else {
+		var duration uint32
+		if timestamp > pending.timestamp {
+			duration = uint32(m.scale(track, timestamp) - m.scale(track, pending.timestamp))
+		}
+
+		m.samples[track] = append(m.samples[track], mp4Sample{
+			data:     pending.data,
+			duration: duration,
+			flags:    m.sampleFlags(track, pending.keyFrame),
+		})
+		m.lastDuration[track] = duration
+	}
+
+	var flush bool
+	if m.videoTrack >= 0 {
+		flush = track == m.videoTrack && keyFrame
+	} else {
+		var duration uint64
+		for _, sample := range m.samples[track] {
+			duration += uint64(sample.duration)
+		}
+
+		flush = duration >= mp4AudioFragmentDuration
+	}
+
+	if flush {
+		err := m.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	m.pending[track] = &mp4PendingSample{timestamp: timestamp, keyFrame: keyFrame, data: data}
+	return nil
+}
+
+func (m *mp4Muxer) fragment(dataOffsets []uint32) []byte {
+	trafs := [][]byte{mp4FullBox("mfhd", 0, 0, mp4Uint32s(m.sequence))}
+
+	for i, samples := range m.samples {
+		if len(samples) == 0 {
+			continue
+		}
+
+		trun := mp4Uint32s(uint32(len(samples)), dataOffsets[i])
+		for _, sample := range samples {
+			trun = append(trun, mp4Uint32s(sample.duration, uint32(len(sample.data)), sample.flags)...)
+		}
+
+		trafs = append(trafs, mp4Box(
+			"traf",
+			mp4FullBox("tfhd", 0, 0x020000, mp4Uint32s(uint32(i+1))),
+			mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, m.decodeTimes[i])),
+			mp4FullBox("trun", 0, 0x000701, trun),
+		))
+	}
+
+	return mp4Box("moof", trafs...)
+}
+
+func (m *mp4Muxer) flush() error {
+	var size int
+	for _, samples := range m.samples {
+		for _, sample := range samples {
+			size += len(sample.data)
+		}
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	m.sequence++
+
+	dataOffsets := make([]uint32, len(m.samples))
+	moofSize := len(m.fragment(dataOffsets))
+	offset := uint32(moofSize + 8)
+
+	mdat := make([]byte, 8, 8+size)
+	binary.BigEndian.PutUint32(mdat, uint32(8+size))
+	copy(mdat[4:], "mdat")
+
+	for i, samples := range m.samples {
+		dataOffsets[i] = offset
+
+		for _, sample := range samples {
+			mdat = append(mdat, sample.data...)
+			offset += uint32(len(sample.data))
+		}
+	}
+
+	moof := m.fragment(dataOffsets)
+
+	for i, samples := range m.samples {
+		for _, sample := range samples {
+			m.decodeTimes[i] += uint64(sample.duration)
+		}
+
+		m.samples[i] = nil
+	}
+
+	return m.write(append(moof, mdat...))
+}
+
+func (m *mp4Muxer) close() error {
+	for i, pending := range m.pending {
+		if pending == nil {
+			continue
+		}
+
+		duration := m.lastDuration[i]
+		if duration == 0 {
+			duration = uint32(m.timescales[i] / 50)
+		}
+
+		m.samples[i] = append(m.samples[i], mp4Sample{
+			data:     pending.data,
+			duration: duration,
+			flags:    m.sampleFlags(i, pending.keyFrame),
+		})
+		m.pending[i] = nil
+	}
+
+	return m.flush()
+}
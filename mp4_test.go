@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+type mp4TestBox struct {
+	boxType string
+	offset  int
+	data    []byte
+}
+
+var mp4ContainerBoxes = map[string]int{"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "mvex": 0, "moof": 0, "traf": 0, "stsd": 8, "avc1": 78, "Opus": 28}
+
+func readMp4Boxes(t *testing.T, data []byte, base int) []mp4TestBox {
+	t.Helper()
+
+	var boxes []mp4TestBox
+
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			t.Fatalf("truncated box header at %d", base+pos)
+		}
+
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 8 || pos+size > len(data) {
+			t.Fatalf("box %q at %d has invalid size %d", data[pos+4:pos+8], base+pos, size)
+		}
+
+		boxes = append(boxes, mp4TestBox{boxType: string(data[pos+4 : pos+8]), offset: base + pos, data: data[pos+8 : pos+size]})
+		pos += size
+	}
+
+	return boxes
+}
+
+func (b mp4TestBox) children(t *testing.T) []mp4TestBox {
+	t.Helper()
+
+	skip, ok := mp4ContainerBoxes[b.boxType]
+	if !ok {
+		t.Fatalf("%s is not a container box", b.boxType)
+	}
+
+	return readMp4Boxes(t, b.data[skip:], b.offset+8+skip)
+}
+
+func findMp4Boxes(boxes []mp4TestBox, boxType string) []mp4TestBox {
+	var found []mp4TestBox
+	for _, b := range boxes {
+		if b.boxType == boxType {
+			found = append(found, b)
+		}
+	}
+
+	return found
+}
+
+func findMp4Box(t *testing.T, boxes []mp4TestBox, path ...string) mp4TestBox {
+	t.Helper()
+
+	for i, boxType := range path {
+		found := findMp4Boxes(boxes, boxType)
+		if len(found) != 1 {
+			t.Fatalf("found %d %s boxes, want 1", len(found), boxType)
+		}
+
+		if i == len(path)-1 {
+			return found[0]
+		}
+
+		boxes = found[0].children(t)
+	}
+
+	return mp4TestBox{}
+}
+
+type mp4TestSample struct {
+	data     []byte
+	duration uint32
+	flags    uint32
+}
+
+type mp4TestFile struct {
+	moov        mp4TestBox
+	fragments   int
+	samples     map[uint32][]mp4TestSample
+	decodeTimes map[uint32][]uint64
+}
+
+func parseMp4(t *testing.T, data []byte) mp4TestFile {
+	t.Helper()
+
+	boxes := readMp4Boxes(t, data, 0)
+	if len(boxes) < 2 || boxes[0].boxType != "ftyp" || boxes[1].boxType != "moov" {
+		t.Fatalf("expected ftyp and moov first, got %v", boxes)
+	}
+
+	f := mp4TestFile{moov: boxes[1], samples: map[uint32][]mp4TestSample{}, decodeTimes: map[uint32][]uint64{}}
+	next := map[uint32]uint64{}
+
+	for i := 2; i < len(boxes); i += 2 {
+		moof := boxes[i]
+		if moof.boxType != "moof" || i+1 >= len(boxes) || boxes[i+1].boxType != "mdat" {
+			t.Fatalf("expected moof and mdat pairs after moov, got %s at %d", moof.boxType, moof.offset)
+		}
+
+		mdat := boxes[i+1]
+		f.fragments++
+
+		children := moof.children(t)
+		if sequence := binary.BigEndian.Uint32(findMp4Box(t, children, "mfhd").data[4:]); sequence != uint32(f.fragments) {
+			t.Fatalf("fragment %d has sequence number %d", f.fragments, sequence)
+		}
+
+		var used int
+
+		for _, traf := range findMp4Boxes(children, "traf") {
+			trafChildren := traf.children(t)
+			track := binary.BigEndian.Uint32(findMp4Box(t, trafChildren, "tfhd").data[4:])
+			decodeTime := binary.BigEndian.Uint64(findMp4Box(t, trafChildren, "tfdt").data[4:])
+
+			if known, ok := next[track]; ok && decodeTime != known {
+				t.Fatalf("track %d fragment %d starts at %d, want %d", track, f.fragments, decodeTime, known)
+			}
+
+			f.decodeTimes[track] = append(f.decodeTimes[track], decodeTime)
+
+			trun := findMp4Box(t, trafChildren, "trun").data
+			if flags := binary.BigEndian.Uint32(trun) & 0xFFFFFF; flags != 0x000701 {
+				t.Fatalf("got trun flags %06x, want 000701", flags)
+			}
+
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			offset := moof.offset + int(binary.BigEndian.Uint32(trun[8:]))
+
+			for j := 0; j < count; j++ {
+				entry := trun[12+12*j:]
+				duration := binary.BigEndian.Uint32(entry)
+				size := int(binary.BigEndian.Uint32(entry[4:]))
+
+				if offset < mdat.offset+8 || offset+size > mdat.offset+8+len(mdat.data) {
+					t.Fatalf("track %d sample %d is outside of its mdat", track, j)
+				}
+
+				f.samples[track] = append(f.samples[track], mp4TestSample{
+					data:     data[offset : offset+size],
+					duration: duration,
+					flags:    binary.BigEndian.Uint32(entry[8:]),
+				})
+
+				offset += size
+				used += size
+				decodeTime += uint64(duration)
+			}
+
+			next[track] = decodeTime
+		}
+
+		if used != len(mdat.data) {
+			t.Fatalf("fragment %d references %d of %d mdat bytes", f.fragments, used, len(mdat.data))
+		}
+	}
+
+	return f
+}
+
+func TestMp4Muxer(t *testing.T) {
+	tracks := testRecordingTracks(t, true, true)
+
+	var b bytes.Buffer
+
+	m, err := newMp4Muxer(&b, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := []testSample{
+		{0, 0, true, []byte{0, 0xAA}},
+		{1, 0, true, []byte{1, 0xBB}},
+		{1, 20000, true, []byte{2, 0xBB}},
+		{0, 33333, false, []byte{3, 0xAA}},
+		{1, 40000, true, []byte{4, 0xBB}},
+		{0, 66666, false, []byte{5, 0xAA}},
+		{1, 60000, true, []byte{6, 0xBB}},
+		{1, 80000, true, []byte{7, 0xBB}},
+		{0, 100000, true, []byte{8, 0xAA}},
+		{1, 100000, true, []byte{9, 0xBB}},
+		{0, 133333, false, []byte{10, 0xAA}},
+	}
+
+	writeTestSamples(t, m, samples)
+
+	f := parseMp4(t, b.Bytes())
+
+	traks := findMp4Boxes(f.moov.children(t), "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d tracks, want 2", len(traks))
+	}
+
+	for i, want := range []struct {
+		handler   string
+		timescale uint32
+		entry     string
+		config    string
+	}{
+		{"vide", 1000000, "avc1", "avcC"},
+		{"soun", 48000, "Opus", "dOps"},
+	} {
+		children := traks[i].children(t)
+
+		if id := binary.BigEndian.Uint32(findMp4Box(t, children, "tkhd").data[12:]); id != uint32(i+1) {
+			t.Errorf("track %d has id %d", i+1, id)
+		}
+
+		if handler := string(findMp4Box(t, children, "mdia", "hdlr").data[8:12]); handler != want.handler {
+			t.Errorf("track %d has handler %s, want %s", i+1, handler, want.handler)
+		}
+
+		if timescale := binary.BigEndian.Uint32(findMp4Box(t, children, "mdia", "mdhd").data[12:]); timescale != want.timescale {
+			t.Errorf("track %d has timescale %d, want %d", i+1, timescale, want.timescale)
+		}
+
+		config := findMp4Box(t, children, "mdia", "minf", "stbl", "stsd", want.entry, want.config)
+		if want.config == "avcC" && !bytes.Equal(config.data, tracks[i].codecConfig) {
+			t.Errorf("got avcC %x, want %x", config.data, tracks[i].codecConfig)
+		}
+	}
+
+	if f.fragments != 2 {
+		t.Fatalf("got %d fragments, want 2", f.fragments)
+	}
+
+	for track, want := range map[uint32][]uint32{1: {33333, 33333, 33334, 33333, 33333}, 2: {960, 960, 960, 960, 960, 960}} {
+		var durations []uint32
+		for _, sample := range f.samples[track] {
+			durations = append(durations, sample.duration)
+		}
+
+		if !slices.Equal(durations, want) {
+			t.Errorf("track %d has durations %v, want %v", track, durations, want)
+		}
+
+		if f.decodeTimes[track][0] != 0 {
+			t.Errorf("track %d starts at %d, want 0", track, f.decodeTimes[track][0])
+		}
+	}
+
+	var index [2]int
+
+	for _, sample := range samples {
+		track := uint32(sample.track + 1)
+		got := f.samples[track][index[sample.track]]
+		index[sample.track]++
+
+		if !bytes.Equal(got.data, sample.data) {
+			t.Errorf("track %d sample has data %x, want %x", track, got.data, sample.data)
+		}
+
+		wantFlags := uint32(0x02000000)
+		if sample.track == 0 && !sample.keyFrame {
+			wantFlags = 0x01010000
+		}
+
+		if got.flags != wantFlags {
+			t.Errorf("track %d sample %x has flags %08x, want %08x", track, sample.data, got.flags, wantFlags)
+		}
+	}
+}
+
+func TestMp4MuxerAudioOnly(t *testing.T) {
+	var b bytes.Buffer
+
+	m, err := newMp4Muxer(&b, testRecordingTracks(t, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []testSample
+	for i := 0; i < 60; i++ {
+		samples = append(samples, testSample{0, int64(i) * 20000, true, []byte{byte(i)}})
+	}
+
+	writeTestSamples(t, m, samples)
+
+	f := parseMp4(t, b.Bytes())
+
+	if f.fragments != 2 {
+		t.Fatalf("got %d fragments, want 2", f.fragments)
+	}
+
+	if want := []uint64{0, 48000}; !slices.Equal(f.decodeTimes[1], want) {
+		t.Fatalf("got fragment decode times %v, want %v", f.decodeTimes[1], want)
+	}
+
+	if len(f.samples[1]) != len(samples) {
+		t.Fatalf("got %d samples, want %d", len(f.samples[1]), len(samples))
+	}
+
+	for i, sample := range f.samples[1] {
+		if !bytes.Equal(sample.data, samples[i].data) || sample.duration != 960 {
+			t.Fatalf("sample %d is %+v, want data %x lasting 960", i, sample, samples[i].data)
+		}
+	}
+}
+
+func TestMp4MuxerRawAudio(t *testing.T) {
+	_, err := newMp4Muxer(&bytes.Buffer{}, []*recordingTrack{{codec: ScrcpyCodecs.Raw}})
+	if err == nil {
+		t.Fatal("expected an error for raw audio")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type configOverride struct {
+	source string
+	path   string
+	value  string
+	enable bool
+}
+
+var version = "dev"
+var configOverrides []configOverride
+
+func configEnvName(path string) string {
+	var b strings.Builder
+	b.WriteString("HSC_")
+
+	previous := rune(0)
+	for _, r := range path {
+		if r == '.' {
+			b.WriteByte('_')
+		} else {
+			if unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)) {
+				b.WriteByte('_')
+			}
+
+			b.WriteRune(unicode.ToUpper(r))
+		}
+
+		previous = r
+	}
+
+	return b.String()
+}
+
+func configEnvPaths(prefix string, t reflect.Type, paths map[string]string) {
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := configPath(prefix, name)
+		fieldType := t.Field(i).Type
+
+		if fieldType.Kind() == reflect.Struct {
+			configEnvPaths(path, fieldType, paths)
+		} else if fieldType.Kind() != reflect.Map {
+			paths[configEnvName(path)] = path
+		}
+	}
+}
+
+func envConfigOverrides(environ []string) ([]configOverride, []string) {
+	paths := map[string]string{}
+	configEnvPaths("", reflect.TypeOf(Config{}), paths)
+	delete(paths, "HSC_INCLUDE")
+	delete(paths, "HSC_PROFILE")
+
+	var overrides []configOverride
+	var unknown []string
+
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "HSC_") || name == "HSC_CONFIG" || name == "HSC_PROFILE" {
+			continue
+		}
+
+		path, ok := paths[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		overrides = append(overrides, configOverride{source: name, path: path, value: value})
+	}
+
+	slices.SortFunc(overrides, func(a configOverride, b configOverride) int {
+		return strings.Compare(a.source, b.source)
+	})
+	slices.Sort(unknown)
+
+	return overrides, unknown
+}
+
+func (c *Config) applyOverrides(overrides []configOverride) ConfigProblems {
+	var problems ConfigProblems
+
+	for _, override := range overrides {
+		err := setConfigField(reflect.ValueOf(c).Elem(), strings.Split(override.path, "."), override.value, override.enable)
+		if err != nil {
+			problems.add(override.path, "%s: %v", override.source, err)
+		}
+	}
+
+	return problems
+}
+
+func setConfigField(v reflect.Value, path []string, value string, enable bool) error {
+	var field reflect.Value
+
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == path[0] {
+			field = v.Field(i)
+			break
+		}
+	}
+
+	if !field.IsValid() {
+		return fmt.Errorf("unknown field %s", path[0])
+	}
+
+	if len(path) > 1 {
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s is not an object", path[0])
+		}
+
+		enabled := field.FieldByName("Enabled")
+		if enable && enabled.IsValid() && !enabled.Bool() {
+			err := json.Unmarshal([]byte("{}"), field.Addr().Interface())
+			if err != nil {
+				return err
+			}
+		}
+
+		return setConfigField(field, path[1:], value, enable)
+	}
+
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	err := json.Unmarshal([]byte(value), field.Addr().Interface())
+	if err != nil && field.Type() == reflect.TypeOf([]string{}) {
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+		return nil
+	}
+
+	return err
+}
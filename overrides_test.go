@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigEnvName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"scrcpy.video", "HSC_SCRCPY_VIDEO"},
+		{"httpServer.shutdownTimeout", "HSC_HTTP_SERVER_SHUTDOWN_TIMEOUT"},
+		{"scrcpy.retry.maxAttempts", "HSC_SCRCPY_RETRY_MAX_ATTEMPTS"},
+		{"scrcpy.stdoutVideoStreamRaw", "HSC_SCRCPY_STDOUT_VIDEO_STREAM_RAW"},
+		{"tcpJsonCommands.address", "HSC_TCP_JSON_COMMANDS_ADDRESS"},
+		{"videoDecoder.mjpeg2Fps", "HSC_VIDEO_DECODER_MJPEG2_FPS"},
+		{"log", "HSC_LOG"},
+	}
+
+	for _, test := range tests {
+		got := configEnvName(test.path)
+		if got != test.want {
+			t.Errorf("configEnvName(%q) = %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestEnvConfigOverrides(t *testing.T) {
+	overrides, unknown := envConfigOverrides([]string{
+		"PATH=/usr/bin",
+		"HSC_SCRCPY_VIDEO=false",
+		"HSC_CONFIG=config.json",
+		"HSC_PROFILE=ci",
+		"HSC_SCRCPY_VIDEOS=true",
+		"HSC_HTTP_SERVER_ADDRESS=127.0.0.1:1=2",
+		"HSC_INCLUDE=other.json",
+		"HSC_CUSTOM_COMMANDS={}",
+	})
+
+	want := []configOverride{
+		{source: "HSC_HTTP_SERVER_ADDRESS", path: "httpServer.address", value: "127.0.0.1:1=2"},
+		{source: "HSC_SCRCPY_VIDEO", path: "scrcpy.video", value: "false"},
+	}
+
+	if !slices.Equal(overrides, want) {
+		t.Errorf("got overrides %+v, want %+v", overrides, want)
+	}
+
+	wantUnknown := []string{"HSC_CUSTOM_COMMANDS", "HSC_INCLUDE", "HSC_SCRCPY_VIDEOS"}
+	if !slices.Equal(unknown, wantUnknown) {
+		t.Errorf("got unknown %v, want %v", unknown, wantUnknown)
+	}
+}
+
+func TestSetConfigField(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		value  string
+		enable bool
+		check  func(c Config) any
+		want   any
+		err    string
+	}{
+		{
+			name:  "string",
+			path:  "scrcpy.address",
+			value: "127.0.0.1:1",
+			check: func(c Config) any { return c.Scrcpy.Address },
+			want:  "127.0.0.1:1",
+		},
+		{
+			name:  "string is not json decoded",
+			path:  "scrcpy.server",
+			value: `"quoted"`,
+			check: func(c Config) any { return c.Scrcpy.Server },
+			want:  `"quoted"`,
+		},
+		{
+			name:  "int",
+			path:  "scrcpy.retry.maxAttempts",
+			value: "7",
+			check: func(c Config) any { return c.Scrcpy.Retry.MaxAttempts },
+			want:  7,
+		},
+		{
+			name:  "bool",
+			path:  "scrcpy.video",
+			value: "true",
+			check: func(c Config) any { return c.Scrcpy.Video },
+			want:  true,
+		},
+		{
+			name:  "string list as json",
+			path:  "scrcpy.serverOptions",
+			value: `["a=1", "b=2,3"]`,
+			check: func(c Config) any { return c.Scrcpy.ServerOptions },
+			want:  []string{"a=1", "b=2,3"},
+		},
+		{
+			name:  "string list separated by commas",
+			path:  "scrcpy.serverOptions",
+			value: "a=1,b=2",
+			check: func(c Config) any { return c.Scrcpy.ServerOptions },
+			want:  []string{"a=1", "b=2"},
+		},
+		{
+			name:   "enable a disabled section",
+			path:   "httpServer.address",
+			value:  "0.0.0.0:8080",
+			enable: true,
+			check:  func(c Config) any { return c.HttpServer },
+			want:   HttpServerConfig{Enabled: true, Address: "0.0.0.0:8080", ShutdownTimeout: 5000},
+		},
+		{
+			name:  "leave a disabled section disabled",
+			path:  "httpServer.address",
+			value: "0.0.0.0:8080",
+			check: func(c Config) any { return c.HttpServer },
+			want:  HttpServerConfig{Address: "0.0.0.0:8080"},
+		},
+		{
+			name:  "invalid value",
+			path:  "scrcpy.retry.maxAttempts",
+			value: "many",
+			err:   "invalid character 'm' looking for beginning of value",
+		},
+		{
+			name:  "unknown field",
+			path:  "scrcpy.vidoe",
+			value: "true",
+			err:   "unknown field vidoe",
+		},
+		{
+			name:  "not an object",
+			path:  "scrcpy.video.enabled",
+			value: "true",
+			err:   "video is not an object",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var c Config
+
+			err := setConfigField(reflect.ValueOf(&c).Elem(), strings.Split(test.path, "."), test.value, test.enable)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := test.check(c); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	c := Config{Scrcpy: ScrcpyConfig{Video: true}}
+
+	problems := c.applyOverrides([]configOverride{
+		{source: "HSC_SCRCPY_VIDEO", path: "scrcpy.video", value: "false"},
+		{source: "--http-address", path: "httpServer.address", value: "127.0.0.1:1", enable: true},
+		{source: "HSC_SCRCPY_AUDIO", path: "scrcpy.audio", value: "maybe"},
+	})
+
+	if c.Scrcpy.Video || !c.HttpServer.Enabled || c.HttpServer.Address != "127.0.0.1:1" {
+		t.Fatalf("overrides were not applied: %+v %+v", c.Scrcpy, c.HttpServer)
+	}
+
+	if len(problems) != 1 || problems[0].Path != "scrcpy.audio" || !strings.HasPrefix(problems[0].Message, "HSC_SCRCPY_AUDIO: ") {
+		t.Fatalf("got problems %v, want one for scrcpy.audio", problems)
+	}
+}
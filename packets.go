@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const packetFlagConfig = uint64(1) << 63
+const packetFlagKeyFrame = uint64(1) << 62
+const packetSubscriberBuffer = 256
+const maxGopSize = 32 << 20
+
+type Packet struct {
+	Header []byte
+	Data   []byte
+}
+
+func (p *Packet) config() bool {
+	return binary.BigEndian.Uint64(p.Header)&packetFlagConfig != 0
+}
+
+func (p *Packet) keyFrame() bool {
+	return binary.BigEndian.Uint64(p.Header)&packetFlagKeyFrame != 0
+}
+
+func (p *Packet) pts() uint64 {
+	return binary.BigEndian.Uint64(p.Header) &^ (packetFlagConfig | packetFlagKeyFrame)
+}
+
+func readPacket(r io.Reader) (*Packet, error) {
+	header := make([]byte, 12)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Packet{Header: header, Data: data}, nil
+}
+
+func readPackets(b *PacketBroadcaster, r io.Reader) {
+	generation := b.start()
+	defer b.end(generation)
+
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		b.publish(p)
+	}
+}
+
+type PacketBroadcaster struct {
+	keyFrames    bool
+	mutex        sync.Mutex
+	generation   int
+	active       bool
+	started      chan struct{}
+	subscribers  map[chan *Packet]bool
+	configPacket *Packet
+	gop          []*Packet
+	gopSize      int
+	lastPacket   time.Time
+	packets      uint64
+	bytes        uint64
+}
+
+func (b *PacketBroadcaster) start() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.generation++
+	b.active = true
+	b.configPacket = nil
+	b.gop = nil
+	b.gopSize = 0
+
+	if b.subscribers == nil {
+		b.subscribers = map[chan *Packet]bool{}
+	}
+
+	if b.started != nil {
+		close(b.started)
+		b.started = nil
+	}
+
+	return b.generation
+}
+
+func (b *PacketBroadcaster) end(generation int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.active = false
+	b.configPacket = nil
+	b.gop = nil
+	b.gopSize = 0
+
+	for c := range b.subscribers {
+		close(c)
+	}
+
+	b.subscribers = map[chan *Packet]bool{}
+}
+
+func (b *PacketBroadcaster) lastPacketTime() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.lastPacket
+}
+
+func (b *PacketBroadcaster) publish(p *Packet) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastPacket = time.Now()
+	b.packets++
+	b.bytes += uint64(len(p.Header) + len(p.Data))
+
+	if p.config() {
+		b.configPacket = p
+	} else if b.keyFrames {
+		if p.keyFrame() {
+			b.gop = []*Packet{p}
+			b.gopSize = len(p.Data)
+		} else if len(b.gop) > 0 {
+			if b.gopSize+len(p.Data) > maxGopSize {
+				b.gop = nil
+				b.gopSize = 0
+			} else {
+				b.gop = append(b.gop, p)
+				b.gopSize += len(p.Data)
+			}
+		}
+	}
+
+	for c, waitKeyFrame := range b.subscribers {
+		if waitKeyFrame {
+			if p.keyFrame() {
+				b.subscribers[c] = false
+			} else if !p.config() {
+				continue
+			}
+		}
+
+		select {
+		case c <- p:
+		default:
+			delete(b.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+func (b *PacketBroadcaster) subscribe(done <-chan struct{}) chan *Packet {
+	for {
+		b.mutex.Lock()
+
+		if b.active {
+			c := make(chan *Packet, len(b.gop)+packetSubscriberBuffer+1)
+			waitKeyFrame := b.keyFrames
+
+			if b.configPacket != nil {
+				c <- b.configPacket
+			}
+
+			for _, p := range b.gop {
+				c <- p
+				waitKeyFrame = false
+			}
+
+			b.subscribers[c] = waitKeyFrame
+			b.mutex.Unlock()
+			return c
+		}
+
+		if b.started == nil {
+			b.started = make(chan struct{})
+		}
+
+		started := b.started
+		b.mutex.Unlock()
+
+		select {
+		case <-started:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (b *PacketBroadcaster) unsubscribe(c chan *Packet) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.subscribers, c)
+}
+
+func writePacketStream(raw bool, w io.Writer, flusher http.Flusher, packets chan *Packet, done <-chan struct{}) bool {
+	var data []byte
+	var n int
+	var err error
+
+	for {
+		var p *Packet
+		var ok bool
+
+		select {
+		case p, ok = <-packets:
+			if !ok {
+				return false
+			}
+		case <-done:
+			return false
+		}
+
+		if raw {
+			data = p.Data
+		} else {
+			data = make([]byte, 12+len(p.Data))
+			copy(data[:12], p.Header)
+			copy(data[12:], p.Data)
+		}
+
+		n, err = w.Write(data)
+		if err != nil {
+			return true
+		}
+		if n < len(data) {
+			return true
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
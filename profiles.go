@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var configProfile string
+
+func includeSource(source string, include string) (string, error) {
+	if strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://") {
+		return include, nil
+	}
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		base, err := url.Parse(source)
+		if err != nil {
+			return "", err
+		}
+
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", err
+		}
+
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	if filepath.IsAbs(include) || source == "-" {
+		return include, nil
+	}
+
+	return filepath.Join(filepath.Dir(source), include), nil
+}
+
+func resolveConfigIncludes(source string, v any, chain []string) (any, error) {
+	m, ok := v.(map[string]any)
+	if !ok || m["include"] == nil {
+		return v, nil
+	}
+
+	var includes []string
+
+	switch include := m["include"].(type) {
+	case string:
+		includes = []string{include}
+	case []any:
+		for _, e := range include {
+			s, ok := e.(string)
+			if !ok {
+				return nil, ConfigProblems{{Path: "include", Message: "must be a file or URL, or a list of them"}}
+			}
+
+			includes = append(includes, s)
+		}
+	default:
+		return nil, ConfigProblems{{Path: "include", Message: "must be a file or URL, or a list of them"}}
+	}
+
+	var merged any = map[string]any{}
+
+	for _, include := range includes {
+		includeSource, err := includeSource(source, include)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", include, err)
+		}
+
+		if slices.Contains(chain, includeSource) {
+			return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), includeSource)
+		}
+
+		data, err := readConfigData(includeSource)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", includeSource, err)
+		}
+
+		included, err := decodeConfigValue(data)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", includeSource, err)
+		}
+
+		included, err = resolveConfigIncludes(includeSource, included, append(chain, includeSource))
+		if err != nil {
+			return nil, err
+		}
+
+		merged = mergeConfigValues(merged, included)
+	}
+
+	return mergeConfigValues(merged, m), nil
+}
+
+func mergeConfigValues(base any, overlay any) any {
+	baseMap, ok := base.(map[string]any)
+	if !ok {
+		return overlay
+	}
+
+	overlayMap, ok := overlay.(map[string]any)
+	if !ok {
+		return overlay
+	}
+
+	merged := make(map[string]any, len(baseMap)+len(overlayMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+
+	for k, v := range overlayMap {
+		merged[k] = mergeConfigValues(baseMap[k], v)
+	}
+
+	return merged
+}
+
+func selectConfigProfile(v any, profile string) (any, ConfigProblems) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v, nil
+	}
+
+	if profile == "" {
+		if m["profile"] == nil {
+			return v, nil
+		}
+
+		profile, ok = m["profile"].(string)
+		if !ok {
+			return v, ConfigProblems{{Path: "profile", Message: "must be a profile name"}}
+		}
+	}
+
+	profiles, _ := m["profiles"].(map[string]any)
+
+	overlay, ok := profiles[profile]
+	if !ok {
+		return v, ConfigProblems{{Path: "profile", Message: fmt.Sprintf("profile %q is not defined in profiles", profile)}}
+	}
+
+	if _, ok := overlay.(map[string]any); !ok {
+		return v, ConfigProblems{{Path: configPath("profiles", profile), Message: "must be an object"}}
+	}
+
+	merged := mergeConfigValues(v, overlay).(map[string]any)
+	merged["profile"] = profile
+
+	return merged, nil
+}
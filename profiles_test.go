@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncludeSource(t *testing.T) {
+	tests := []struct {
+		source  string
+		include string
+		want    string
+	}{
+		{"/etc/hsc/config.json", "base.json", "/etc/hsc/base.json"},
+		{"/etc/hsc/config.json", "../shared/base.yaml", "/etc/shared/base.yaml"},
+		{"/etc/hsc/config.json", "/opt/base.json", "/opt/base.json"},
+		{"config.json", "base.json", "base.json"},
+		{"-", "base.json", "base.json"},
+		{"/etc/hsc/config.json", "https://example.com/base.json", "https://example.com/base.json"},
+		{"https://example.com/hsc/config.json", "base.json", "https://example.com/hsc/base.json"},
+		{"https://example.com/hsc/config.json", "../base.json", "https://example.com/base.json"},
+		{"https://example.com/hsc/config.json", "/base.json", "https://example.com/base.json"},
+		{"https://example.com/hsc/config.json", "http://other.example/base.json", "http://other.example/base.json"},
+	}
+
+	for _, test := range tests {
+		got, err := includeSource(test.source, test.include)
+		if err != nil || got != filepath.FromSlash(test.want) && got != test.want {
+			t.Errorf("includeSource(%q, %q) = %q, %v, want %q", test.source, test.include, got, err, test.want)
+		}
+	}
+}
+
+func TestMergeConfigValues(t *testing.T) {
+	base := map[string]any{
+		"scrcpy": map[string]any{
+			"video": true,
+			"retry": map[string]any{"maxAttempts": 3.0, "initialDelay": 100.0},
+		},
+		"adb":            []any{"-H", "host"},
+		"customCommands": map[string]any{"a": "x"},
+	}
+
+	overlay := map[string]any{
+		"scrcpy": map[string]any{
+			"audio": true,
+			"retry": map[string]any{"maxAttempts": 5.0},
+		},
+		"adb":            []any{"-P", "5038"},
+		"customCommands": "none",
+		"log":            map[string]any{"level": "debug"},
+	}
+
+	want := map[string]any{
+		"scrcpy": map[string]any{
+			"video": true,
+			"audio": true,
+			"retry": map[string]any{"maxAttempts": 5.0, "initialDelay": 100.0},
+		},
+		"adb":            []any{"-P", "5038"},
+		"customCommands": "none",
+		"log":            map[string]any{"level": "debug"},
+	}
+
+	got := mergeConfigValues(base, overlay)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if base["scrcpy"].(map[string]any)["audio"] != nil {
+		t.Fatal("merging modified the base value")
+	}
+
+	if got := mergeConfigValues("x", map[string]any{"a": 1.0}); !reflect.DeepEqual(got, map[string]any{"a": 1.0}) {
+		t.Fatalf("got %v, want the overlay when the base is not an object", got)
+	}
+}
+
+func TestSelectConfigProfile(t *testing.T) {
+	config := func(profile any) map[string]any {
+		c := map[string]any{
+			"scrcpy": map[string]any{"video": true, "audio": false},
+			"profiles": map[string]any{
+				"ci":     map[string]any{"scrcpy": map[string]any{"video": false}},
+				"audio":  map[string]any{"scrcpy": map[string]any{"audio": true}},
+				"broken": "video",
+			},
+		}
+
+		if profile != nil {
+			c["profile"] = profile
+		}
+
+		return c
+	}
+
+	scrcpy := func(v any) any {
+		return v.(map[string]any)["scrcpy"]
+	}
+
+	tests := []struct {
+		name    string
+		config  map[string]any
+		profile string
+		want    any
+		err     string
+	}{
+		{"no profile", config(nil), "", map[string]any{"video": true, "audio": false}, ""},
+		{"profile argument", config(nil), "ci", map[string]any{"video": false, "audio": false}, ""},
+		{"profile field", config("audio"), "", map[string]any{"video": true, "audio": true}, ""},
+		{"argument overrides field", config("audio"), "ci", map[string]any{"video": false, "audio": false}, ""},
+		{"undefined profile", config(nil), "release", nil, `profile: profile "release" is not defined in profiles`},
+		{"profile is not an object", config(nil), "broken", nil, "profiles.broken: must be an object"},
+		{"profile field is not a name", config(1.0), "", nil, "profile: must be a profile name"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, problems := selectConfigProfile(test.config, test.profile)
+
+			if test.err != "" {
+				if problems.Error() != test.err {
+					t.Fatalf("got problems %q, want %q", problems.Error(), test.err)
+				}
+
+				return
+			}
+
+			if len(problems) > 0 {
+				t.Fatalf("unexpected problems: %v", problems)
+			}
+
+			if !reflect.DeepEqual(scrcpy(got), test.want) {
+				t.Fatalf("got scrcpy %v, want %v", scrcpy(got), test.want)
+			}
+
+			if profile := got.(map[string]any)["profile"]; test.profile != "" && profile != test.profile {
+				t.Fatalf("got profile %v, want %s", profile, test.profile)
+			}
+		})
+	}
+}
+
+func TestResolveConfigIncludes(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"config.json":          `{"include": ["shared/base.json", "local.yaml"], "scrcpy": {"address": "main"}}`,
+		"shared/base.json":     `{"include": "defaults.json", "scrcpy": {"address": "base", "video": true}, "log": {"level": "warn"}}`,
+		"shared/defaults.json": `{"scrcpy": {"audio": true, "video": false}, "adb": true}`,
+		"local.yaml":           "log:\n  level: debug\n",
+		"cycle.json":           `{"include": "shared/cycle.json"}`,
+		"shared/cycle.json":    `{"include": "../cycle.json"}`,
+		"bad.json":             `{"include": 1}`,
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolve := func(name string) (any, error) {
+		source := filepath.Join(dir, name)
+
+		data, err := readConfigData(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := decodeConfigValue(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resolveConfigIncludes(source, v, []string{source})
+	}
+
+	got, err := resolve("config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"include": []any{"shared/base.json", "local.yaml"},
+		"scrcpy":  map[string]any{"address": "main", "video": true, "audio": true},
+		"log":     map[string]any{"level": "debug"},
+		"adb":     true,
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	_, err = resolve("cycle.json")
+	if err == nil || !strings.HasPrefix(err.Error(), "include cycle: ") || !strings.HasSuffix(err.Error(), filepath.Join(dir, "cycle.json")) {
+		t.Fatalf("got error %v, want an include cycle", err)
+	}
+
+	_, err = resolve("bad.json")
+	if err == nil || err.Error() != "include: must be a file or URL, or a list of them" {
+		t.Fatalf("got error %v, want an invalid include", err)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type recordingTrack struct {
+	video         bool
+	codec         uint32
+	width         int
+	height        int
+	packets       chan *Packet
+	codecConfig   []byte
+	parameterSets []byte
+}
+
+type muxer interface {
+	writeSample(track int, timestamp int64, keyFrame bool, data []byte) error
+	close() error
+}
+
+type recordingWriter struct {
+	muxer   muxer
+	tracks  []*recordingTrack
+	started bool
+	base    int64
+}
+
+type Recorder struct {
+	Path   string
+	Format string
+	stop   chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+var errNothingRecorded = errors.New("nothing was recorded")
+
+func (t *recordingTrack) configure(config []byte) error {
+	var err error
+
+	switch t.codec {
+	case ScrcpyCodecs.H264:
+		t.codecConfig, err = avcDecoderConfiguration(config)
+	case ScrcpyCodecs.H265:
+		t.codecConfig, err = hevcDecoderConfiguration(config)
+	case ScrcpyCodecs.Av1:
+		t.codecConfig, err = av1CodecConfiguration(config)
+	case ScrcpyCodecs.Opus:
+		t.codecConfig, err = opusHead(config)
+	case ScrcpyCodecs.Aac:
+		t.codecConfig = config
+	case ScrcpyCodecs.Flac:
+		t.codecConfig, err = flacStreamInfo(config)
+	default:
+		err = fmt.Errorf("unsupported codec %08x", t.codec)
+	}
+
+	return err
+}
+
+func (t *recordingTrack) sample(p *Packet) []byte {
+	switch t.codec {
+	case ScrcpyCodecs.H264, ScrcpyCodecs.H265:
+		if p.config() {
+			t.parameterSets = annexBToLengthPrefixed(p.Data)
+			return nil
+		}
+
+		data := annexBToLengthPrefixed(p.Data)
+
+		if p.keyFrame() && t.parameterSets != nil {
+			data = append(t.parameterSets, data...)
+			t.parameterSets = nil
+		}
+
+		return data
+	case ScrcpyCodecs.Av1:
+		if p.config() {
+			return nil
+		}
+
+		return av1StripTemporalDelimiters(p.Data)
+	default:
+		if p.config() {
+			return nil
+		}
+
+		return p.Data
+	}
+}
+
+func recordingFormat(path string, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".mp4", ".m4v", ".m4a":
+			return "mp4", nil
+		default:
+			return "mkv", nil
+		}
+	}
+
+	if format != "mkv" && format != "mp4" {
+		return "", fmt.Errorf("unknown recording format %q", format)
+	}
+
+	return format, nil
+}
+
+func recordingPath(dir string, name string) (string, error) {
+	if dir == "" {
+		return "", errors.New("recording directory is not configured")
+	}
+
+	if !filepath.IsLocal(name) || slices.Contains(strings.Split(filepath.ToSlash(name), "/"), "..") {
+		return "", fmt.Errorf("invalid recording path %q", name)
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+func createRecordingFile(dir string, name string) (*os.File, string, error) {
+	path, err := recordingPath(dir, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return file, path, nil
+}
+
+func newRecordingWriter(w io.Writer, format string, tracks []*recordingTrack) (*recordingWriter, error) {
+	var m muxer
+	var err error
+
+	if format == "mp4" {
+		m, err = newMp4Muxer(w, tracks)
+	} else {
+		m, err = newMatroskaMuxer(w, tracks)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingWriter{muxer: m, tracks: tracks}, nil
+}
+
+func (rw *recordingWriter) write(track int, p *Packet) error {
+	t := rw.tracks[track]
+
+	data := t.sample(p)
+	if data == nil {
+		return nil
+	}
+
+	if !rw.started {
+		if !t.video && rw.tracks[0].video {
+			return nil
+		}
+
+		rw.started = true
+		rw.base = int64(p.pts())
+	}
+
+	timestamp := int64(p.pts()) - rw.base
+	if timestamp < 0 {
+		return nil
+	}
+
+	return rw.muxer.writeSample(track, timestamp, !t.video || p.keyFrame(), data)
+}
+
+func muxPackets(w io.Writer, format string, tracks []*recordingTrack, stop <-chan struct{}) error {
+	var packets [2]chan *Packet
+	var initial [2][]*Packet
+
+	for i, t := range tracks {
+		packets[i] = t.packets
+
+		for t.codecConfig == nil {
+			var p *Packet
+			var ok bool
+
+			select {
+			case p, ok = <-t.packets:
+			case <-stop:
+				return errNothingRecorded
+			}
+
+			if !ok {
+				return errNothingRecorded
+			}
+
+			if p.config() {
+				err := t.configure(p.Data)
+				if err != nil {
+					return err
+				}
+			} else if t.codec == ScrcpyCodecs.Raw {
+				initial[i] = append(initial[i], p)
+				break
+			} else {
+				return errors.New("missing codec configuration")
+			}
+		}
+	}
+
+	rw, err := newRecordingWriter(w, format, tracks)
+	if err != nil {
+		return err
+	}
+
+	for i := range initial {
+		for _, p := range initial[i] {
+			err = rw.write(i, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for packets[0] != nil || packets[1] != nil {
+		var p *Packet
+		var ok bool
+		var i int
+
+		select {
+		case p, ok = <-packets[0]:
+			i = 0
+		case p, ok = <-packets[1]:
+			i = 1
+		case <-stop:
+			return rw.muxer.close()
+		}
+
+		if !ok {
+			packets[i] = nil
+			continue
+		}
+
+		err = rw.write(i, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rw.muxer.close()
+}
+
+func (s *Session) startRecording(path string, format string) error {
+	device := s.device()
+
+	format, err := recordingFormat(path, format)
+	if err != nil {
+		return err
+	}
+
+	if !device.Scrcpy.Video && !device.Scrcpy.Audio {
+		return errors.New("video and audio are disabled")
+	}
+
+	s.recorderMutex.Lock()
+	defer s.recorderMutex.Unlock()
+
+	if s.recorder != nil {
+		return errors.New("already recording")
+	}
+
+	file, path, err := createRecordingFile(device.Scrcpy.RecordingDirectory, path)
+	if err != nil {
+		return err
+	}
+
+	r := &Recorder{
+		Path:   path,
+		Format: format,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	s.recorder = r
+	go s.record(r, file)
+
+	return nil
+}
+
+func (s *Session) record(r *Recorder, file *os.File) {
+	device := s.device()
+
+	defer close(r.done)
+
+	var tracks []*recordingTrack
+
+	if device.Scrcpy.Video {
+		packets := s.video.subscribe(r.stop)
+		if packets != nil {
+			defer s.video.unsubscribe(packets)
+
+			tracks = append(tracks, &recordingTrack{
+				video:   true,
+				codec:   s.videoCodec,
+				width:   s.initialVideoWidth,
+				height:  s.initialVideoHeight,
+				packets: packets,
+			})
+		}
+	}
+
+	if device.Scrcpy.Audio {
+		packets := s.audio.subscribe(r.stop)
+		if packets != nil {
+			defer s.audio.unsubscribe(packets)
+
+			tracks = append(tracks, &recordingTrack{codec: s.audioCodec, packets: packets})
+		}
+	}
+
+	r.err = errNothingRecorded
+	if len(tracks) > 0 {
+		r.err = muxPackets(file, r.Format, tracks, r.stop)
+	}
+
+	err := file.Close()
+	if r.err == nil {
+		r.err = err
+	}
+
+	if r.err == errNothingRecorded {
+		os.Remove(r.Path)
+	}
+
+	s.recorderMutex.Lock()
+	if s.recorder == r {
+		s.recorder = nil
+	}
+	s.recorderMutex.Unlock()
+
+	if r.err != nil {
+		s.events.publish(Event{Type: "recordingerror", Data: r.err.Error()})
+	}
+
+	s.events.publish(Event{Type: "recordingstopped", Data: r.Path})
+}
+
+func (s *Session) stopRecording() (string, error) {
+	s.recorderMutex.Lock()
+	r := s.recorder
+	s.recorder = nil
+	s.recorderMutex.Unlock()
+
+	if r == nil {
+		return "", errors.New("not recording")
+	}
+
+	close(r.stop)
+	<-r.done
+
+	return r.Path, r.err
+}
+
+func recordingHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, POST")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodPost:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		command := []string{req.URL.Path[1:]}
+
+		if req.URL.Path == "/startrecording" || req.URL.Path == "/savereplay" {
+			path := req.URL.Query().Get("path")
+			if path == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			command = append(command, path)
+
+			format := req.URL.Query().Get("format")
+			if format != "" {
+				command = append(command, format)
+			}
+		}
+
+		results := s.runCommands(httpCommandSource("http", req), [][]string{command})
+
+		resultsBytes, err := json.Marshal(results)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !results.Ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		w.Write(resultsBytes)
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordingPath(t *testing.T) {
+	tests := []struct {
+		dir  string
+		name string
+		want string
+		err  bool
+	}{
+		{"/rec", "a.mkv", "/rec/a.mkv", false},
+		{"/rec", "day/a.mp4", "/rec/day/a.mp4", false},
+		{"/rec", "/root/.bashrc", "", true},
+		{"/rec", "../a.mkv", "", true},
+		{"/rec", "day/../a.mkv", "", true},
+		{"/rec", "", "", true},
+		{"", "a.mkv", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := recordingPath(test.dir, test.name)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("recordingPath(%q, %q) = %q, %v, want %q", test.dir, test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestCreateRecordingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(dir, "existing.mkv"), []byte("keep"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = createRecordingFile(dir, "existing.mkv")
+	if err == nil {
+		t.Fatal("expected an error for an existing file")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "existing.mkv"))
+	if err != nil || string(data) != "keep" {
+		t.Fatalf("existing file was changed to %q, %v", data, err)
+	}
+
+	file, path, err := createRecordingFile(dir, "new.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	if path != filepath.Join(dir, "new.mkv") {
+		t.Fatalf("got path %s, want %s", path, filepath.Join(dir, "new.mkv"))
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+type replayGop struct {
+	config  *Packet
+	packets []*Packet
+	size    int
+}
+
+type replayTrack struct {
+	codec  uint32
+	width  int
+	height int
+	config *Packet
+	gops   []*replayGop
+	size   int
+}
+
+type ReplayBuffer struct {
+	duration uint64
+	maxSize  int
+	mutex    sync.Mutex
+	video    replayTrack
+	audio    replayTrack
+}
+
+func (r *ReplayBuffer) add(t *replayTrack, video bool, p *Packet) {
+	if p.config() {
+		t.config = p
+		return
+	}
+
+	if !video || p.keyFrame() {
+		t.gops = append(t.gops, &replayGop{config: t.config})
+	} else if len(t.gops) == 0 {
+		return
+	}
+
+	gop := t.gops[len(t.gops)-1]
+	gop.packets = append(gop.packets, p)
+	gop.size += len(p.Data)
+	t.size += len(p.Data)
+
+	for len(t.gops) > 1 && r.expired(t, p.pts()) {
+		t.size -= t.gops[0].size
+		t.gops[0] = nil
+		t.gops = t.gops[1:]
+	}
+}
+
+func (r *ReplayBuffer) expired(t *replayTrack, pts uint64) bool {
+	if t.size > r.maxSize {
+		return true
+	}
+
+	start := t.gops[1].packets[0].pts()
+	return pts >= start && pts-start >= r.duration
+}
+
+func (s *Session) bufferReplay(b *PacketBroadcaster, video bool) {
+	t := &s.replay.audio
+	if video {
+		t = &s.replay.video
+	}
+
+	for {
+		packets := b.subscribe(nil)
+		first := true
+
+		for p := range packets {
+			s.replay.mutex.Lock()
+
+			if first {
+				first = false
+
+				if video {
+					*t = replayTrack{codec: s.videoCodec, width: s.initialVideoWidth, height: s.initialVideoHeight}
+				} else {
+					*t = replayTrack{codec: s.audioCodec}
+				}
+			}
+
+			s.replay.add(t, video, p)
+			s.replay.mutex.Unlock()
+		}
+
+		b.unsubscribe(packets)
+	}
+}
+
+func (r *ReplayBuffer) snapshot(video bool) (*recordingTrack, []*Packet, error) {
+	t := &r.audio
+	if video {
+		t = &r.video
+	}
+
+	if len(t.gops) == 0 {
+		return nil, nil, nil
+	}
+
+	track := &recordingTrack{video: video, codec: t.codec, width: t.width, height: t.height}
+
+	config := t.gops[0].config
+	if config != nil {
+		err := track.configure(config.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if video || t.codec != ScrcpyCodecs.Raw {
+		return nil, nil, errors.New("missing codec configuration")
+	}
+
+	var packets []*Packet
+
+	for _, gop := range t.gops {
+		if gop.config != config {
+			config = gop.config
+			packets = append(packets, config)
+		}
+
+		packets = append(packets, gop.packets...)
+	}
+
+	return track, packets, nil
+}
+
+func (s *Session) saveReplay(path string, format string) (string, error) {
+	device := s.device()
+
+	format, err := recordingFormat(path, format)
+	if err != nil {
+		return "", err
+	}
+
+	if device.Scrcpy.ReplayDuration <= 0 {
+		return "", errors.New("replay buffer is disabled")
+	}
+
+	var tracks []*recordingTrack
+	var packets [][]*Packet
+
+	s.replay.mutex.Lock()
+
+	for _, video := range []bool{true, false} {
+		t, p, err := s.replay.snapshot(video)
+		if err != nil {
+			s.replay.mutex.Unlock()
+			return "", err
+		}
+
+		if t != nil {
+			tracks = append(tracks, t)
+			packets = append(packets, p)
+		}
+	}
+
+	s.replay.mutex.Unlock()
+
+	if len(tracks) == 0 {
+		return "", errors.New("replay buffer is empty")
+	}
+
+	file, path, err := createRecordingFile(device.Scrcpy.RecordingDirectory, path)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeReplay(file, format, tracks, packets)
+	closeErr := file.Close()
+
+	if err != nil {
+		return "", err
+	}
+
+	return path, closeErr
+}
+
+func writeReplay(w io.Writer, format string, tracks []*recordingTrack, packets [][]*Packet) error {
+	rw, err := newRecordingWriter(w, format, tracks)
+	if err != nil {
+		return err
+	}
+
+	for {
+		track := -1
+
+		for i := range packets {
+			if len(packets[i]) > 0 && (track == -1 || packets[i][0].pts() < packets[track][0].pts()) {
+				track = i
+			}
+		}
+
+		if track == -1 {
+			break
+		}
+
+		err = rw.write(track, packets[track][0])
+		if err != nil {
+			return err
+		}
+
+		packets[track] = packets[track][1:]
+	}
+
+	return rw.muxer.close()
+}
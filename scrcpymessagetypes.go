@@ -47,3 +47,21 @@ var ScrcpyDeviceMessageTypes = struct {
 	AckClipboard: 0x01,
 	UhidOutput:   0x02,
 }
+
+var ScrcpyCodecs = struct {
+	H264 uint32
+	H265 uint32
+	Av1  uint32
+	Opus uint32
+	Aac  uint32
+	Flac uint32
+	Raw  uint32
+}{
+	H264: 0x68323634,
+	H265: 0x68323635,
+	Av1:  0x00617631,
+	Opus: 0x6F707573,
+	Aac:  0x00616163,
+	Flac: 0x666C6163,
+	Raw:  0x00726177,
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type screenshotOptions struct {
+	quality int
+	scale   float64
+	crop    image.Rectangle
+}
+
+var errNoVideoFrame = errors.New("no video frame")
+
+func parseScreenshotOptions(query url.Values) (screenshotOptions, error) {
+	options := screenshotOptions{quality: 90, scale: 1}
+	var err error
+
+	if query.Get("quality") != "" {
+		options.quality, err = strconv.Atoi(query.Get("quality"))
+		if err != nil {
+			return options, err
+		}
+		if options.quality < 1 || options.quality > 100 {
+			return options, errors.New("quality must be between 1 and 100")
+		}
+	}
+
+	if query.Get("scale") != "" {
+		options.scale, err = strconv.ParseFloat(query.Get("scale"), 64)
+		if err != nil {
+			return options, err
+		}
+		if options.scale <= 0 || options.scale > 1 {
+			return options, errors.New("scale must be greater than 0 and at most 1")
+		}
+	}
+
+	if query.Get("crop") != "" {
+		parts := strings.Split(query.Get("crop"), ",")
+		if len(parts) != 4 {
+			return options, errors.New("crop must be x,y,width,height")
+		}
+
+		values := make([]int, 4)
+
+		for i, part := range parts {
+			values[i], err = strconv.Atoi(part)
+			if err != nil {
+				return options, err
+			}
+		}
+
+		if values[2] <= 0 || values[3] <= 0 {
+			return options, errors.New("crop must be x,y,width,height")
+		}
+
+		options.crop = image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3])
+	}
+
+	return options, nil
+}
+
+func screenshotFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return "png", nil
+	case ".jpg", ".jpeg":
+		return "jpeg", nil
+	default:
+		return "", fmt.Errorf("unknown screenshot format %q", filepath.Ext(path))
+	}
+}
+
+func scaleImage(src *image.NRGBA, scale float64) *image.NRGBA {
+	bounds := src.Bounds()
+	width := max(1, int(float64(bounds.Dx())*scale))
+	height := max(1, int(float64(bounds.Dy())*scale))
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var sum [4]int
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[i+c])
+					}
+				}
+			}
+
+			count := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = byte(sum[c] / count)
+			}
+		}
+	}
+
+	return dst
+}
+
+func (s *Session) screenshot(options screenshotOptions) (image.Image, error) {
+	s.videoFrameMutex.RLock()
+
+	if len(s.videoFrame) == 0 {
+		s.videoFrameMutex.RUnlock()
+		return nil, errNoVideoFrame
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, s.videoFrameWidth, s.videoFrameHeight))
+
+	if s.device().VideoDecoder.Alpha {
+		copy(img.Pix, s.videoFrame)
+	} else {
+		for i, j := 0, 0; i+2 < len(s.videoFrame) && j+3 < len(img.Pix); i, j = i+3, j+4 {
+			img.Pix[j] = s.videoFrame[i]
+			img.Pix[j+1] = s.videoFrame[i+1]
+			img.Pix[j+2] = s.videoFrame[i+2]
+			img.Pix[j+3] = 0xFF
+		}
+	}
+
+	s.videoFrameMutex.RUnlock()
+
+	if !options.crop.Empty() {
+		if !options.crop.In(img.Bounds()) {
+			return nil, errors.New("crop is outside of the video frame")
+		}
+
+		img = img.SubImage(options.crop).(*image.NRGBA)
+	}
+
+	if options.scale < 1 {
+		img = scaleImage(img, options.scale)
+	}
+
+	return img, nil
+}
+
+func encodeScreenshot(w io.Writer, img image.Image, format string, quality int) error {
+	if format == "png" {
+		return png.Encode(w, img)
+	}
+
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
+
+func (s *Session) saveScreenshot(path string, query string) error {
+	format, err := screenshotFormat(path)
+	if err != nil {
+		return err
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return err
+	}
+
+	options, err := parseScreenshotOptions(values)
+	if err != nil {
+		return err
+	}
+
+	img, err := s.screenshot(options)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = encodeScreenshot(file, img, format, options.quality)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func screenshotHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := req.Header.Get("Origin")
+
+	switch req.Method {
+	case http.MethodOptions:
+		if req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", "OPTIONS, GET")
+		} else if origin != "" {
+			requestHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+
+			if requestHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+			}
+		}
+	case http.MethodGet:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "Device-Name")
+		}
+
+		options, err := parseScreenshotOptions(req.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		img, err := s.screenshot(options)
+		if err == errNoVideoFrame {
+			http.NotFound(w, req)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		format, _ := screenshotFormat(req.URL.Path)
+
+		var buffer bytes.Buffer
+
+		err = encodeScreenshot(&buffer, img, format, options.quality)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/"+format)
+		w.Header().Set("Device-Name", s.deviceName)
+		w.Write(buffer.Bytes())
+	default:
+		if origin != "" {
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		w.Header().Set("Allow", "OPTIONS, GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DeviceConfig struct {
+	Adb          AdbConfig          `json:"adb"`
+	Scrcpy       ScrcpyConfig       `json:"scrcpy"`
+	VideoDecoder VideoDecoderConfig `json:"videoDecoder"`
+}
+
+type Session struct {
+	Name                     string
+	deviceConfig             atomic.Pointer[DeviceConfig]
+	scrcpyListener           net.Listener
+	videoSocket              net.Conn
+	audioSocket              net.Conn
+	controlSocket            net.Conn
+	connectionControlChannel chan connectionRequest
+	connectionLostChannel    chan uint64
+	connectionGeneration     uint64
+	state                    string
+	lastError                string
+	attempts                 int
+	reconnects               uint64
+	stateMutex               sync.Mutex
+	deviceName               string
+	videoCodec               uint32
+	audioCodec               uint32
+	initialVideoWidth        int
+	initialVideoHeight       int
+	scrcpyServer             *exec.Cmd
+	scrcpyServerArgs         []string
+	scrcpyServerDone         chan struct{}
+	scrcpyServerMutex        sync.Mutex
+	scrcpyConnectedCommands  CommandSlice
+	videoFrame               []byte
+	videoFrameWidth          int
+	videoFrameHeight         int
+	videoFrameSequence       uint64
+	videoFrameMutex          sync.RWMutex
+	decodeRate               float64
+	decodeRateStart          time.Time
+	decodeRateSequence       uint64
+	events                   EventBus
+	video                    PacketBroadcaster
+	audio                    PacketBroadcaster
+	connected                bool
+	connectedMutex           sync.Mutex
+	recorder                 *Recorder
+	recorderMutex            sync.Mutex
+	replay                   ReplayBuffer
+	watchdog                 Watchdog
+	decoder                  *exec.Cmd
+	decoderMutex             sync.Mutex
+	closed                   atomic.Bool
+	pendingConfig            *DeviceConfig
+	controlWriteLatency      metricHistogram
+	clipboardRoundTrip       metricHistogram
+}
+
+type sessionContextKey struct{}
+
+var defaultSession *Session
+var sessions map[string]*Session = map[string]*Session{}
+
+func newSession(name string, adb AdbConfig, scrcpy ScrcpyConfig, videoDecoder VideoDecoderConfig) *Session {
+	s := &Session{
+		Name:                     name,
+		connectionControlChannel: make(chan connectionRequest),
+		connectionLostChannel:    make(chan uint64),
+		state:                    ConnectionStates.Idle,
+	}
+
+	s.events.device = name
+	s.deviceConfig.Store(&DeviceConfig{Adb: adb, Scrcpy: scrcpy, VideoDecoder: videoDecoder})
+	s.video.keyFrames = true
+	return s
+}
+
+func (s *Session) device() *DeviceConfig {
+	return s.deviceConfig.Load()
+}
+
+func requestSession(req *http.Request) *Session {
+	s, ok := req.Context().Value(sessionContextKey{}).(*Session)
+	if !ok {
+		return defaultSession
+	}
+
+	return s
+}
+
+func stdoutStreaming() bool {
+	for _, s := range sessions {
+		if s.device().Scrcpy.StdoutVideoStream || s.device().Scrcpy.StdoutAudioStream {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Session) setConnectedCommands(cs CommandSlice) {
+	s.connectedMutex.Lock()
+	defer s.connectedMutex.Unlock()
+
+	s.scrcpyConnectedCommands = cs
+}
+
+func (s *Session) setConnected(connected bool, reason string) {
+	s.connectedMutex.Lock()
+	defer s.connectedMutex.Unlock()
+
+	if s.connected == connected {
+		return
+	}
+
+	s.connected = connected
+
+	if connected {
+		s.events.publish(Event{Type: "connected", Data: s.deviceName})
+
+		go s.runHook(s.scrcpyConnectedCommands, map[string]string{
+			"DEVICE_NAME": s.deviceName,
+			"WIDTH":       strconv.Itoa(s.initialVideoWidth),
+			"HEIGHT":      strconv.Itoa(s.initialVideoHeight),
+		})
+	} else {
+		s.events.publish(Event{Type: "disconnected", Data: reason})
+
+		go s.runHook(s.device().Scrcpy.DisconnectedCommands, map[string]string{
+			"DEVICE_NAME": s.deviceName,
+			"REASON":      reason,
+		})
+	}
+}
+
+func (s *Session) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, s)))
+	})
+}
+
+func (s *Session) start() {
+	device := s.device()
+
+	s.setConnectedCommands(device.Scrcpy.ConnectedCommands)
+
+	if device.Scrcpy.StdoutClipboard || device.Scrcpy.StderrClipboard || device.Scrcpy.StdoutUhidOutput || device.Scrcpy.StderrUhidOutput {
+		go s.printEvents()
+	}
+
+	if device.Scrcpy.Video {
+		if device.Scrcpy.StdoutVideoStream {
+			go func() {
+				for {
+					packets := s.video.subscribe(shutdownContext.Done())
+					if packets == nil {
+						return
+					}
+
+					failed := writePacketStream(device.Scrcpy.StdoutVideoStreamRaw, os.Stdout, nil, packets, shutdownContext.Done())
+					s.video.unsubscribe(packets)
+
+					if failed {
+						slog.Error("stdout stream write failed", "device", s.Name, "stream", "video")
+						return
+					}
+				}
+			}()
+		}
+
+		if device.VideoDecoder.Enabled {
+			if runtime.GOOS == "windows" {
+				go s.decodeVideoFfmpeg()
+			} else {
+				_, ok := exec.Command(device.VideoDecoder.Executable).Run().(*exec.ExitError)
+				if ok {
+					go s.decodeVideoFfmpeg()
+				} else {
+					go s.decodeVideo()
+				}
+			}
+		}
+	}
+
+	if device.Scrcpy.ReplayDuration > 0 {
+		s.replay.duration = uint64(device.Scrcpy.ReplayDuration) * 1000000
+		s.replay.maxSize = device.Scrcpy.ReplayMaxSize
+
+		if device.Scrcpy.Video {
+			go s.bufferReplay(&s.video, true)
+		}
+
+		if device.Scrcpy.Audio {
+			go s.bufferReplay(&s.audio, false)
+		}
+	}
+
+	if device.Scrcpy.Audio && device.Scrcpy.StdoutAudioStream {
+		go func() {
+			for {
+				packets := s.audio.subscribe(shutdownContext.Done())
+				if packets == nil {
+					return
+				}
+
+				failed := writePacketStream(device.Scrcpy.StdoutAudioStreamRaw, os.Stdout, nil, packets, shutdownContext.Done())
+				s.audio.unsubscribe(packets)
+
+				if failed {
+					slog.Error("stdout stream write failed", "device", s.Name, "stream", "audio")
+					return
+				}
+			}
+		}()
+	}
+
+	if device.Scrcpy.Watchdog.Enabled {
+		go s.runWatchdog()
+	}
+
+	go s.runConnection()
+}
+
+func (s *Session) registerEndpoints(mux *http.ServeMux) {
+	device := s.device()
+
+	endpoint := func(path string, handler func(http.ResponseWriter, *http.Request)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			if !endpointAllowed(path) {
+				http.NotFound(w, req)
+				return
+			}
+
+			handler(w, req)
+		})
+	}
+
+	endpoint("/ws", webSocketHandler)
+	endpoint("/events", eventStreamHandler)
+	endpoint("/status", statusHandler)
+
+	if device.Scrcpy.Enabled {
+		endpoint("/connect", commandHandler)
+		endpoint("/disconnect", commandHandler)
+		endpoint("/devicename", infoHandler)
+
+		if device.Scrcpy.Video {
+			endpoint("/videocodec", infoHandler)
+			endpoint("/initialvideowidth", infoHandler)
+			endpoint("/initialvideoheight", infoHandler)
+
+			endpoint("/videostream", videoStreamHandler)
+			endpoint("/rawvideostream", videoStreamHandler)
+
+			if device.VideoDecoder.Enabled {
+				endpoint("/videoframe", videoFrameHandler)
+				endpoint("/screenshot.png", screenshotHandler)
+				endpoint("/screenshot.jpg", screenshotHandler)
+				endpoint("/mjpeg", mjpegHandler)
+			}
+		}
+
+		if device.Scrcpy.Video || device.Scrcpy.Audio {
+			endpoint("/startrecording", recordingHandler)
+			endpoint("/stoprecording", recordingHandler)
+
+			if device.Scrcpy.ReplayDuration > 0 {
+				endpoint("/savereplay", recordingHandler)
+			}
+		}
+
+		if device.Scrcpy.Audio {
+			endpoint("/audiocodec", infoHandler)
+
+			endpoint("/audiostream", audioStreamHandler)
+			endpoint("/rawaudiostream", audioStreamHandler)
+		}
+
+		if device.Scrcpy.Control {
+			endpoint("/key", keyHandler)
+			endpoint("/keydown", keyHandler)
+			endpoint("/keyup", keyHandler)
+			endpoint("/type", typeHandler)
+			endpoint("/touch", touchHandler)
+			endpoint("/touchdown", touchHandler)
+			endpoint("/touchup", touchHandler)
+			endpoint("/touchmove", touchHandler)
+			endpoint("/mouseclick", mouseHandler)
+			endpoint("/mousedown", mouseHandler)
+			endpoint("/mouseup", mouseHandler)
+			endpoint("/mousemove", mouseHandler)
+			endpoint("/scrollleft", scrollHandler)
+			endpoint("/scrollright", scrollHandler)
+			endpoint("/scrollup", scrollHandler)
+			endpoint("/scrolldown", scrollHandler)
+			endpoint("/getclipboard", commandHandler)
+			endpoint("/getclipboardcut", commandHandler)
+			endpoint("/clipboard", clipboardHandler)
+			endpoint("/clipboardcut", clipboardHandler)
+			endpoint("/setclipboard", setClipboardHandler)
+			endpoint("/setclipboardpaste", setClipboardHandler)
+			endpoint("/clipboardstream", clipboardStreamHandler)
+			endpoint("/uhidinput", uhidInputHandler)
+			endpoint("/uhidoutputstream", uhidOutputStreamHandler)
+			endpoint("/openhardkeyboardsettings", commandHandler)
+			endpoint("/backorscreenon", commandHandler)
+			endpoint("/expandnotificationspanel", commandHandler)
+			endpoint("/expandsettingspanel", commandHandler)
+			endpoint("/collapsepanels", commandHandler)
+			endpoint("/turnscreenon", commandHandler)
+			endpoint("/turnscreenoff", commandHandler)
+			endpoint("/rotate", commandHandler)
+			endpoint("/resetvideo", commandHandler)
+		}
+
+		if device.Adb.Enabled {
+			endpoint("/startscrcpyserver", commandHandler)
+			endpoint("/stopscrcpyserver", commandHandler)
+			endpoint("/encoders", listHandler)
+			endpoint("/displays", listHandler)
+			endpoint("/cameras", listHandler)
+			endpoint("/apps", listHandler)
+			endpoint("/camerasizes", listHandler)
+		}
+	}
+}
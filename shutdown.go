@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+var errSessionClosed = errors.New("session is closed")
+
+var httpServer *http.Server
+var shutdownContext, cancelShutdown = context.WithCancel(context.Background())
+var shutdownClosers []io.Closer
+var shutdownMutex sync.Mutex
+
+func addShutdownCloser(c io.Closer) {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+
+	shutdownClosers = append(shutdownClosers, c)
+}
+
+func (s *Session) startDecoder(decoder *exec.Cmd) error {
+	s.decoderMutex.Lock()
+	defer s.decoderMutex.Unlock()
+
+	if s.closed.Load() {
+		return errSessionClosed
+	}
+
+	err := decoder.Start()
+	if err != nil {
+		return err
+	}
+
+	s.decoder = decoder
+	return nil
+}
+
+func (s *Session) killDecoder() {
+	s.decoderMutex.Lock()
+	defer s.decoderMutex.Unlock()
+
+	if s.decoder == nil {
+		return
+	}
+
+	s.decoder.Process.Kill()
+	s.decoder.Wait()
+	s.decoder = nil
+}
+
+func (s *Session) close() {
+	s.closed.Store(true)
+
+	s.stopRecording()
+
+	select {
+	case s.connectionControlChannel <- connectionRequest{}:
+	case <-time.After(time.Second):
+		if s.scrcpyListener != nil {
+			s.scrcpyListener.Close()
+		}
+	}
+
+	s.scrcpyServerMutex.Lock()
+	s.killScrcpyServer()
+	s.scrcpyServerArgs = nil
+	s.scrcpyServerMutex.Unlock()
+
+	s.killDecoder()
+}
+
+func shutdown(reason string) {
+	slog.Info("shutting down", "reason", reason)
+	cancelShutdown()
+
+	timeout := defaultShutdownTimeout
+	if config.HttpServer.Enabled {
+		timeout = time.Duration(config.HttpServer.ShutdownTimeout) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	hooksDone := make(chan struct{})
+
+	go func() {
+		defer close(hooksDone)
+
+		var wg sync.WaitGroup
+
+		for _, s := range sessions {
+			if !s.device().Scrcpy.Enabled {
+				continue
+			}
+
+			wg.Add(1)
+			go func(s *Session) {
+				defer wg.Done()
+				s.runHook(s.device().Scrcpy.ShutdownCommands, map[string]string{"REASON": reason})
+			}(s)
+		}
+
+		wg.Wait()
+	}()
+
+	select {
+	case <-hooksDone:
+	case <-ctx.Done():
+		slog.Warn("shutdown commands timed out", "timeout", timeout)
+	}
+
+	shutdownMutex.Lock()
+	for _, c := range shutdownClosers {
+		c.Close()
+	}
+	shutdownMutex.Unlock()
+
+	if httpServer != nil {
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("http server shutdown timed out", "error", err)
+			httpServer.Close()
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for _, s := range sessions {
+		if !s.device().Scrcpy.Enabled {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			s.close()
+		}(s)
+	}
+
+	wg.Wait()
+}
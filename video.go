@@ -4,103 +4,15 @@ import (
 	"encoding/binary"
 	"io"
 	"net/http"
-	"os"
 	"os/exec"
 	"strconv"
 )
 
-func writeVideoStream(raw bool, w io.Writer, flusher http.Flusher) bool {
-	headerBytes := make([]byte, 12)
-	var packetSize int
-	var packet []byte
-	var n int
-	var err error
-
-	if raw {
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				return false
-			}
-			if n != 12 {
-				return false
-			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
-
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				return false
-			}
-			if n != packetSize {
-				return false
-			}
-
-			n, err = w.Write(packet)
-			if err != nil {
-				connectionControlChannel <- ""
-				break
-			}
-			if n < packetSize {
-				connectionControlChannel <- ""
-				break
-			}
-
-			if flusher != nil {
-				flusher.Flush()
-			}
-		}
-	} else {
-		var data []byte
-
-		for {
-			n, err = io.ReadFull(videoSocket, headerBytes)
-			if err != nil {
-				return false
-			}
-			if n != 12 {
-				return false
-			}
-
-			packetSize = int(binary.BigEndian.Uint32(headerBytes[8:]))
-			packet = make([]byte, packetSize)
-
-			n, err = io.ReadFull(videoSocket, packet)
-			if err != nil {
-				return false
-			}
-			if n != packetSize {
-				return false
-			}
-
-			data = make([]byte, 12+packetSize)
-			copy(data[:12], headerBytes)
-			copy(data[12:12+packetSize], packet)
-
-			n, err = w.Write(data)
-			if err != nil {
-				connectionControlChannel <- ""
-				break
-			}
-			if n < 12+packetSize {
-				connectionControlChannel <- ""
-				break
-			}
-
-			if flusher != nil {
-				flusher.Flush()
-			}
-		}
-	}
-
-	return true
-}
-
 func videoStreamHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -129,17 +41,17 @@ func videoStreamHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Codec, Initial-Width, Initial-Height")
 		}
 
-		select {
-		case <-videoConnectedChannel:
-		case <-req.Context().Done():
+		packets := s.video.subscribe(req.Context().Done())
+		if packets == nil {
 			return
 		}
+		defer s.video.unsubscribe(packets)
 
-		w.Header().Set("Device-Name", deviceName)
-		w.Header().Set("Codec", strconv.FormatUint(uint64(videoCodec), 10))
-		w.Header().Set("Initial-Width", strconv.Itoa(initialVideoWidth))
-		w.Header().Set("Initial-Height", strconv.Itoa(initialVideoHeight))
-		writeVideoStream(req.URL.Path == "/rawvideostream", w, w.(http.Flusher))
+		w.Header().Set("Device-Name", s.deviceName)
+		w.Header().Set("Codec", strconv.FormatUint(uint64(s.videoCodec), 10))
+		w.Header().Set("Initial-Width", strconv.Itoa(s.initialVideoWidth))
+		w.Header().Set("Initial-Height", strconv.Itoa(s.initialVideoHeight))
+		writePacketStream(req.URL.Path == "/rawvideostream", w, w.(http.Flusher), packets, req.Context().Done())
 	default:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
@@ -151,33 +63,28 @@ func videoStreamHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func decodeVideo() {
+func (s *Session) decodeVideo() {
+	device := s.device()
+
 	var err error
 	var decoder *exec.Cmd
 	var decoderStdin io.WriteCloser
 	var decoderStdout io.ReadCloser
 
 	for {
-		<-videoConnectedChannel
+		packets := s.video.subscribe(nil)
 
-		if decoder != nil {
-			decoder.Process.Kill()
-			decoder.Wait()
-		}
+		s.killDecoder()
 
 		decoder = exec.Command(
-			config.VideoDecoder.Executable,
-			strconv.FormatUint(uint64(videoCodec), 10),
+			device.VideoDecoder.Executable,
+			strconv.FormatUint(uint64(s.videoCodec), 10),
 			map[bool]string{
 				false: "0",
 				true:  "1",
-			}[config.VideoDecoder.Alpha],
+			}[device.VideoDecoder.Alpha],
 		)
 
-		if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrUhidOutput {
-			decoder.Stderr = os.Stderr
-		}
-
 		decoderStdin, err = decoder.StdinPipe()
 		if err != nil {
 			return
@@ -188,7 +95,9 @@ func decodeVideo() {
 			return
 		}
 
-		err = decoder.Start()
+		logProcessOutput(decoder, "device", s.Name)
+
+		err = s.startDecoder(decoder)
 		if err != nil {
 			return
 		}
@@ -224,7 +133,7 @@ func decodeVideo() {
 					frameSize2 = frameWidth * frameHeight * map[bool]int{
 						false: 3,
 						true:  4,
-					}[config.VideoDecoder.Alpha]
+					}[device.VideoDecoder.Alpha]
 
 					if frameSize != frameSize2 {
 						frame = make([]byte, frameSize2)
@@ -240,53 +149,59 @@ func decodeVideo() {
 					break
 				}
 
-				videoFrameMutex.Lock()
+				s.videoFrameMutex.Lock()
 
-				if videoFrameWidth != frameWidth || videoFrameHeight != frameHeight {
-					videoFrameWidth = frameWidth
-					videoFrameHeight = frameHeight
-					videoFrame = make([]byte, frameSize)
+				if s.videoFrameWidth != frameWidth || s.videoFrameHeight != frameHeight {
+					s.videoSizeChanged(s.videoFrameWidth, s.videoFrameHeight, frameWidth, frameHeight)
+					s.videoFrameWidth = frameWidth
+					s.videoFrameHeight = frameHeight
+					s.videoFrame = make([]byte, frameSize)
 				}
 
-				copy(videoFrame, frame)
+				copy(s.videoFrame, frame)
+				s.videoFrameSequence++
+				s.countDecodedFrame()
 
-				videoFrameMutex.Unlock()
+				s.videoFrameMutex.Unlock()
 			}
 		}()
 
-		writeVideoStream(false, decoderStdin, nil)
+		writePacketStream(false, decoderStdin, nil, packets, nil)
+		s.video.unsubscribe(packets)
 	}
 }
 
-func decodeVideoFfmpeg() {
+func (s *Session) decodeVideoFfmpeg() {
+	device := s.device()
+
 	var err error
 	var ffmpeg *exec.Cmd
 	var ffmpegStdin io.WriteCloser
 	var ffmpegStdout io.ReadCloser
 
 	for {
-		<-videoConnectedChannel
+		packets := s.video.subscribe(nil)
 
-		videoFrameSize := initialVideoWidth * initialVideoHeight * map[bool]int{
+		videoFrameSize := s.initialVideoWidth * s.initialVideoHeight * map[bool]int{
 			false: 3,
 			true:  4,
-		}[config.VideoDecoder.Alpha]
+		}[device.VideoDecoder.Alpha]
 
-		videoFrameMutex.Lock()
-		videoFrameWidth = initialVideoWidth
-		videoFrameHeight = initialVideoHeight
-		if len(videoFrame) != videoFrameSize {
-			videoFrame = make([]byte, videoFrameSize)
+		s.videoFrameMutex.Lock()
+		if s.videoFrameWidth != s.initialVideoWidth || s.videoFrameHeight != s.initialVideoHeight {
+			s.videoSizeChanged(s.videoFrameWidth, s.videoFrameHeight, s.initialVideoWidth, s.initialVideoHeight)
 		}
-		videoFrameMutex.Unlock()
-
-		if ffmpeg != nil {
-			ffmpeg.Process.Kill()
-			ffmpeg.Wait()
+		s.videoFrameWidth = s.initialVideoWidth
+		s.videoFrameHeight = s.initialVideoHeight
+		if len(s.videoFrame) != videoFrameSize {
+			s.videoFrame = make([]byte, videoFrameSize)
 		}
+		s.videoFrameMutex.Unlock()
+
+		s.killDecoder()
 
 		ffmpeg = exec.Command(
-			config.VideoDecoder.Executable,
+			device.VideoDecoder.Executable,
 			"-probesize",
 			"32",
 			"-analyzeduration",
@@ -297,7 +212,7 @@ func decodeVideoFfmpeg() {
 				0x68323634: "h264",
 				0x68323635: "hevc",
 				0x617631:   "av1",
-			}[videoCodec],
+			}[s.videoCodec],
 			"-i",
 			"-",
 			"-f",
@@ -306,10 +221,10 @@ func decodeVideoFfmpeg() {
 			map[bool]string{
 				false: "rgb24",
 				true:  "rgba",
-			}[config.VideoDecoder.Alpha],
+			}[device.VideoDecoder.Alpha],
 			"-vf",
 			func() string {
-				if initialVideoWidth >= initialVideoHeight {
+				if s.initialVideoWidth >= s.initialVideoHeight {
 					return "transpose=1:landscape"
 				}
 
@@ -318,10 +233,6 @@ func decodeVideoFfmpeg() {
 			"-",
 		)
 
-		if !config.Scrcpy.StderrClipboard && !config.Scrcpy.StderrUhidOutput {
-			ffmpeg.Stderr = os.Stderr
-		}
-
 		ffmpegStdin, err = ffmpeg.StdinPipe()
 		if err != nil {
 			return
@@ -332,7 +243,9 @@ func decodeVideoFfmpeg() {
 			return
 		}
 
-		err = ffmpeg.Start()
+		logProcessOutput(ffmpeg, "device", s.Name)
+
+		err = s.startDecoder(ffmpeg)
 		if err != nil {
 			return
 		}
@@ -341,9 +254,9 @@ func decodeVideoFfmpeg() {
 			var n int
 			var err error
 
-			videoFrameMutex.RLock()
-			frame := make([]byte, len(videoFrame))
-			videoFrameMutex.RUnlock()
+			s.videoFrameMutex.RLock()
+			frame := make([]byte, len(s.videoFrame))
+			s.videoFrameMutex.RUnlock()
 
 			for {
 				n, err = io.ReadFull(ffmpegStdout, frame)
@@ -354,24 +267,27 @@ func decodeVideoFfmpeg() {
 					break
 				}
 
-				videoFrameMutex.Lock()
-				copy(videoFrame, frame)
-				videoFrameMutex.Unlock()
+				s.videoFrameMutex.Lock()
+				copy(s.videoFrame, frame)
+				s.videoFrameSequence++
+				s.countDecodedFrame()
+				s.videoFrameMutex.Unlock()
 			}
 		}()
 
-		if !writeVideoStream(false, ffmpegStdin, nil) {
-			ffmpeg.Process.Kill()
-			ffmpeg.Wait()
-			ffmpeg = nil
+		if !writePacketStream(false, ffmpegStdin, nil, packets, nil) {
+			s.killDecoder()
 		}
+
+		s.video.unsubscribe(packets)
 	}
 }
 
 func videoFrameHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
 	w.Header().Set("Cache-Control", "no-store")
 
-	if config.HttpServer.ClientCa != "" && tlsClientAuth(config.HttpServer.Endpoints[req.URL.Path], req.TLS) == " " {
+	if config.HttpServer.ClientCa != "" && tlsClientAuth(endpointClients(req.URL.Path), req.TLS) == " " {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -400,19 +316,19 @@ func videoFrameHandler(w http.ResponseWriter, req *http.Request) {
 			w.Header().Set("Access-Control-Expose-Headers", "Device-Name, Width, Height")
 		}
 
-		videoFrameMutex.RLock()
-		defer videoFrameMutex.RUnlock()
+		s.videoFrameMutex.RLock()
+		defer s.videoFrameMutex.RUnlock()
 
-		if len(videoFrame) == 0 {
+		if len(s.videoFrame) == 0 {
 			http.NotFound(w, req)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Device-Name", deviceName)
-		w.Header().Set("Width", strconv.Itoa(videoFrameWidth))
-		w.Header().Set("Height", strconv.Itoa(videoFrameHeight))
-		w.Write(videoFrame)
+		w.Header().Set("Device-Name", s.deviceName)
+		w.Header().Set("Width", strconv.Itoa(s.videoFrameWidth))
+		w.Header().Set("Height", strconv.Itoa(s.videoFrameHeight))
+		w.Write(s.videoFrame)
 	default:
 		if origin != "" {
 			w.Header().Set("Vary", "Origin")
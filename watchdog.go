@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const watchdogInterval = 250 * time.Millisecond
+
+type Watchdog struct {
+	mutex       sync.Mutex
+	since       time.Time
+	lastControl time.Time
+	stalled     string
+	stalledAt   time.Time
+	resetVideo  bool
+	escalated   bool
+}
+
+func (w *Watchdog) reset() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.since = time.Now()
+	w.resetVideo = false
+	w.escalated = false
+
+	if w.stalled != "" {
+		w.stalledAt = w.since
+	}
+}
+
+func (w *Watchdog) touchControl() {
+	w.mutex.Lock()
+	w.lastControl = time.Now()
+	w.mutex.Unlock()
+}
+
+func (s *Session) lastActivity(stream string) time.Time {
+	var last time.Time
+
+	switch stream {
+	case "video":
+		last = s.video.lastPacketTime()
+	case "audio":
+		last = s.audio.lastPacketTime()
+	case "control":
+		s.watchdog.mutex.Lock()
+		last = s.watchdog.lastControl
+		s.watchdog.mutex.Unlock()
+	}
+
+	return last
+}
+
+func (s *Session) runWatchdog() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if s.currentState() != ConnectionStates.Connected {
+			continue
+		}
+
+		device := s.device()
+
+		s.watchdog.mutex.Lock()
+		since := s.watchdog.since
+		stalled := s.watchdog.stalled
+		stalledAt := s.watchdog.stalledAt
+		s.watchdog.mutex.Unlock()
+
+		if stalled != "" {
+			if s.lastActivity(stalled).After(stalledAt) {
+				s.watchdog.mutex.Lock()
+				s.watchdog.stalled = ""
+				s.watchdog.mutex.Unlock()
+
+				s.events.publish(Event{Type: "recovered", Data: stalled})
+
+				if len(device.Scrcpy.Watchdog.RecoveryCommands) > 0 {
+					go s.runCommands(CommandSource{Transport: "watchdog"}, device.Scrcpy.Watchdog.RecoveryCommands)
+				}
+			} else {
+				s.handleStall(stalled, now.Sub(stalledAt))
+			}
+
+			continue
+		}
+
+		for _, stream := range []struct {
+			name    string
+			enabled bool
+			timeout int
+		}{
+			{"video", device.Scrcpy.Video, device.Scrcpy.Watchdog.VideoTimeout},
+			{"audio", device.Scrcpy.Audio, device.Scrcpy.Watchdog.AudioTimeout},
+			{"control", device.Scrcpy.Control, device.Scrcpy.Watchdog.ControlTimeout},
+		} {
+			if !stream.enabled || stream.timeout <= 0 {
+				continue
+			}
+
+			last := s.lastActivity(stream.name)
+			if last.Before(since) {
+				last = since
+			}
+
+			if now.Sub(last) < time.Duration(stream.timeout)*time.Millisecond {
+				continue
+			}
+
+			s.watchdog.mutex.Lock()
+			s.watchdog.stalled = stream.name
+			s.watchdog.stalledAt = now
+			s.watchdog.mutex.Unlock()
+
+			s.events.publish(Event{Type: "stall", Data: stream.name})
+
+			if len(device.Scrcpy.Watchdog.StallCommands) > 0 {
+				go s.runCommands(CommandSource{Transport: "watchdog"}, device.Scrcpy.Watchdog.StallCommands)
+			}
+
+			s.handleStall(stream.name, 0)
+			break
+		}
+	}
+}
+
+func (s *Session) handleStall(stream string, duration time.Duration) {
+	device := s.device()
+
+	s.watchdog.mutex.Lock()
+	resetVideo := !s.watchdog.resetVideo && stream == "video" && device.Scrcpy.Control
+	escalate := !s.watchdog.escalated && device.Scrcpy.Watchdog.EscalateTimeout > 0 && duration >= time.Duration(device.Scrcpy.Watchdog.EscalateTimeout)*time.Millisecond
+	if resetVideo {
+		s.watchdog.resetVideo = true
+	}
+	if escalate {
+		s.watchdog.escalated = true
+	}
+	s.watchdog.mutex.Unlock()
+
+	if resetVideo {
+		go s.runCommands(CommandSource{Transport: "watchdog"}, [][]string{{"resetvideo"}})
+	}
+
+	if escalate {
+		select {
+		case s.connectionControlChannel <- connectionRequest{reconnect: true, reason: fmt.Errorf("%s stalled", stream)}:
+		default:
+			slog.Warn("watchdog escalation skipped", "device", s.Name, "stream", stream, "error", errConnectionBusy)
+
+			s.watchdog.mutex.Lock()
+			s.watchdog.escalated = false
+			s.watchdog.mutex.Unlock()
+		}
+	}
+}
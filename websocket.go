@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var WebSocketOpcodes = struct {
+	Continuation byte
+	Text         byte
+	Binary       byte
+	Close        byte
+	Ping         byte
+	Pong         byte
+}{
+	Continuation: 0x0,
+	Text:         0x1,
+	Binary:       0x2,
+	Close:        0x8,
+	Ping:         0x9,
+	Pong:         0xA,
+}
+
+type webSocketConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+type webSocketResponse struct {
+	Type string `json:"type"`
+	CommandResponse
+}
+
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*webSocketConn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || req.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGuid))
+
+	_, err = conn.Write([]byte(
+		"HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n",
+	))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{conn: conn, reader: brw.Reader}, nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	var header []byte
+
+	switch {
+	case len(payload) < 126:
+		header = []byte{0x80 | opcode, byte(len(payload))}
+	case len(payload) <= 0xFFFF:
+		header = make([]byte, 4)
+		header[0] = 0x80 | opcode
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header = make([]byte, 10)
+		header[0] = 0x80 | opcode
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+func (c *webSocketConn) writeJson(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return c.writeFrame(WebSocketOpcodes.Text, data)
+}
+
+func (c *webSocketConn) readMessage(maxMessageSize int) ([]byte, error) {
+	var message []byte
+	header := make([]byte, 2)
+
+	for {
+		_, err := io.ReadFull(c.reader, header)
+		if err != nil {
+			return nil, err
+		}
+
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		size := uint64(header[1] & 0x7F)
+
+		if !masked {
+			return nil, errors.New("unmasked client frame")
+		}
+
+		switch size {
+		case 126:
+			_, err = io.ReadFull(c.reader, header)
+			if err != nil {
+				return nil, err
+			}
+
+			size = uint64(binary.BigEndian.Uint16(header))
+		case 127:
+			data := make([]byte, 8)
+
+			_, err = io.ReadFull(c.reader, data)
+			if err != nil {
+				return nil, err
+			}
+
+			size = binary.BigEndian.Uint64(data)
+		}
+
+		if size > uint64(maxMessageSize) || uint64(len(message))+size > uint64(maxMessageSize) {
+			c.writeFrame(WebSocketOpcodes.Close, []byte{0x03, 0xF1})
+			return nil, errMessageTooLarge
+		}
+
+		mask := make([]byte, 4)
+
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return nil, err
+		}
+
+		payload := make([]byte, size)
+
+		_, err = io.ReadFull(c.reader, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case WebSocketOpcodes.Close:
+			c.writeFrame(WebSocketOpcodes.Close, payload)
+			return nil, io.EOF
+		case WebSocketOpcodes.Ping:
+			err = c.writeFrame(WebSocketOpcodes.Pong, payload)
+			if err != nil {
+				return nil, err
+			}
+		case WebSocketOpcodes.Pong:
+		case WebSocketOpcodes.Text, WebSocketOpcodes.Binary, WebSocketOpcodes.Continuation:
+			message = append(message, payload...)
+
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, errors.New("unknown websocket opcode")
+		}
+	}
+}
+
+func webSocketHandler(w http.ResponseWriter, req *http.Request) {
+	s := requestSession(req)
+	w.Header().Set("Cache-Control", "no-store")
+
+	var tlsClient string
+	if config.HttpServer.ClientCa != "" {
+		tlsClient = tlsClientAuth(endpointClients(req.URL.Path), req.TLS)
+		if tlsClient == " " {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, err := upgradeWebSocket(w, req)
+	if err != nil {
+		slog.Warn("websocket upgrade failed", "remoteAddress", req.RemoteAddr, "error", err)
+		return
+	}
+	defer c.conn.Close()
+
+	slog.Info("websocket connected", "device", s.Name, "remoteAddress", req.RemoteAddr)
+	defer slog.Info("websocket disconnected", "device", s.Name, "remoteAddress", req.RemoteAddr)
+
+	events := s.events.subscribe(eventSubscriberBuffer)
+	defer s.events.unsubscribe(events)
+
+	requests := make(chan CommandRequest, 64)
+	defer close(requests)
+
+	go func() {
+		for r := range requests {
+			c.writeJson(webSocketResponse{
+				Type:            "results",
+				CommandResponse: CommandResponse{Id: r.Id, CommandResults: s.runCommands(httpCommandSource("websocket", req), r.Commands)},
+			})
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok || c.writeJson(e) != nil {
+					c.conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		message, err := c.readMessage(defaultMaxMessageSize)
+		if err != nil {
+			return
+		}
+
+		var r CommandRequest
+
+		err = json.Unmarshal(message, &r)
+		if err != nil {
+			if c.writeJson(webSocketResponse{Type: "results", CommandResponse: CommandResponse{Error: err.Error()}}) != nil {
+				return
+			}
+
+			continue
+		}
+
+		if len(r.Commands) == 0 {
+			continue
+		}
+
+		requests <- r
+	}
+}